@@ -0,0 +1,203 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// Websocket close codes sent to the devices and to the users; the
+// application specific codes are in the 4000-4999 range (RFC 6455 7.4.2).
+const (
+	// CloseConnectionReplaced: a newer connection of the device took over
+	CloseConnectionReplaced = 4000
+	// CloseProtocolViolation: the peer sent a malformed or unexpected message
+	CloseProtocolViolation = 4001
+	// CloseSessionTerminated: the session was terminated by an administrator
+	CloseSessionTerminated = 4002
+	// CloseDeviceDisconnected: the device of the session disconnected
+	CloseDeviceDisconnected = 4003
+	// CloseForbidden: the user is no longer allowed to access the device
+	CloseForbidden = 4004
+	// CloseSessionExpired: the session reached its idle timeout or its
+	// maximum duration
+	CloseSessionExpired = 4005
+	// CloseRecordingFailed: the recording of the session failed
+	CloseRecordingFailed = 4006
+
+	// CloseServerShutdown: the server is shutting down
+	CloseServerShutdown = websocket.CloseGoingAway
+	// CloseMessageTooLarge: the peer sent a message exceeding the limit
+	CloseMessageTooLarge = websocket.CloseMessageTooBig
+	// CloseInternalError: the server failed to handle the connection
+	CloseInternalError = websocket.CloseInternalServerErr
+)
+
+// maxCloseTextLength is the maximum length of the text of a close frame,
+// the payload of the control frames is limited to 125 bytes.
+const maxCloseTextLength = 123
+
+const (
+	// ProtoTypeControl is the protocol of the messages about the
+	// connection itself rather than a session.
+	ProtoTypeControl ws.ProtoType = 0xFFFF
+
+	// MessageTypeError is the type of the control messages reporting
+	// an error to the peer.
+	MessageTypeError = "error"
+	// MessageTypeHello is the type of the control messages advertising
+	// the capabilities of the device, the body is a msgpack encoded
+	// model.DeviceCapabilities.
+	MessageTypeHello = "hello"
+)
+
+// ProtoError is the body of the error control messages
+type ProtoError struct {
+	// Error is the human readable description of the error
+	Error string `msgpack:"err" json:"error"`
+	// Code is the close code of the connection, if Close is set
+	Code int `msgpack:"code,omitempty" json:"code,omitempty"`
+	// Close is set if the connection is closed after the error
+	Close bool `msgpack:"close,omitempty" json:"close,omitempty"`
+}
+
+// protocolError is returned when the peer violates the protocol
+type protocolError struct {
+	reason string
+}
+
+func (e *protocolError) Error() string {
+	return "protocol violation: " + e.reason
+}
+
+func newProtocolError(reason string) error {
+	return &protocolError{reason: reason}
+}
+
+type shutdownContextKey struct{}
+
+// ContextWithShutdown returns a context notifying the websocket handlers
+// that the server is shutting down when the done channel is closed; the
+// context is meant to be the base context of the HTTP server.
+func ContextWithShutdown(ctx context.Context, done <-chan struct{}) context.Context {
+	return context.WithValue(ctx, shutdownContextKey{}, done)
+}
+
+// shutdownFromContext returns the channel closed on server shutdown, the
+// channel is nil if the context does not carry one.
+func shutdownFromContext(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(shutdownContextKey{}).(<-chan struct{})
+	return done
+}
+
+// closeCodeForError returns the close code and text reporting the error
+// which terminated the connection; ok is false if the connection is already
+// gone and no close frame should be sent.
+func closeCodeForError(err error) (code int, text string, ok bool) {
+	var (
+		protoErr *protocolError
+		closeErr *websocket.CloseError
+		netErr   net.Error
+	)
+	switch {
+	case err == nil,
+		errors.As(err, &closeErr),
+		errors.As(err, &netErr),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, websocket.ErrCloseSent):
+		return 0, "", false
+	case errors.As(err, &protoErr):
+		return CloseProtocolViolation, protoErr.Error(), true
+	case errors.Is(err, websocket.ErrReadLimit):
+		return CloseMessageTooLarge, "message too large", true
+	default:
+		return CloseInternalError, "internal error", true
+	}
+}
+
+// closeCodeForReason returns the close code of a session closed by the
+// server for the given reason.
+func closeCodeForReason(reason string) int {
+	switch reason {
+	case model.SessionCloseReasonTerminated:
+		return CloseSessionTerminated
+	case model.SessionCloseReasonDeviceDisconnect:
+		return CloseDeviceDisconnected
+	case model.SessionCloseReasonIdleTimeout,
+		model.SessionCloseReasonMaxDuration:
+		return CloseSessionExpired
+	case model.SessionCloseReasonRecordingFailed:
+		return CloseRecordingFailed
+	default:
+		return websocket.CloseNormalClosure
+	}
+}
+
+// newErrorMessage returns the control message reporting the error which
+// closes the connection.
+func newErrorMessage(sessionID string, code int, text string) []byte {
+	body, _ := msgpack.Marshal(ProtoError{
+		Error: text,
+		Code:  code,
+		Close: true,
+	})
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ProtoTypeControl,
+			MsgType:   MessageTypeError,
+			SessionID: sessionID,
+		},
+		Body: body,
+	}
+	data, _ := msgpack.Marshal(msg)
+	return data
+}
+
+// closeWebsocket reports the error in-band, then sends the close frame with
+// the code and the text, truncated to fit in the control frame. It must be
+// called by the routine writing the messages on the connection.
+func closeWebsocket(
+	conn *websocket.Conn,
+	sessionID string,
+	code int,
+	text string,
+) error {
+	err := conn.WriteMessage(
+		websocket.BinaryMessage,
+		newErrorMessage(sessionID, code, text),
+	)
+	if err != nil {
+		return err
+	}
+	if len(text) > maxCloseTextLength {
+		text = text[:maxCloseTextLength]
+	}
+	return conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(writeWait),
+	)
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// assertErrorMessage checks that data is an error control message closing
+// the connection with the given code.
+func assertErrorMessage(t *testing.T, data []byte, code int) {
+	var msg ws.ProtoMsg
+	err := msgpack.Unmarshal(data, &msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ProtoTypeControl, msg.Header.Proto)
+	assert.Equal(t, MessageTypeError, msg.Header.MsgType)
+	var protoErr ProtoError
+	err = msgpack.Unmarshal(msg.Body, &protoErr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, code, protoErr.Code)
+		assert.True(t, protoErr.Close)
+		assert.NotEmpty(t, protoErr.Error)
+	}
+}
+
+func TestCloseCodeForError(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Err  error
+
+		Code int
+		Text string
+		OK   bool
+	}{
+		{
+			Name: "no error",
+		},
+		{
+			Name: "closed by the peer",
+			Err:  &websocket.CloseError{Code: websocket.CloseNormalClosure},
+		},
+		{
+			Name: "connection broken",
+			Err:  &net.OpError{Op: "read", Err: errors.New("reset")},
+		},
+		{
+			Name: "connection closed",
+			Err:  fmt.Errorf("read: %w", io.ErrUnexpectedEOF),
+		},
+		{
+			Name: "protocol violation",
+			Err:  newProtocolError("message missing required session ID"),
+			Code: CloseProtocolViolation,
+			Text: "protocol violation: message missing required session ID",
+			OK:   true,
+		},
+		{
+			Name: "message too large",
+			Err:  websocket.ErrReadLimit,
+			Code: CloseMessageTooLarge,
+			Text: "message too large",
+			OK:   true,
+		},
+		{
+			Name: "internal error",
+			Err:  errors.New("nats: connection closed"),
+			Code: CloseInternalError,
+			Text: "internal error",
+			OK:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, text, ok := closeCodeForError(tc.Err)
+			assert.Equal(t, tc.Code, code)
+			assert.Equal(t, tc.Text, text)
+			assert.Equal(t, tc.OK, ok)
+		})
+	}
+}
+
+func TestCloseCodeForReason(t *testing.T) {
+	assert.Equal(t, CloseSessionTerminated,
+		closeCodeForReason(model.SessionCloseReasonTerminated))
+	assert.Equal(t, CloseDeviceDisconnected,
+		closeCodeForReason(model.SessionCloseReasonDeviceDisconnect))
+	assert.Equal(t, CloseSessionExpired,
+		closeCodeForReason(model.SessionCloseReasonIdleTimeout))
+	assert.Equal(t, CloseSessionExpired,
+		closeCodeForReason(model.SessionCloseReasonMaxDuration))
+	assert.Equal(t, CloseRecordingFailed,
+		closeCodeForReason(model.SessionCloseReasonRecordingFailed))
+	assert.Equal(t, websocket.CloseNormalClosure,
+		closeCodeForReason(model.SessionCloseReasonUserDisconnect))
+}
+
+func TestCloseWebsocket(t *testing.T) {
+	done := make(chan struct{})
+	shutdown := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			ctx := ContextWithShutdown(context.Background(), shutdown)
+			<-shutdownFromContext(ctx)
+			err = closeWebsocket(conn, "session", CloseServerShutdown,
+				strings.Repeat("server shutting down ", 10))
+			assert.NoError(t, err)
+		},
+	))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	close(shutdown)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err := conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assertErrorMessage(t, data, CloseServerShutdown)
+	}
+	_, _, err = conn.ReadMessage()
+	if assert.IsType(t, &websocket.CloseError{}, err) {
+		closeErr := err.(*websocket.CloseError)
+		assert.Equal(t, CloseServerShutdown, closeErr.Code)
+		assert.Len(t, closeErr.Text, maxCloseTextLength)
+	}
+	<-done
+
+	// the context does not carry the shutdown channel
+	assert.Nil(t, shutdownFromContext(context.Background()))
+}
@@ -17,10 +17,14 @@ package http
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
@@ -41,6 +45,9 @@ var (
 
 	// Seconds allowed to write a message to the peer.
 	writeWait = time.Second * 10
+
+	// Time the sessions looked up by a device connection are cached.
+	sessionLookupTTL = time.Second * 10
 )
 
 // HTTP errors
@@ -52,18 +59,21 @@ var (
 
 // DeviceController container for end-points
 type DeviceController struct {
-	app  app.App
-	nats *nats.Conn
+	app    app.App
+	nats   *nats.Conn
+	config Config
 }
 
 // NewDeviceController returns a new DeviceController
 func NewDeviceController(
 	app app.App,
 	natsClient *nats.Conn,
+	config Config,
 ) *DeviceController {
 	return &DeviceController{
-		app:  app,
-		nats: natsClient,
+		app:    app,
+		nats:   natsClient,
+		config: config,
 	}
 }
 
@@ -103,6 +113,11 @@ func (h DeviceController) Provision(c *gin.Context) {
 	c.Writer.WriteHeader(http.StatusCreated)
 }
 
+// List responds to GET /tenants/:tenantId/devices
+func (h DeviceController) List(c *gin.Context) {
+	listDevices(c, h.app, c.Param("tenantId"))
+}
+
 // Delete responds to DELETE /tenants/:tenantId/devices/:deviceId
 func (h DeviceController) Delete(c *gin.Context) {
 	tenantID := c.Param("tenantId")
@@ -147,6 +162,21 @@ func (h DeviceController) Connect(c *gin.Context) {
 	//nolint:errcheck
 	defer sub.Unsubscribe()
 
+	ctrlChan := make(chan *nats.Msg, 1)
+	ctrlSub, err := h.nats.ChanSubscribe(
+		model.GetDeviceControlSubject(idata.Tenant, idata.Subject),
+		ctrlChan,
+	)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to allocate internal device channel",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer ctrlSub.Unsubscribe()
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -173,10 +203,20 @@ func (h DeviceController) Connect(c *gin.Context) {
 		l.Error(err)
 		return
 	}
+	if h.config.MaxMessageSize > 0 {
+		conn.SetReadLimit(h.config.MaxMessageSize)
+	}
+	devConn := &deviceConnection{
+		remoteAddr: c.ClientIP(),
+		heartbeat: &deviceHeartbeat{
+			app:      h.app,
+			interval: h.config.DeviceLastSeenInterval,
+		},
+	}
 	// websocketWriter is responsible for closing the websocket
 	//nolint:errcheck
-	go h.connectWSWriter(ctx, conn, msgChan, errChan)
-	err = h.ConnectServeWS(ctx, conn)
+	go h.connectWSWriter(ctx, conn, msgChan, ctrlChan, errChan, devConn)
+	err = h.ConnectServeWS(ctx, conn, devConn)
 	if err != nil {
 		select {
 		case errChan <- err:
@@ -189,18 +229,23 @@ func (h DeviceController) Connect(c *gin.Context) {
 
 // websocketWriter is the go-routine responsible for the writing end of the
 // websocket. The routine forwards messages posted on the NATS session subject
-// and periodically pings the connection. If the connection times out or a
-// protocol violation occurs, the routine closes the connection.
+// and periodically pings the connection. If the connection times out, a
+// protocol violation occurs or a newer connection of the device takes over,
+// the routine closes the connection.
 func (h DeviceController) connectWSWriter(
 	ctx context.Context,
 	conn *websocket.Conn,
 	msgChan <-chan *nats.Msg,
+	ctrlChan <-chan *nats.Msg,
 	errChan <-chan error,
+	devConn *deviceConnection,
 ) (err error) {
 	l := log.FromContext(ctx)
 	defer func() {
-		// TODO Check err and errChan and send close control packet
-		// with error if not initiated by client.
+		// report the error unless the connection is already gone
+		if code, text, ok := closeCodeForError(err); ok {
+			_ = closeWebsocket(conn, "", code, text)
+		}
 		conn.Close()
 	}()
 
@@ -216,10 +261,12 @@ func (h DeviceController) connectWSWriter(
 	defer ticker.Stop()
 	conn.SetPongHandler(func(string) error {
 		ticker.Reset(pingPeriod)
+		devConn.heartbeat.touch(ctx)
 		return conn.SetReadDeadline(time.Now().Add(pongWait))
 	})
 	conn.SetPingHandler(func(msg string) error {
 		ticker.Reset(pingPeriod)
+		devConn.heartbeat.touch(ctx)
 		err := conn.SetReadDeadline(time.Now().Add(pongWait))
 		if err != nil {
 			return err
@@ -239,6 +286,20 @@ Loop:
 				l.Error(err)
 				break Loop
 			}
+		case msg := <-ctrlChan:
+			if !devConn.replacedBy(msg.Data) {
+				continue
+			}
+			l.Infof("closing the connection of device %s: "+
+				"replaced by a newer connection",
+				identity.FromContext(ctx).Subject)
+			err = closeWebsocket(conn, "", CloseConnectionReplaced,
+				"replaced by a newer connection of the device")
+			break Loop
+		case <-shutdownFromContext(ctx):
+			err = closeWebsocket(conn, "", CloseServerShutdown,
+				"server shutting down")
+			break Loop
 		case <-ctx.Done():
 			break Loop
 		case <-ticker.C:
@@ -256,21 +317,44 @@ Loop:
 func (h DeviceController) ConnectServeWS(
 	ctx context.Context,
 	conn *websocket.Conn,
+	devConn *deviceConnection,
 ) (err error) {
 	l := log.FromContext(ctx)
 	id := identity.FromContext(ctx)
 	sessMap := make(map[string]struct{})
+	sessions := make(map[string]*deviceSession)
+	validator := newProtocolValidator(h.config, true)
 
 	// update the device status on websocket opening
-	err = h.app.UpdateDeviceStatus(
-		ctx, id.Tenant,
-		id.Subject, model.DeviceStatusConnected,
-	)
+	generation, err := h.app.ConnectDevice(ctx, id.Tenant, id.Subject)
 	if err != nil {
 		l.Error(err)
 		return
 	}
+	devConn.setGeneration(generation)
+	h.takeOverConnections(ctx, generation)
+	h.recordConnectionEvent(ctx, &model.ConnectionEvent{
+		DeviceID:   id.Subject,
+		Type:       model.ConnectionEventConnected,
+		RemoteAddr: devConn.remoteAddr,
+	})
+	stopPresence := h.keepPresence(ctx)
 	defer func() {
+		stopPresence()
+		validator.logSummary(ctx)
+		event := &model.ConnectionEvent{
+			DeviceID:   id.Subject,
+			Type:       model.ConnectionEventDisconnected,
+			RemoteAddr: devConn.remoteAddr,
+			Reason:     disconnectReason(err),
+		}
+		if devConn.isReplaced() {
+			event.Reason = model.DisconnectReasonReplaced
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		closeReason := model.SessionCloseReasonDeviceDisconnect
 		for sess := range sessMap {
 			// TODO: notify the session NATS topic about the session
 			//       being released.
@@ -280,50 +364,99 @@ func (h DeviceController) ConnectServeWS(
 					MsgType:   shell.MessageTypeStopShell,
 					SessionID: sess,
 					Properties: map[string]interface{}{
-						"status": shell.ErrorMessage,
+						"status":            shell.ErrorMessage,
+						PropertyCloseReason: closeReason,
 					},
 				},
 				Body: []byte("device disconnected"),
 			}
 			data, _ := msgpack.Marshal(msg)
-			err = h.nats.Publish(
+			// the error terminating the connection is kept for the
+			// websocket writer
+			errPub := h.nats.Publish(
 				model.GetSessionSubject(id.Tenant, sess),
 				data,
 			)
+			if errPub != nil {
+				l.Error(errPub)
+			}
 		}
-		// update the device status on websocket closing
-		err = h.app.UpdateDeviceStatus(
-			ctx, id.Tenant,
-			id.Subject, model.DeviceStatusDisconnected,
+		// update the device status on websocket closing, unless a
+		// newer connection of the device took over
+		errDisconnect := h.app.DisconnectDevice(
+			ctx, id.Tenant, id.Subject, generation,
 		)
-		if err != nil {
-			l.Error(err)
+		if errDisconnect != nil {
+			l.Error(errDisconnect)
 		}
+		h.recordConnectionEvent(ctx, event)
 	}()
 
-	var data []byte
+	var (
+		data  []byte
+		valid bool
+	)
 	for {
 		_, data, err = conn.ReadMessage()
 		if err != nil {
 			return err
 		}
+		devConn.heartbeat.touch(ctx)
 		m := &ws.ProtoMsg{}
 		err = msgpack.Unmarshal(data, m)
+		if err != nil {
+			return newProtocolError("malformed message: " + err.Error())
+		}
+
+		valid, err = validator.validate(ctx, &m.Header)
 		if err != nil {
 			return err
+		} else if !valid {
+			continue
+		} else if m.Header.Proto == ProtoTypeControl {
+			err = h.handleControlMessage(ctx, validator, m)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the device may only publish into its own sessions
+		devSess, errLookup := h.lookupSession(
+			ctx, sessions, m.Header.SessionID,
+		)
+		if errLookup != nil {
+			l.Errorf("dropping message of session %s: %s",
+				m.Header.SessionID, errLookup.Error())
+			continue
+		} else if devSess.session == nil {
+			err = validator.violate(ctx, &protocolViolation{
+				kind: violationForeignSession,
+				reason: fmt.Sprintf(
+					"session %q does not belong to the device",
+					m.Header.SessionID,
+				),
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		} else if devSess.session.Status == model.SessionStatusDisconnected {
+			// the output of a closed session has nowhere to go
+			delete(sessMap, m.Header.SessionID)
+			delete(sessions, m.Header.SessionID)
+			continue
 		}
 
 		sessMap[m.Header.SessionID] = struct{}{}
-		switch m.Header.Proto {
-		case ws.ProtoTypeShell:
-			if m.Header.SessionID == "" {
-				return errors.New("api: message missing required session ID")
+		if m.Header.Proto == ws.ProtoTypeShell {
+			if !h.recordFrame(ctx, devSess, data) {
+				continue
 			}
 			if m.Header.MsgType == shell.MessageTypeStopShell {
 				delete(sessMap, m.Header.SessionID)
+				delete(sessions, m.Header.SessionID)
 			}
-		default:
-			// TODO: Handle protocol violation
 		}
 
 		err = h.nats.Publish(
@@ -335,3 +468,269 @@ func (h DeviceController) ConnectServeWS(
 		}
 	}
 }
+
+// handleControlMessage handles the control messages sent by the device,
+// which are not relayed to the sessions.
+func (h DeviceController) handleControlMessage(
+	ctx context.Context,
+	validator *protocolValidator,
+	m *ws.ProtoMsg,
+) error {
+	if m.Header.MsgType != MessageTypeHello {
+		return nil
+	}
+	id := identity.FromContext(ctx)
+	capabilities := &model.DeviceCapabilities{}
+	err := msgpack.Unmarshal(m.Body, capabilities)
+	if err != nil {
+		return validator.violate(ctx, &protocolViolation{
+			kind:   violationInvalidBody,
+			reason: "malformed capabilities: " + err.Error(),
+		})
+	}
+	err = h.app.UpdateDeviceCapabilities(
+		ctx, id.Tenant, id.Subject, capabilities,
+	)
+	if _, ok := errors.Cause(err).(validation.Errors); ok {
+		return validator.violate(ctx, &protocolViolation{
+			kind:   violationInvalidBody,
+			reason: "invalid capabilities: " + err.Error(),
+		})
+	} else if err != nil {
+		log.FromContext(ctx).Error(err)
+	}
+	return nil
+}
+
+// deviceConnection holds the state of a websocket connection of a device
+// shared by the reading and the writing routines.
+type deviceConnection struct {
+	remoteAddr string
+	heartbeat  *deviceHeartbeat
+	// generation of the connection, only the latest connection of the
+	// device updates the device status; accessed atomically.
+	generation int64
+	// replaced is set when a newer connection of the device took over
+	replaced int32
+}
+
+func (c *deviceConnection) setGeneration(generation int64) {
+	atomic.StoreInt64(&c.generation, generation)
+}
+
+// replacedBy returns true and marks the connection replaced if the takeover
+// message comes from a newer connection of the device.
+func (c *deviceConnection) replacedBy(data []byte) bool {
+	var takeover connectionTakeover
+	if err := msgpack.Unmarshal(data, &takeover); err != nil {
+		return false
+	}
+	generation := atomic.LoadInt64(&c.generation)
+	if generation == 0 || takeover.Generation <= generation {
+		return false
+	}
+	atomic.StoreInt32(&c.replaced, 1)
+	return true
+}
+
+func (c *deviceConnection) isReplaced() bool {
+	return atomic.LoadInt32(&c.replaced) != 0
+}
+
+// connectionTakeover is published on the control subject of the device when
+// the device connects, to close its older connections.
+type connectionTakeover struct {
+	Generation int64 `msgpack:"generation"`
+}
+
+// takeOverConnections notifies the older connections of the device that the
+// connection of the given generation took over.
+func (h DeviceController) takeOverConnections(
+	ctx context.Context,
+	generation int64,
+) {
+	id := identity.FromContext(ctx)
+	data, _ := msgpack.Marshal(connectionTakeover{Generation: generation})
+	err := h.nats.Publish(
+		model.GetDeviceControlSubject(id.Tenant, id.Subject),
+		data,
+	)
+	if err != nil {
+		log.FromContext(ctx).Errorf(
+			"failed to take over the connections of device %s: %s",
+			id.Subject, err.Error(),
+		)
+	}
+}
+
+// keepPresence renews the presence lease of the device until the returned
+// function is called, so the device does not stay connected if this instance
+// dies without updating the device status.
+func (h DeviceController) keepPresence(ctx context.Context) (stop func()) {
+	lease := h.config.DevicePresenceLease
+	if lease <= 0 {
+		return func() {}
+	}
+	l := log.FromContext(ctx)
+	id := identity.FromContext(ctx)
+	renew := func() {
+		err := h.app.RenewDevicePresence(ctx, id.Tenant, id.Subject, lease)
+		if err != nil {
+			l.Errorf("failed to renew the presence of device %s: %s",
+				id.Subject, err.Error())
+		}
+	}
+	renew()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				renew()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// deviceHeartbeat updates the last seen time of the device it is heard
+// from, at most once per interval.
+type deviceHeartbeat struct {
+	app      app.App
+	interval time.Duration
+	// last is the time of the last update in nanoseconds, it is
+	// accessed atomically by the reading and writing routines.
+	last int64
+}
+
+func (hb *deviceHeartbeat) touch(ctx context.Context) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&hb.last)
+	if now-last < int64(hb.interval) ||
+		!atomic.CompareAndSwapInt64(&hb.last, last, now) {
+		return
+	}
+	id := identity.FromContext(ctx)
+	err := hb.app.UpdateDeviceLastSeen(ctx, id.Tenant, id.Subject)
+	if err != nil {
+		log.FromContext(ctx).Errorf(
+			"failed to update the last seen time of device %s: %s",
+			id.Subject, err.Error(),
+		)
+	}
+}
+
+// recordConnectionEvent appends the event to the connection history of the
+// device; failures are logged and do not affect the connection.
+func (h DeviceController) recordConnectionEvent(
+	ctx context.Context,
+	event *model.ConnectionEvent,
+) {
+	id := identity.FromContext(ctx)
+	err := h.app.RecordConnectionEvent(ctx, id.Tenant, event)
+	if err != nil {
+		log.FromContext(ctx).Errorf(
+			"failed to record the %s event of device %s: %s",
+			event.Type, event.DeviceID, err.Error(),
+		)
+	}
+}
+
+// disconnectReason classifies the error terminating the device connection
+func disconnectReason(err error) string {
+	var (
+		closeErr *websocket.CloseError
+		netErr   net.Error
+	)
+	switch {
+	case errors.As(err, &closeErr):
+		if closeErr.Code == websocket.CloseAbnormalClosure {
+			return model.DisconnectReasonLost
+		}
+		return model.DisconnectReasonClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return model.DisconnectReasonTimeout
+	default:
+		return model.DisconnectReasonError
+	}
+}
+
+// deviceSession holds the state of a session relayed by the device, the
+// session is looked up again once the cached lookup expires; session is nil
+// if the session does not belong to the device.
+type deviceSession struct {
+	session *model.Session
+	// recordingFailed is set once the recording of the session failed
+	recordingFailed bool
+	// expires is the time the cached lookup expires
+	expires time.Time
+}
+
+// lookupSession returns the state of the session relayed by the device, the
+// result of the lookup is cached for sessionLookupTTL.
+func (h DeviceController) lookupSession(
+	ctx context.Context,
+	sessions map[string]*deviceSession,
+	sessionID string,
+) (*deviceSession, error) {
+	devSess, ok := sessions[sessionID]
+	if ok && time.Now().Before(devSess.expires) {
+		return devSess, nil
+	} else if !ok {
+		devSess = &deviceSession{}
+	}
+	devSess.session = nil
+	if sessionID != "" {
+		sess, err := h.app.GetSession(ctx, sessionID)
+		if err != nil && err != app.ErrSessionNotFound {
+			return nil, err
+		}
+		id := identity.FromContext(ctx)
+		if sess != nil && sess.DeviceID == id.Subject {
+			devSess.session = sess
+		}
+	}
+	devSess.expires = time.Now().Add(sessionLookupTTL)
+	sessions[sessionID] = devSess
+	return devSess, nil
+}
+
+// recordFrame records the output of the recorded sessions; it returns false
+// if the message must not be relayed because the recording failed.
+func (h DeviceController) recordFrame(
+	ctx context.Context,
+	devSess *deviceSession,
+	data []byte,
+) bool {
+	l := log.FromContext(ctx)
+	if !devSess.session.Recorded {
+		return true
+	} else if devSess.recordingFailed && h.config.RecordingFailClosed {
+		return false
+	}
+
+	err := h.app.RecordSessionFrame(
+		ctx, devSess.session.ID, model.RecordingDirectionOutput, data,
+	)
+	if err == nil {
+		return true
+	}
+	l.Error(err)
+	if !devSess.recordingFailed {
+		devSess.recordingFailed = true
+		id := identity.FromContext(ctx)
+		err = publishRecordingFailure(
+			h.nats, id.Tenant, devSess.session,
+			h.config.RecordingFailClosed,
+		)
+		if err != nil {
+			l.Error(err)
+		}
+	}
+	return !h.config.RecordingFailClosed
+}
@@ -18,17 +18,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/deviceconnect/app"
 	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
 	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/nats-io/nats.go"
 	"github.com/vmihailenco/msgpack/v5"
 
@@ -65,22 +70,74 @@ func TestDeviceConnect(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
 			app := &app_mocks.App{}
-			app.On("UpdateDeviceStatus",
+			app.On("ConnectDevice",
 				mock.MatchedBy(func(_ context.Context) bool {
 					return true
 				}),
 				tc.Identity.Tenant,
 				tc.Identity.Subject,
-				model.DeviceStatusConnected,
+			).Return(int64(1), nil)
+
+			app.On("DisconnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.Identity.Tenant,
+				tc.Identity.Subject,
+				int64(1),
 			).Return(nil)
 
-			app.On("UpdateDeviceStatus",
+			app.On("UpdateDeviceLastSeen",
 				mock.MatchedBy(func(_ context.Context) bool {
 					return true
 				}),
 				tc.Identity.Tenant,
 				tc.Identity.Subject,
-				model.DeviceStatusDisconnected,
+			).Return(nil)
+
+			app.On("RecordConnectionEvent",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.Identity.Tenant,
+				mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+					return event.DeviceID == tc.Identity.Subject &&
+						event.Type == model.ConnectionEventConnected &&
+						event.RemoteAddr != ""
+				}),
+			).Return(nil).Once()
+
+			app.On("RecordConnectionEvent",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.Identity.Tenant,
+				mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+					return event.DeviceID == tc.Identity.Subject &&
+						event.Type == model.ConnectionEventDisconnected &&
+						event.Reason == model.DisconnectReasonLost &&
+						event.Error != ""
+				}),
+			).Return(errors.New("record error")).Once()
+
+			app.On("GetSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				"foobar",
+			).Return(&model.Session{
+				ID:       "foobar",
+				DeviceID: tc.Identity.Subject,
+				Recorded: true,
+			}, nil).Once()
+
+			app.On("RecordSessionFrame",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				"foobar",
+				model.RecordingDirectionOutput,
+				mock.AnythingOfType("[]uint8"),
 			).Return(nil)
 
 			natsClient := NewNATSTestClient(t)
@@ -129,7 +186,7 @@ func TestDeviceConnect(t *testing.T) {
 			msg := ws.ProtoMsg{
 				Header: ws.ProtoHdr{
 					Proto:     ws.ProtoTypeShell,
-					MsgType:   "cmd",
+					MsgType:   shell.MessageTypeShellCommand,
 					SessionID: "foobar",
 				},
 			}
@@ -198,6 +255,576 @@ func TestDeviceConnect(t *testing.T) {
 	}
 }
 
+func TestDeviceConnectReplaced(t *testing.T) {
+	id := identity.Identity{
+		Subject:  "00000000-0000-0000-0000-000000000000",
+		Tenant:   "000000000000000000000000",
+		IsDevice: true,
+	}
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	app.On("ConnectDevice",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		id.Subject,
+	).Return(int64(1), nil).Once()
+	app.On("ConnectDevice",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		id.Subject,
+	).Return(int64(2), nil).Once()
+
+	disconnected := make(chan int64, 2)
+	app.On("DisconnectDevice",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		id.Subject,
+		mock.AnythingOfType("int64"),
+	).Run(func(args mock.Arguments) {
+		disconnected <- args.Get(3).(int64)
+	}).Return(nil)
+
+	app.On("RecordConnectionEvent",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+			return event.Type == model.ConnectionEventConnected
+		}),
+	).Return(nil).Twice()
+	app.On("RecordConnectionEvent",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+			return event.Type == model.ConnectionEventDisconnected &&
+				event.Reason == model.DisconnectReasonReplaced
+		}),
+	).Return(nil).Once()
+	app.On("RecordConnectionEvent",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		id.Tenant,
+		mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+			return event.Type == model.ConnectionEventDisconnected &&
+				event.Reason != model.DisconnectReasonReplaced
+		}),
+	).Return(nil).Once()
+
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(app, natsClient)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + APIURLDevicesConnect
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+
+	oldConn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer oldConn.Close()
+	// wait for the first connection to be established
+	time.Sleep(100 * time.Millisecond)
+
+	newConn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// the old connection is closed with the replaced close code
+	err = oldConn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	assert.NoError(t, err)
+	_, data, err := oldConn.ReadMessage()
+	if assert.NoError(t, err) {
+		assertErrorMessage(t, data, CloseConnectionReplaced)
+	}
+	_, _, err = oldConn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseConnectionReplaced),
+		"unexpected error: %v", err)
+
+	select {
+	case generation := <-disconnected:
+		assert.Equal(t, int64(1), generation)
+	case <-time.After(time.Second * 2):
+		assert.Fail(t, "the old connection did not terminate")
+	}
+
+	newConn.Close()
+	select {
+	case generation := <-disconnected:
+		assert.Equal(t, int64(2), generation)
+	case <-time.After(time.Second * 2):
+		assert.Fail(t, "the new connection did not terminate")
+	}
+	// wait for the connection events to be recorded
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestDeviceConnectSessionOwnership(t *testing.T) {
+	id := identity.Identity{
+		Subject:  "00000000-0000-0000-0000-000000000000",
+		Tenant:   "000000000000000000000000",
+		IsDevice: true,
+	}
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name   string
+		Config Config
+
+		Session       *model.Session
+		GetSessionErr error
+		LookupTTL     time.Duration
+		// Lookups is the number of times the session is looked up
+		Lookups int
+		Closed  bool
+	}{
+		{
+			Name: "ok, session of the device",
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: id.Subject,
+			},
+			Lookups: 1,
+		},
+		{
+			Name: "ok, cached lookup expires",
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: id.Subject,
+			},
+			LookupTTL: time.Nanosecond,
+			Lookups:   2,
+		},
+		{
+			Name: "ok, session closed",
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: id.Subject,
+				Status:   model.SessionStatusDisconnected,
+			},
+			Lookups: 2,
+		},
+		{
+			Name: "error, session of another device",
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: "00000000-0000-0000-0000-000000000002",
+			},
+			Lookups: 1,
+		},
+		{
+			Name:          "error, session not found",
+			Config:        Config{ProtocolValidation: ProtocolValidationStrict},
+			GetSessionErr: app.ErrSessionNotFound,
+			Lookups:       1,
+			Closed:        true,
+		},
+		{
+			Name:          "error, failed to look up the session",
+			GetSessionErr: errors.New("store: internal error"),
+			Lookups:       2,
+		},
+	}
+	prevLookupTTL := sessionLookupTTL
+	defer func() {
+		sessionLookupTTL = prevLookupTTL
+	}()
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sessionLookupTTL = prevLookupTTL
+			if tc.LookupTTL > 0 {
+				sessionLookupTTL = tc.LookupTTL
+			}
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			app.On("ConnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(int64(1), nil)
+			disconnected := make(chan struct{})
+			app.On("DisconnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+				int64(1),
+			).Run(func(mock.Arguments) {
+				close(disconnected)
+			}).Return(nil)
+			app.On("UpdateDeviceLastSeen",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(nil).Maybe()
+			app.On("RecordConnectionEvent",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				mock.AnythingOfType("*model.ConnectionEvent"),
+			).Return(nil)
+			app.On("GetSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(tc.Session, tc.GetSessionErr).Times(tc.Lookups)
+
+			natsClient := NewNATSTestClient(t)
+			sessChan := make(chan *nats.Msg, 2)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetSessionSubject(id.Tenant, sessionID), sessChan,
+			)
+			defer sub.Unsubscribe()
+
+			router, _ := NewRouter(app, natsClient, tc.Config)
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				APIURLDevicesConnect
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			msg, _ := msgpack.Marshal(ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   shell.MessageTypeShellCommand,
+					SessionID: sessionID,
+				},
+				Body: []byte("ls"),
+			})
+			messages := 2
+			if tc.Closed {
+				messages = 1
+			}
+			for i := 0; i < messages; i++ {
+				err = conn.WriteMessage(websocket.BinaryMessage, msg)
+				assert.NoError(t, err)
+			}
+
+			if tc.Closed {
+				err = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+				assert.NoError(t, err)
+				_, data, err := conn.ReadMessage()
+				if assert.NoError(t, err) {
+					assertErrorMessage(t, data, CloseProtocolViolation)
+				}
+			} else if tc.GetSessionErr == nil &&
+				tc.Session.DeviceID == id.Subject &&
+				tc.Session.Status != model.SessionStatusDisconnected {
+				for i := 0; i < messages; i++ {
+					select {
+					case natsMsg := <-sessChan:
+						assert.Equal(t, msg, natsMsg.Data)
+					case <-time.After(time.Second):
+						assert.Fail(t, "timeout waiting for message")
+					}
+				}
+				conn.Close()
+			} else {
+				select {
+				case <-sessChan:
+					assert.Fail(t, "message published into the session")
+				case <-time.After(500 * time.Millisecond):
+				}
+				conn.Close()
+			}
+
+			select {
+			case <-disconnected:
+			case <-time.After(time.Second * 2):
+				assert.Fail(t, "the connection did not terminate")
+			}
+			// wait for the connection events to be recorded
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+}
+
+func TestDeviceConnectHello(t *testing.T) {
+	id := identity.Identity{
+		Subject:  "00000000-0000-0000-0000-000000000000",
+		Tenant:   "000000000000000000000000",
+		IsDevice: true,
+	}
+	capabilities := &model.DeviceCapabilities{
+		AgentVersion: "2.0.0",
+		Protocols:    []string{model.ProtocolShell},
+		Shells:       []string{"/bin/sh"},
+	}
+	testCases := []struct {
+		Name      string
+		Body      []byte
+		Malformed bool
+
+		UpdateErr error
+		Closed    bool
+	}{
+		{
+			Name: "ok",
+			Body: func() []byte {
+				b, _ := msgpack.Marshal(capabilities)
+				return b
+			}(),
+		},
+		{
+			Name: "ok, failed to store the capabilities",
+			Body: func() []byte {
+				b, _ := msgpack.Marshal(capabilities)
+				return b
+			}(),
+			UpdateErr: errors.New("store: internal error"),
+		},
+		{
+			Name: "error, invalid capabilities",
+			Body: func() []byte {
+				b, _ := msgpack.Marshal(capabilities)
+				return b
+			}(),
+			UpdateErr: validation.Errors{
+				"protocols": errors.New("cannot be blank"),
+			},
+			Closed: true,
+		},
+		{
+			Name:      "error, malformed capabilities",
+			Body:      []byte("capabilities"),
+			Malformed: true,
+			Closed:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			app.On("ConnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(int64(1), nil)
+			disconnected := make(chan struct{})
+			app.On("DisconnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+				int64(1),
+			).Run(func(mock.Arguments) {
+				close(disconnected)
+			}).Return(nil)
+			app.On("UpdateDeviceLastSeen",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(nil).Maybe()
+			app.On("RecordConnectionEvent",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				mock.AnythingOfType("*model.ConnectionEvent"),
+			).Return(nil)
+			updated := make(chan struct{})
+			if !tc.Malformed {
+				app.On("UpdateDeviceCapabilities",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					id.Tenant,
+					id.Subject,
+					capabilities,
+				).Run(func(mock.Arguments) {
+					close(updated)
+				}).Return(tc.UpdateErr)
+			}
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, Config{
+				ProtocolValidation: ProtocolValidationStrict,
+			})
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				APIURLDevicesConnect
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			msg, _ := msgpack.Marshal(ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ProtoTypeControl,
+					MsgType: MessageTypeHello,
+				},
+				Body: tc.Body,
+			})
+			err = conn.WriteMessage(websocket.BinaryMessage, msg)
+			assert.NoError(t, err)
+
+			if tc.Closed {
+				err = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+				assert.NoError(t, err)
+				_, data, err := conn.ReadMessage()
+				if assert.NoError(t, err) {
+					assertErrorMessage(t, data, CloseProtocolViolation)
+				}
+			} else {
+				select {
+				case <-updated:
+				case <-time.After(time.Second * 2):
+					assert.Fail(t, "the capabilities were not stored")
+				}
+				conn.Close()
+			}
+
+			select {
+			case <-disconnected:
+			case <-time.After(time.Second * 2):
+				assert.Fail(t, "the connection did not terminate")
+			}
+			// wait for the connection events to be recorded
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+}
+
+func TestDeviceHeartbeat(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject:  deviceID,
+		Tenant:   tenantID,
+		IsDevice: true,
+	})
+
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	app.On("UpdateDeviceLastSeen", ctx, tenantID, deviceID).
+		Return(errors.New("store: internal error")).Once()
+	app.On("UpdateDeviceLastSeen", ctx, tenantID, deviceID).
+		Return(nil).Once()
+
+	heartbeat := &deviceHeartbeat{app: app, interval: time.Hour}
+	heartbeat.touch(ctx)
+	// throttled
+	heartbeat.touch(ctx)
+	heartbeat.touch(ctx)
+
+	heartbeat.last -= int64(time.Hour)
+	heartbeat.touch(ctx)
+}
+
+func TestDeviceKeepPresence(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+		lease    = time.Millisecond * 150
+	)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject:  deviceID,
+		Tenant:   tenantID,
+		IsDevice: true,
+	})
+
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	renewed := make(chan struct{}, 10)
+	app.On("RenewDevicePresence", ctx, tenantID, deviceID, lease).
+		Return(errors.New("store: internal error")).Once()
+	app.On("RenewDevicePresence", ctx, tenantID, deviceID, lease).
+		Run(func(mock.Arguments) {
+			renewed <- struct{}{}
+		}).
+		Return(nil)
+
+	h := NewDeviceController(app, nil, Config{DevicePresenceLease: lease})
+	stop := h.keepPresence(ctx)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-renewed:
+		case <-time.After(lease):
+			assert.Fail(t, "presence lease not renewed")
+		}
+	}
+	stop()
+
+	// disabled
+	h = NewDeviceController(app, nil, Config{})
+	h.keepPresence(ctx)()
+}
+
+func TestDisconnectReason(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Err    error
+		Reason string
+	}{
+		{
+			Name: "closed by the device",
+			Err: &websocket.CloseError{
+				Code: websocket.CloseNormalClosure,
+			},
+			Reason: model.DisconnectReasonClosed,
+		},
+		{
+			Name: "connection lost",
+			Err: fmt.Errorf("read failed: %w", &websocket.CloseError{
+				Code: websocket.CloseAbnormalClosure,
+			}),
+			Reason: model.DisconnectReasonLost,
+		},
+		{
+			Name:   "pong timeout",
+			Err:    &net.DNSError{IsTimeout: true},
+			Reason: model.DisconnectReasonTimeout,
+		},
+		{
+			Name:   "protocol error",
+			Err:    errors.New("api: message missing required session ID"),
+			Reason: model.DisconnectReasonError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Reason, disconnectReason(tc.Err))
+		})
+	}
+}
+
 func TestDeviceConnectFailures(t *testing.T) {
 	JWT := GenerateJWT(identity.Identity{
 		Subject:  "00000000-0000-0000-0000-000000000000",
@@ -275,6 +902,74 @@ func TestDeviceConnectFailures(t *testing.T) {
 	}
 }
 
+func TestListDevices(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		TenantID   string
+		Query      string
+		Filter     *model.DeviceFilter
+		SearchErr  error
+		HTTPStatus int
+	}{
+		{
+			Name:     "ok",
+			TenantID: "1234",
+			Query:    "?status=disconnected&sort=asc",
+			Filter: &model.DeviceFilter{
+				Status: model.DeviceStatusDisconnected,
+				Sort:   model.SortAscending,
+				Limit:  20,
+			},
+			HTTPStatus: http.StatusOK,
+		},
+		{
+			Name:       "ko, bad sort",
+			TenantID:   "1234",
+			Query:      "?sort=sideways",
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, error",
+			TenantID: "1234",
+			Filter: &model.DeviceFilter{
+				Sort:  model.SortDescending,
+				Limit: 20,
+			},
+			SearchErr:  errors.New("error"),
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			deviceConnectApp := &app_mocks.App{}
+			if tc.Filter != nil {
+				deviceConnectApp.On("SearchDevices",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.TenantID,
+					*tc.Filter,
+				).Return([]model.Device{}, int64(0), tc.SearchErr)
+			}
+
+			router, _ := NewRouter(deviceConnectApp, nil)
+
+			url := strings.Replace(APIURLInternalDevices, ":tenantId", tc.TenantID, 1)
+			req, err := http.NewRequest("GET", url+tc.Query, nil)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			deviceConnectApp.AssertExpectations(t)
+		})
+	}
+}
+
 func TestProvisionDevice(t *testing.T) {
 	testCases := []struct {
 		Name               string
@@ -0,0 +1,137 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+)
+
+var (
+	// sessionLimitUnit is the unit of the session limits in the settings
+	sessionLimitUnit = time.Minute
+	// sessionLimitsCheckPeriod is the period for checking the limits
+	sessionLimitsCheckPeriod = time.Second
+	// sessionExpiryWarning is how long before the session expires the user
+	// is warned.
+	sessionExpiryWarning = time.Minute
+)
+
+// sessionLimits holds the idle timeout and the maximum duration of a session
+type sessionLimits struct {
+	start       time.Time
+	idleTimeout time.Duration
+	maxDuration time.Duration
+}
+
+func newSessionLimits(sess *model.Session) sessionLimits {
+	return sessionLimits{
+		start:       sess.StartTS,
+		idleTimeout: time.Duration(sess.IdleTimeout) * sessionLimitUnit,
+		maxDuration: time.Duration(sess.MaxDuration) * sessionLimitUnit,
+	}
+}
+
+func (l sessionLimits) enabled() bool {
+	return l.idleTimeout > 0 || l.maxDuration > 0
+}
+
+// deadline returns the time the session expires given the time of the last
+// user input, and the reason of the expiry.
+func (l sessionLimits) deadline(lastInput time.Time) (time.Time, string) {
+	var (
+		deadline time.Time
+		reason   string
+	)
+	if l.maxDuration > 0 {
+		deadline = l.start.Add(l.maxDuration)
+		reason = model.SessionCloseReasonMaxDuration
+	}
+	if l.idleTimeout > 0 {
+		idleDeadline := lastInput.Add(l.idleTimeout)
+		if reason == "" || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			reason = model.SessionCloseReasonIdleTimeout
+		}
+	}
+	return deadline, reason
+}
+
+// sessionExpiryText returns the text explaining why the session expired
+func sessionExpiryText(reason string) string {
+	if reason == model.SessionCloseReasonIdleTimeout {
+		return "session closed due to inactivity"
+	}
+	return "session closed: maximum session duration reached"
+}
+
+// newExpiryWarning returns the control message warning the user that the
+// session is about to expire.
+func newExpiryWarning(
+	sess *model.Session,
+	reason string,
+	remaining time.Duration,
+) []byte {
+	body := fmt.Sprintf(
+		"warning: the session will be closed in %d seconds",
+		int(remaining.Round(time.Second).Seconds()),
+	)
+	if reason == model.SessionCloseReasonIdleTimeout {
+		body += " due to inactivity"
+	} else {
+		body += " as it reaches the maximum session duration"
+	}
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sess.ID,
+			Properties: map[string]interface{}{
+				"status": shell.ControlMessage,
+			},
+		},
+		Body: []byte(body),
+	}
+	data, _ := msgpack.Marshal(msg)
+	return data
+}
+
+// newStopShellMessage returns the message stopping the shell of the session;
+// closeReason is set if the session is stopped by the server.
+func newStopShellMessage(sess *model.Session, closeReason, body string) []byte {
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: sess.ID,
+			Properties: map[string]interface{}{
+				"status":       shell.ErrorMessage,
+				PropertyUserID: sess.UserID,
+			},
+		},
+		Body: []byte(body),
+	}
+	if closeReason != "" {
+		msg.Header.Properties[PropertyCloseReason] = closeReason
+	}
+	data, _ := msgpack.Marshal(msg)
+	return data
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestSessionLimitsDeadline(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	lastInput := time.Now().Add(-time.Minute)
+	testCases := []struct {
+		Name    string
+		Session *model.Session
+
+		Enabled  bool
+		Deadline time.Time
+		Reason   string
+	}{{
+		Name:    "no limits",
+		Session: &model.Session{StartTS: start},
+	}, {
+		Name: "idle timeout",
+		Session: &model.Session{
+			StartTS:     start,
+			IdleTimeout: 10,
+		},
+
+		Enabled:  true,
+		Deadline: lastInput.Add(10 * time.Minute),
+		Reason:   model.SessionCloseReasonIdleTimeout,
+	}, {
+		Name: "maximum duration",
+		Session: &model.Session{
+			StartTS:     start,
+			MaxDuration: 120,
+		},
+
+		Enabled:  true,
+		Deadline: start.Add(120 * time.Minute),
+		Reason:   model.SessionCloseReasonMaxDuration,
+	}, {
+		Name: "maximum duration before idle timeout",
+		Session: &model.Session{
+			StartTS:     start,
+			IdleTimeout: 10,
+			MaxDuration: 65,
+		},
+
+		Enabled:  true,
+		Deadline: start.Add(65 * time.Minute),
+		Reason:   model.SessionCloseReasonMaxDuration,
+	}, {
+		Name: "idle timeout before maximum duration",
+		Session: &model.Session{
+			StartTS:     start,
+			IdleTimeout: 10,
+			MaxDuration: 120,
+		},
+
+		Enabled:  true,
+		Deadline: lastInput.Add(10 * time.Minute),
+		Reason:   model.SessionCloseReasonIdleTimeout,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			limits := newSessionLimits(tc.Session)
+			assert.Equal(t, tc.Enabled, limits.enabled())
+			if !tc.Enabled {
+				return
+			}
+			deadline, reason := limits.deadline(lastInput)
+			assert.Equal(t, tc.Deadline, deadline)
+			assert.Equal(t, tc.Reason, reason)
+		})
+	}
+}
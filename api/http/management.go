@@ -16,9 +16,15 @@ package http
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -42,34 +48,1158 @@ var (
 	ErrMissingUserAuthentication = errors.New(
 		"missing or non-user identity in the authorization headers",
 	)
+	ErrSessionClosed = errors.New("session is already closed")
 )
 
 const channelSize = 25 // TODO make configurable
 
 const (
-	PropertyUserID = "user_id"
+	PropertyUserID       = "user_id"
+	PropertyTerminatedBy = "terminated_by"
+	PropertyCloseReason  = "close_reason"
+
+	PropertyTerminalWidth  = "terminal_width"
+	PropertyTerminalHeight = "terminal_height"
+)
+
+const (
+	hdrLink       = "Link"
+	hdrTotalCount = "X-Total-Count"
+
+	qUserID      = "user_id"
+	qDeviceID    = "device_id"
+	qStatus      = "status"
+	qStartTsFrom = "start_ts_from"
+	qStartTsTo   = "start_ts_to"
+	qSort        = "sort"
+
+	qSpeed  = "speed"
+	qSeek   = "seek"
+	qFormat = "format"
+
+	formatAsciicast = "asciicast"
+)
+
+// Bounds of the playback speed multiplier
+const (
+	playbackSpeedMin = 0.1
+	playbackSpeedMax = 100.0
 )
 
-// ManagementController container for end-points
-type ManagementController struct {
-	app  app.App
-	nats *nats.Conn
+// ManagementController container for end-points
+type ManagementController struct {
+	app    app.App
+	nats   *nats.Conn
+	config Config
+}
+
+// NewManagementController returns a new ManagementController
+func NewManagementController(
+	app app.App,
+	nc *nats.Conn,
+	config Config,
+) *ManagementController {
+	return &ManagementController{
+		app:    app,
+		nats:   nc,
+		config: config,
+	}
+}
+
+// GetDevice returns a device
+func (h ManagementController) GetDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	tenantID := idata.Tenant
+	deviceID := c.Param("deviceId")
+
+	device, err := h.app.GetDevice(ctx, tenantID, deviceID)
+	if err == app.ErrDeviceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+// GetDeviceSessions returns the sessions allocated for a device
+func (h ManagementController) GetDeviceSessions(c *gin.Context) {
+	h.listSessions(c, c.Param("deviceId"), model.SessionStatusConnected)
+}
+
+// GetDeviceSessionsHistory returns the closed sessions of a device
+func (h ManagementController) GetDeviceSessionsHistory(c *gin.Context) {
+	h.listSessions(c, c.Param("deviceId"), model.SessionStatusDisconnected)
+}
+
+// GetDeviceConnections returns the connection history of a device
+func (h ManagementController) GetDeviceConnections(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	deviceID := c.Param("deviceId")
+	if !h.remoteTerminalAllowed(c, idata.Tenant, deviceID) {
+		return
+	}
+
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter := model.ConnectionFilter{
+		DeviceID: deviceID,
+		Skip:     (page - 1) * perPage,
+		Limit:    perPage,
+	}
+
+	events, count, err := h.app.GetConnectionEvents(ctx, idata.Tenant, filter)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	setPagingHeaders(c, count)
+	c.JSON(http.StatusOK, events)
+}
+
+// ListDevices returns the devices of the tenant, optionally in a given status
+func (h ManagementController) ListDevices(c *gin.Context) {
+	idata := identity.FromContext(c.Request.Context())
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	listDevices(c, h.app, idata.Tenant)
+}
+
+// SearchDevices returns the devices of the tenant matching the filter
+func (h ManagementController) SearchDevices(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+	filter := model.DeviceFilter{}
+	if len(rawData) > 0 {
+		if err = json.Unmarshal(rawData, &filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errors.Wrap(err, "invalid payload").Error(),
+			})
+			return
+		}
+	}
+	filter.Skip = (page - 1) * perPage
+	filter.Limit = perPage
+
+	devices, count, err := h.app.SearchDevices(ctx, idata.Tenant, filter)
+	if _, ok := errors.Cause(err).(validation.Errors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	setPagingHeaders(c, count)
+	c.JSON(http.StatusOK, devices)
+}
+
+// ListSessions returns the sessions of the tenant matching the query
+func (h ManagementController) ListSessions(c *gin.Context) {
+	h.listSessions(c, "", "")
+}
+
+func (h ManagementController) listSessions(
+	c *gin.Context,
+	deviceID string,
+	status string,
+) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	// the sessions of a device are only listed to the users permitted to
+	// access its remote terminal
+	if deviceID != "" &&
+		!h.remoteTerminalAllowed(c, idata.Tenant, deviceID) {
+		return
+	}
+
+	filter, err := parseSessionFilter(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if deviceID != "" {
+		filter.DeviceID = deviceID
+	}
+	if status != "" {
+		filter.Status = status
+	}
+	if deviceID == "" && !h.sessionsAllowed(c, idata.Tenant, filter) {
+		return
+	}
+
+	sessions, count, err := h.app.GetSessions(ctx, *filter)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	setPagingHeaders(c, count)
+	c.JSON(http.StatusOK, sessions)
+}
+
+// parseSessionFilter parses the filter, sort and paging query parameters
+func parseSessionFilter(r *http.Request) (*model.SessionFilter, error) {
+	page, perPage, err := rest.ParsePagingParameters(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	filter := &model.SessionFilter{
+		UserID:   q.Get(qUserID),
+		DeviceID: q.Get(qDeviceID),
+		Status:   q.Get(qStatus),
+		Sort:     q.Get(qSort),
+		Skip:     (page - 1) * perPage,
+		Limit:    perPage,
+	}
+	filter.StartTsFrom, err = parseTimeQuery(q, qStartTsFrom)
+	if err != nil {
+		return nil, err
+	}
+	filter.StartTsTo, err = parseTimeQuery(q, qStartTsTo)
+	if err != nil {
+		return nil, err
+	}
+	return filter, filter.Validate()
+}
+
+// parseDeviceFilter parses the query of the device listings; the devices are
+// sorted by update time, most recently updated first by default.
+func parseDeviceFilter(r *http.Request) (*model.DeviceFilter, error) {
+	page, perPage, err := rest.ParsePagingParameters(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	filter := &model.DeviceFilter{
+		Status: q.Get(qStatus),
+		Sort:   q.Get(qSort),
+		Skip:   (page - 1) * perPage,
+		Limit:  perPage,
+	}
+	if filter.Sort == "" {
+		filter.Sort = model.SortDescending
+	}
+	return filter, filter.Validate()
+}
+
+// listDevices renders the devices of the tenant matching the query
+func listDevices(c *gin.Context, a app.App, tenantID string) {
+	ctx := c.Request.Context()
+	filter, err := parseDeviceFilter(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	devices, count, err := a.SearchDevices(ctx, tenantID, *filter)
+	if err != nil {
+		log.FromContext(ctx).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	setPagingHeaders(c, count)
+	c.JSON(http.StatusOK, devices)
+}
+
+// parseTimeQuery parses an optional RFC3339 timestamp query parameter
+func parseTimeQuery(q url.Values, name string) (*time.Time, error) {
+	value := q.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, errors.Errorf("invalid %s query: \"%s\"", name, value)
+	}
+	return &ts, nil
+}
+
+// setPagingHeaders sets the Link and X-Total-Count headers on the response
+func setPagingHeaders(c *gin.Context, totalCount int64) {
+	hints := rest.NewPagingHints().SetTotalCount(totalCount)
+	links, _ := rest.MakePagingHeaders(c.Request, hints)
+	for _, link := range links {
+		c.Writer.Header().Add(hdrLink, link)
+	}
+	c.Header(hdrTotalCount, strconv.FormatInt(totalCount, 10))
+}
+
+// remoteTerminalAllowed checks the RBAC groups of the user against the
+// device; if the access is denied, the error response is rendered.
+func (h ManagementController) remoteTerminalAllowed(
+	c *gin.Context,
+	tenantID, deviceID string,
+) bool {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	if len(c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups)) > 1 {
+		groups := strings.Split(
+			c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups), ",")
+
+		allowed, err := h.app.RemoteTerminalAllowed(ctx, tenantID, deviceID, groups)
+		if err != nil {
+			l.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "internal error",
+			})
+			return false
+		} else if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Access denied (RBAC).",
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// sessionsAllowed restricts the sessions of the tenant listed to the user to
+// the ones of the devices in the RBAC groups of the user; if the access is
+// denied, the error response is rendered.
+func (h ManagementController) sessionsAllowed(
+	c *gin.Context,
+	tenantID string,
+	filter *model.SessionFilter,
+) bool {
+	ctx := c.Request.Context()
+
+	if len(c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups)) <= 1 {
+		return true
+	} else if filter.DeviceID != "" {
+		return h.remoteTerminalAllowed(c, tenantID, filter.DeviceID)
+	}
+	groups := strings.Split(
+		c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups), ",")
+
+	deviceIDs, err := h.app.GetGroupsDevices(ctx, tenantID, groups)
+	if err != nil {
+		log.FromContext(ctx).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return false
+	}
+	filter.DeviceIDs = deviceIDs
+	return true
+}
+
+// adminAllowed checks that the user is an administrator of the tenant; if
+// the request carries no RBAC headers, the RBAC is not enforced and every
+// user is an administrator. If the access is denied, the error response is
+// rendered.
+func adminAllowed(c *gin.Context) bool {
+	roles := c.Request.Header.Get(model.RBACHeaderRoles)
+	if roles == "" &&
+		c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups) == "" {
+		return true
+	}
+	for _, role := range strings.Split(roles, ",") {
+		if strings.TrimSpace(role) == model.RBACRoleAdmin {
+			return true
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": "Access denied (RBAC).",
+	})
+	return false
+}
+
+// Connect extracts identity from request, checks user permissions
+// and calls ConnectDevice
+func (h ManagementController) Connect(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	tenantID := idata.Tenant
+	userID := idata.Subject
+	deviceID := c.Param("deviceId")
+
+	if !h.remoteTerminalAllowed(c, tenantID, deviceID) {
+		return
+	}
+
+	session := &model.Session{
+		TenantID: tenantID,
+		UserID:   userID,
+		DeviceID: deviceID,
+		StartTS:  time.Now(),
+	}
+
+	// Prepare the user session
+	err := h.app.PrepareUserSession(ctx, session)
+	if err == app.ErrDeviceNotFound || err == app.ErrDeviceNotConnected {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err == app.ErrShellNotSupported {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err == app.ErrDeviceSessionLimit ||
+		err == app.ErrUserSessionLimit ||
+		err == app.ErrTenantSessionLimit {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if _, ok := errors.Cause(err).(validation.Errors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	tracker := &sessionTracker{}
+	defer h.freeUserSession(ctx, session.ID, tracker)
+
+	deviceChan := make(chan *nats.Msg, channelSize)
+	sub, err := h.nats.ChanSubscribe(session.Subject(tenantID), deviceChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	conn, err := h.upgradeWebsocket(c)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	//nolint:errcheck
+	h.ConnectServeWS(ctx, conn, session, deviceChan, tracker)
+}
+
+// upgradeWebsocket upgrades the request to the websocket protocol and
+// applies the read limit of the websocket messages.
+func (h ManagementController) upgradeWebsocket(
+	c *gin.Context,
+) (*websocket.Conn, error) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{"protomsg/msgpack"},
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		Error: func(
+			w http.ResponseWriter, r *http.Request, s int, e error) {
+			rest.RenderError(c, s, e)
+		},
+	}
+
+	// upgrade get request to websocket protocol
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, errors.Wrap(err,
+			"unable to upgrade the request to websocket protocol",
+		)
+	}
+	if h.config.MaxMessageSize > 0 {
+		conn.SetReadLimit(h.config.MaxMessageSize)
+	}
+	return conn, nil
+}
+
+// freeUserSession frees the session unless it was handed over to a new
+// connection.
+func (h ManagementController) freeUserSession(
+	ctx context.Context,
+	sessionID string,
+	tracker *sessionTracker,
+) {
+	if tracker.isResumed() {
+		return
+	}
+	err := h.app.FreeUserSession(ctx, sessionID, tracker.sessionEnd())
+	if err != nil && err != app.ErrSessionNotFound {
+		log.FromContext(ctx).
+			Warnf("failed to free session: %s", err.Error())
+	}
+}
+
+// Reconnect re-attaches the user to a session suspended after the websocket
+// of the user broke; the output buffered meanwhile is sent first.
+func (h ManagementController) Reconnect(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	sess, err := h.app.GetSession(ctx, c.Param("sessionId"))
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	} else if sess.Status == model.SessionStatusDisconnected {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionClosed.Error(),
+		})
+		return
+	} else if sess.UserID != idata.Subject {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "the session belongs to another user",
+		})
+		return
+	}
+	sess.TenantID = idata.Tenant
+
+	if !h.remoteTerminalAllowed(c, idata.Tenant, sess.DeviceID) {
+		return
+	}
+
+	deviceChan := make(chan *nats.Msg, channelSize)
+	sub, err := h.nats.ChanSubscribe(sess.Subject(idata.Tenant), deviceChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	resumed, err := h.resumeSession(ctx, sess)
+	if err == ErrSessionNotSuspended {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+	tracker := &sessionTracker{
+		bytesToDevice:   resumed.BytesToDevice,
+		bytesFromDevice: resumed.BytesFromDevice,
+	}
+	defer h.freeUserSession(ctx, sess.ID, tracker)
+
+	conn, err := h.upgradeWebsocket(c)
+	if err != nil {
+		l.Error(err)
+		h.stopDeviceShell(ctx, sess, "", "user disconnected")
+		return
+	}
+	for _, data := range resumed.Frames {
+		err = conn.WriteMessage(websocket.BinaryMessage, data)
+		if err != nil {
+			break
+		}
+	}
+
+	//nolint:errcheck
+	h.ConnectServeWS(ctx, conn, sess, deviceChan, tracker)
+}
+
+// TerminateSession forcefully terminates a session, stopping the shell on the
+// device and closing the websocket of the session owner; only the
+// administrators with access to the device may terminate a session.
+func (h ManagementController) TerminateSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	if !adminAllowed(c) {
+		return
+	}
+
+	sess, err := h.app.GetSession(ctx, c.Param("sessionId"))
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	} else if sess.Status == model.SessionStatusDisconnected {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionClosed.Error(),
+		})
+		return
+	}
+
+	if !h.remoteTerminalAllowed(c, idata.Tenant, sess.DeviceID) {
+		return
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: sess.ID,
+			Properties: map[string]interface{}{
+				"status":             shell.ErrorMessage,
+				PropertyUserID:       sess.UserID,
+				PropertyTerminatedBy: idata.Subject,
+			},
+		},
+		Body: []byte("session terminated by administrator"),
+	}
+	data, _ := msgpack.Marshal(msg)
+	for _, subject := range []string{
+		model.GetDeviceSubject(idata.Tenant, sess.DeviceID),
+		sess.Subject(idata.Tenant),
+	} {
+		if err = h.nats.Publish(subject, data); err != nil {
+			l.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to terminate session",
+			})
+			return
+		}
+	}
+
+	err = h.app.FreeUserSession(ctx, sess.ID, model.SessionEnd{
+		Reason: model.SessionCloseReasonTerminated,
+	})
+	if err != nil && err != app.ErrSessionNotFound {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetSettings returns the settings of the tenant
+func (h ManagementController) GetSettings(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	settings, err := h.app.GetTenantSettings(ctx, idata.Tenant)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// UpdateSettings replaces the settings of the tenant; the settings include
+// compliance controls, so only the administrators may change them.
+func (h ManagementController) UpdateSettings(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	if !adminAllowed(c) {
+		return
+	}
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	settings := &model.TenantSettings{}
+	if err = json.Unmarshal(rawData, settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	}
+
+	if err = settings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = h.app.UpdateTenantSettings(ctx, idata.Tenant, settings)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListWebhooks returns the webhooks of the tenant
+func (h ManagementController) ListWebhooks(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	webhooks, err := h.app.GetWebhooks(ctx, idata.Tenant)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// CreateWebhook registers a webhook of the tenant; the response is the only
+// time the secret of the webhook is returned.
+func (h ManagementController) CreateWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	if !adminAllowed(c) {
+		return
+	}
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	webhook := &model.Webhook{}
+	if err = json.Unmarshal(rawData, webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	}
+
+	err = h.app.CreateWebhook(ctx, idata.Tenant, webhook)
+	if _, ok := errors.Cause(err).(validation.Errors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// DeleteWebhook removes a webhook of the tenant
+func (h ManagementController) DeleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	if !adminAllowed(c) {
+		return
+	}
+
+	err := h.app.DeleteWebhook(ctx, idata.Tenant, c.Param("webhookId"))
+	if err == app.ErrWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook, newest first
+func (h ManagementController) GetWebhookDeliveries(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter := model.WebhookDeliveryFilter{
+		WebhookID: c.Param("webhookId"),
+		Skip:      (page - 1) * perPage,
+		Limit:     perPage,
+	}
+
+	deliveries, count, err := h.app.GetWebhookDeliveries(
+		ctx, idata.Tenant, filter,
+	)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	setPagingHeaders(c, count)
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// Playback replays the recorded output of a session over a websocket with
+// its original timing, scaled by the speed query parameter and starting from
+// the seek offset (in seconds); the user must be permitted to access the
+// remote terminal of the device.
+func (h ManagementController) Playback(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	speed, seek, err := parsePlaybackParameters(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	frames, ok := h.getSessionRecording(c, idata.Tenant)
+	if !ok {
+		return
+	}
+
+	conn, err := h.upgradeWebsocket(c)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+
+	//nolint:errcheck
+	playbackServeWS(ctx, conn, frames, speed, seek)
+}
+
+// getSessionRecording returns the recorded frames of the session, checking
+// the RBAC groups of the user against the device of the session; if the
+// recording is not available, the error response is rendered.
+func (h ManagementController) getSessionRecording(
+	c *gin.Context,
+	tenantID string,
+) ([]model.RecordingFrame, bool) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	sess, err := h.app.GetSession(ctx, c.Param("sessionId"))
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return nil, false
+	}
+
+	if !h.remoteTerminalAllowed(c, tenantID, sess.DeviceID) {
+		return nil, false
+	}
+
+	frames, err := h.app.GetSessionRecording(ctx, sess)
+	if err == app.ErrSessionNotRecorded {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return nil, false
+	}
+	return frames, true
 }
 
-// NewManagementController returns a new ManagementController
-func NewManagementController(
-	app app.App,
-	nc *nats.Conn,
-) *ManagementController {
-	return &ManagementController{
-		app:  app,
-		nats: nc,
+// parsePlaybackParameters parses the speed and seek query parameters
+func parsePlaybackParameters(
+	q url.Values,
+) (speed float64, seek time.Duration, err error) {
+	speed = 1
+	if value := q.Get(qSpeed); value != "" {
+		speed, err = strconv.ParseFloat(value, 64)
+		if err != nil || speed < playbackSpeedMin || speed > playbackSpeedMax {
+			return 0, 0, errors.Errorf(
+				"invalid %s query: must be a number between %g and %g",
+				qSpeed, playbackSpeedMin, playbackSpeedMax,
+			)
+		}
 	}
+	if value := q.Get(qSeek); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return 0, 0, errors.Errorf(
+				"invalid %s query: must be a non-negative number",
+				qSeek,
+			)
+		}
+		seek = time.Duration(seconds * float64(time.Second))
+	}
+	return speed, seek, nil
 }
 
-// GetDevice returns a device
-func (h ManagementController) GetDevice(c *gin.Context) {
+// playbackServeWS writes the recorded output frames to the websocket. The
+// frames before the seek offset are written without delay to restore the
+// state of the terminal.
+func playbackServeWS(
+	ctx context.Context,
+	conn *websocket.Conn,
+	frames []model.RecordingFrame,
+	speed float64,
+	seek time.Duration,
+) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the reader handles the control messages and stops the playback
+	// when the client closes the websocket
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var start time.Time
+	position := seek
+	for _, frame := range frames {
+		if start.IsZero() {
+			start = frame.Timestamp
+		}
+		if frame.Direction != model.RecordingDirectionOutput {
+			continue
+		}
+		offset := frame.Timestamp.Sub(start)
+		if offset > position {
+			delay := time.Duration(float64(offset-position) / speed)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			position = offset
+		}
+		err := conn.WriteMessage(websocket.BinaryMessage, frame.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(
+			websocket.CloseNormalClosure,
+			"end of recording",
+		),
+		time.Now().Add(writeWait),
+	)
+}
+
+// GetRecording exports the recording of a session, the only supported
+// format is asciicast v2; the user must be permitted to access the remote
+// terminal of the device.
+func (h ManagementController) GetRecording(c *gin.Context) {
 	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
 
 	idata := identity.FromContext(ctx)
 	if idata == nil || !idata.IsUser {
@@ -78,97 +1208,72 @@ func (h ManagementController) GetDevice(c *gin.Context) {
 		})
 		return
 	}
-	tenantID := idata.Tenant
-	deviceID := c.Param("deviceId")
 
-	device, err := h.app.GetDevice(ctx, tenantID, deviceID)
-	if err == app.ErrDeviceNotFound {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": err.Error(),
-		})
-		return
-	} else if err != nil {
+	if format := c.Query(qFormat); format != formatAsciicast {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+			"error": fmt.Sprintf(
+				"invalid %s query: \"%s\", supported formats: %s",
+				qFormat, format, formatAsciicast,
+			),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, device)
+	frames, ok := h.getSessionRecording(c, idata.Tenant)
+	if !ok {
+		return
+	}
+
+	sessionID := c.Param("sessionId")
+	c.Header("Content-Type", "application/x-asciicast")
+	c.Header("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s.cast\"", sessionID),
+	)
+	c.Status(http.StatusOK)
+	if err := writeAsciicast(c.Writer, frames); err != nil {
+		l.Error(err)
+	}
 }
 
-// Connect extracts identity from request, checks user permissions
-// and calls ConnectDevice
-func (h ManagementController) Connect(c *gin.Context) {
+// Observe attaches the user to a connected session in read-only mode: the
+// output of the session is streamed and the input is dropped.
+func (h ManagementController) Observe(c *gin.Context) {
 	ctx := c.Request.Context()
 	l := log.FromContext(ctx)
 
 	idata := identity.FromContext(ctx)
-	if !idata.IsUser {
+	if idata == nil || !idata.IsUser {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": ErrMissingUserAuthentication.Error(),
 		})
 		return
 	}
 
-	tenantID := idata.Tenant
-	userID := idata.Subject
-	deviceID := c.Param("deviceId")
-
-	if len(c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups)) > 1 {
-		groups := strings.Split(
-			c.Request.Header.Get(model.RBACHeaderRemoteTerminalGroups), ",")
-
-		allowed, err := h.app.RemoteTerminalAllowed(ctx, tenantID, deviceID, groups)
-		if err != nil {
-			l.Error(err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "internal error",
-			})
-			return
-		} else if !allowed {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "Access denied (RBAC).",
-			})
-			return
-		}
-	}
-
-	session := &model.Session{
-		TenantID: tenantID,
-		UserID:   userID,
-		DeviceID: deviceID,
-		StartTS:  time.Now(),
-	}
-
-	// Prepare the user session
-	err := h.app.PrepareUserSession(ctx, session)
-	if err == app.ErrDeviceNotFound || err == app.ErrDeviceNotConnected {
+	sess, err := h.app.GetSession(ctx, c.Param("sessionId"))
+	if err == app.ErrSessionNotFound {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": err.Error(),
 		})
 		return
-	} else if _, ok := errors.Cause(err).(validation.Errors); ok {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
-		return
 	} else if err != nil {
 		l.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
+			"error": "internal error",
+		})
+		return
+	} else if sess.Status == model.SessionStatusDisconnected {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionClosed.Error(),
 		})
 		return
 	}
-	defer func() {
-		err := h.app.FreeUserSession(ctx, session.ID)
-		if err != nil {
-			l.Warnf("failed to free session: %s", err.Error())
-		}
-	}()
 
-	deviceChan := make(chan *nats.Msg, channelSize)
-	sub, err := h.nats.ChanSubscribe(session.Subject(tenantID), deviceChan)
+	if !h.remoteTerminalAllowed(c, idata.Tenant, sess.DeviceID) {
+		return
+	}
+
+	msgChan := make(chan *nats.Msg, channelSize)
+	sub, err := h.nats.ChanSubscribe(sess.Subject(idata.Tenant), msgChan)
 	if err != nil {
 		l.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -179,32 +1284,183 @@ func (h ManagementController) Connect(c *gin.Context) {
 	//nolint:errcheck
 	defer sub.Unsubscribe()
 
-	// upgrade get request to websocket protocol
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		Subprotocols:    []string{"protomsg/msgpack"},
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-		Error: func(
-			w http.ResponseWriter, r *http.Request, s int, e error) {
-			rest.RenderError(c, s, e)
-		},
-	}
-
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		err = errors.Wrap(err, "unable to upgrade the request to websocket protocol")
+	observer, err := h.app.ObserveSession(ctx, sess.ID, idata.Subject)
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionClosed.Error(),
+		})
+		return
+	} else if err != nil {
 		l.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "internal error",
 		})
 		return
 	}
+	defer func() {
+		err := h.app.StopObservingSession(ctx, sess.ID, observer.ID)
+		if err != nil {
+			l.Warnf("failed to detach session observer: %s", err.Error())
+		}
+	}()
+
+	conn, err := h.upgradeWebsocket(c)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+
+	//nolint:errcheck
+	h.observeServeWS(ctx, conn, sess, msgChan)
+}
+
+// observeServeWS streams the session output to an observer and drops the
+// messages received from the observer.
+func (h ManagementController) observeServeWS(
+	ctx context.Context,
+	conn *websocket.Conn,
+	sess *model.Session,
+	msgChan chan *nats.Msg,
+) error {
+	errChan := make(chan error, 1)
+	defer close(errChan)
 
+	// the traffic of the observers is not accounted to the session
+	// websocketWriter is responsible for closing the websocket
 	//nolint:errcheck
-	h.ConnectServeWS(ctx, conn, session, deviceChan)
+	go h.websocketWriter(
+		ctx, conn, sess, msgChan, errChan,
+		&sessionTracker{}, sessionLimits{},
+	)
+
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// stopMessage holds the attributes of a message stopping the shell session
+type stopMessage struct {
+	// terminatedBy is the ID of the user who forcefully terminated the
+	// session, if any.
+	terminatedBy string
+	// closeReason is set if the session was stopped by the server.
+	closeReason string
+	body        string
+}
+
+// parseStopMessage checks if the message stops the shell session and returns
+// its attributes.
+func parseStopMessage(data []byte) (*stopMessage, bool) {
+	var msg ws.ProtoMsg
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, false
+	}
+	if msg.Header.Proto != ws.ProtoTypeShell ||
+		msg.Header.MsgType != shell.MessageTypeStopShell {
+		return nil, false
+	}
+	stop := &stopMessage{body: string(msg.Body)}
+	stop.terminatedBy, _ = msg.Header.Properties[PropertyTerminatedBy].(string)
+	stop.closeReason, _ = msg.Header.Properties[PropertyCloseReason].(string)
+	return stop, true
+}
+
+// sessionTracker keeps track of the byte counts and the close reason of a
+// session while it is being served.
+type sessionTracker struct {
+	bytesToDevice   int64
+	bytesFromDevice int64
+
+	mu          sync.Mutex
+	closeReason string
+	// resumed is set when the session is handed over to a new connection
+	resumed bool
+	// stopped is set when the shell was stopped by the server
+	stopped bool
+
+	// lastInput is the time of the last user input in Unix nanoseconds
+	lastInput int64
+}
+
+// touch records user input
+func (t *sessionTracker) touch() {
+	atomic.StoreInt64(&t.lastInput, time.Now().UnixNano())
+}
+
+func (t *sessionTracker) lastInputTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastInput))
+}
+
+func (t *sessionTracker) addBytesToDevice(n int) {
+	atomic.AddInt64(&t.bytesToDevice, int64(n))
+}
+
+func (t *sessionTracker) addBytesFromDevice(n int) {
+	atomic.AddInt64(&t.bytesFromDevice, int64(n))
+}
+
+// setCloseReason sets the close reason unless it is already set
+func (t *sessionTracker) setCloseReason(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closeReason == "" {
+		t.closeReason = reason
+	}
+}
+
+// resumable checks if the session can wait for the user to reconnect: the
+// session must not be stopped, except for the connection timing out.
+func (t *sessionTracker) resumable() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeReason == "" ||
+		t.closeReason == model.SessionCloseReasonTimeout
+}
+
+func (t *sessionTracker) setResumed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resumed = true
+}
+
+func (t *sessionTracker) isResumed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resumed
+}
+
+func (t *sessionTracker) setStopped() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+}
+
+func (t *sessionTracker) isStopped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopped
+}
+
+// sessionEnd returns the SessionEnd, by default the session is closed
+// because the user disconnected.
+func (t *sessionTracker) sessionEnd() model.SessionEnd {
+	t.mu.Lock()
+	reason := t.closeReason
+	t.mu.Unlock()
+	if reason == "" {
+		reason = model.SessionCloseReasonUserDisconnect
+	}
+	return model.SessionEnd{
+		Reason:          reason,
+		BytesToDevice:   atomic.LoadInt64(&t.bytesToDevice),
+		BytesFromDevice: atomic.LoadInt64(&t.bytesFromDevice),
+	}
 }
 
 func websocketPing(conn *websocket.Conn) bool {
@@ -229,11 +1485,15 @@ func (h ManagementController) websocketWriter(
 	session *model.Session,
 	deviceChan <-chan *nats.Msg,
 	errChan <-chan error,
+	tracker *sessionTracker,
+	limits sessionLimits,
 ) (err error) {
 	l := log.FromContext(ctx)
 	defer func() {
-		// TODO Check errChan and send close control packet with error
-		// if not initiated by client.
+		// report the error unless the connection is already gone
+		if code, text, ok := closeCodeForError(err); ok {
+			_ = closeWebsocket(conn, session.ID, code, text)
+		}
 		conn.Close()
 	}()
 
@@ -263,6 +1523,16 @@ func (h ManagementController) websocketWriter(
 			time.Now().Add(writeWait),
 		)
 	})
+
+	var (
+		limitsC      <-chan time.Time
+		warnDeadline time.Time
+	)
+	if limits.enabled() {
+		limitsTicker := time.NewTicker(sessionLimitsCheckPeriod)
+		defer limitsTicker.Stop()
+		limitsC = limitsTicker.C
+	}
 Loop:
 	for {
 		select {
@@ -272,12 +1542,59 @@ Loop:
 				l.Error(err)
 				break Loop
 			}
+			tracker.addBytesFromDevice(len(msg.Data))
+			if stop, isStop := parseStopMessage(msg.Data); isStop {
+				var closeReason, closeText string
+				switch {
+				case stop.terminatedBy != "":
+					closeReason = model.SessionCloseReasonTerminated
+					l.Infof("session %s terminated by user %s",
+						session.ID, stop.terminatedBy)
+					closeText = "session terminated by administrator"
+				case stop.closeReason != "":
+					closeReason = stop.closeReason
+					closeText = stop.body
+				default:
+					closeReason = model.SessionCloseReasonDeviceDisconnect
+				}
+				tracker.setCloseReason(closeReason)
+				if closeText != "" {
+					_ = closeWebsocket(conn, session.ID,
+						closeCodeForReason(closeReason), closeText)
+					break Loop
+				}
+			}
+		case <-shutdownFromContext(ctx):
+			err = closeWebsocket(conn, session.ID, CloseServerShutdown,
+				"server shutting down")
+			break Loop
 		case <-ctx.Done():
 			break Loop
 		case <-ticker.C:
 			if !websocketPing(conn) {
+				tracker.setCloseReason(model.SessionCloseReasonTimeout)
+				break Loop
+			}
+		case now := <-limitsC:
+			deadline, reason := limits.deadline(tracker.lastInputTime())
+			remaining := deadline.Sub(now)
+			if remaining <= 0 {
+				h.expireSession(ctx, conn, session, tracker, reason)
 				break Loop
+			} else if remaining <= sessionExpiryWarning &&
+				!deadline.Equal(warnDeadline) {
+				warnDeadline = deadline
+				err = conn.WriteMessage(
+					websocket.BinaryMessage,
+					newExpiryWarning(session, reason, remaining),
+				)
+				if err != nil {
+					l.Error(err)
+					break Loop
+				}
 			}
+			// the limits check does not reset the ping period
+			continue
 		case err := <-errChan:
 			return err
 		}
@@ -286,6 +1603,34 @@ Loop:
 	return err
 }
 
+// expireSession stops the shell of a session which reached its idle timeout
+// or maximum duration and closes the websocket of the user.
+func (h ManagementController) expireSession(
+	ctx context.Context,
+	conn *websocket.Conn,
+	sess *model.Session,
+	tracker *sessionTracker,
+	reason string,
+) {
+	l := log.FromContext(ctx)
+	l.Infof("session %s expired: %s", sess.ID, reason)
+
+	text := sessionExpiryText(reason)
+	tracker.setCloseReason(reason)
+	tracker.setStopped()
+	h.stopDeviceShell(ctx, sess, reason, text)
+
+	err := conn.WriteMessage(
+		websocket.BinaryMessage,
+		newStopShellMessage(sess, reason, text),
+	)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	_ = closeWebsocket(conn, sess.ID, CloseSessionExpired, text)
+}
+
 // ConnectServeWS starts a websocket connection with the device
 // Currently this handler only properly handles a single terminal session.
 func (h ManagementController) ConnectServeWS(
@@ -293,11 +1638,15 @@ func (h ManagementController) ConnectServeWS(
 	conn *websocket.Conn,
 	sess *model.Session,
 	deviceChan chan *nats.Msg,
+	tracker *sessionTracker,
 ) (err error) {
-	var sessionClosed bool
+	var sessionClosed, recordingFailed, resumable bool
 	l := log.FromContext(ctx)
 	id := identity.FromContext(ctx)
+	validator := newProtocolValidator(h.config, false)
 	errChan := make(chan error, 1)
+	writerDone := make(chan struct{})
+	tracker.touch()
 	defer func() {
 		if err != nil {
 			select {
@@ -307,55 +1656,63 @@ func (h ManagementController) ConnectServeWS(
 				l.Warn("Failed to propagate error to client")
 			}
 		}
-		if !sessionClosed {
-			msg := ws.ProtoMsg{
-				Header: ws.ProtoHdr{
-					Proto:     ws.ProtoTypeShell,
-					MsgType:   shell.MessageTypeStopShell,
-					SessionID: sess.ID,
-					Properties: map[string]interface{}{
-						"status":       shell.ErrorMessage,
-						PropertyUserID: sess.UserID,
-					},
-				},
-				Body: []byte("user disconnected"),
-			}
-			data, _ := msgpack.Marshal(msg)
-			errPublish := h.nats.Publish(model.GetDeviceSubject(
-				id.Tenant, sess.DeviceID),
-				data,
-			)
-			if errPublish != nil {
-				l.Warnf(
-					"failed to propagate stop session "+
-						"message to device: %s",
-					errPublish.Error(),
-				)
-			}
-		}
 		close(errChan)
+		validator.logSummary(ctx)
+		if !sessionClosed && resumable && tracker.resumable() {
+			// wait for the writer to release the session subscription
+			conn.Close()
+			<-writerDone
+			sessionClosed = h.suspendSession(ctx, sess, deviceChan, tracker)
+		}
+		if !sessionClosed && !tracker.isStopped() {
+			h.stopDeviceShell(ctx, sess, "", "user disconnected")
+		}
 	}()
 	// websocketWriter is responsible for closing the websocket
-	//nolint:errcheck
-	go h.websocketWriter(ctx, conn, sess, deviceChan, errChan)
+	go func() {
+		defer close(writerDone)
+		//nolint:errcheck
+		h.websocketWriter(
+			ctx, conn, sess, deviceChan, errChan,
+			tracker, newSessionLimits(sess),
+		)
+	}()
 
-	var data []byte
+	var (
+		data  []byte
+		valid bool
+	)
 	for {
 		_, data, err = conn.ReadMessage()
 		if err != nil {
+			// the session waits for the user to reconnect unless the
+			// websocket was closed on purpose or the user navigated away
+			resumable = h.config.SessionGracePeriod > 0 &&
+				!websocket.IsCloseError(err,
+					websocket.CloseNormalClosure,
+					websocket.CloseGoingAway,
+				)
 			if _, ok := err.(*websocket.CloseError); ok {
 				return nil
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				tracker.setCloseReason(model.SessionCloseReasonTimeout)
 			}
 			return err
 		}
 		m := &ws.ProtoMsg{}
 		err = msgpack.Unmarshal(data, m)
+		if err != nil {
+			return newProtocolError("malformed message: " + err.Error())
+		}
+		tracker.touch()
+		valid, err = validator.validate(ctx, &m.Header)
 		if err != nil {
 			return err
+		} else if !valid {
+			continue
 		}
 
-		switch m.Header.Proto {
-		case ws.ProtoTypeShell:
+		if m.Header.Proto == ws.ProtoTypeShell {
 			m.Header.SessionID = sess.ID
 			if m.Header.Properties == nil {
 				m.Header.Properties = make(map[string]interface{})
@@ -366,13 +1723,57 @@ func (h ManagementController) ConnectServeWS(
 			if m.Header.MsgType == shell.MessageTypeStopShell {
 				sessionClosed = true
 			}
-		default:
-			// TODO: Handle protocol violation
+		}
+
+		if sess.Recorded && m.Header.Proto == ws.ProtoTypeShell {
+			if recordingFailed && h.config.RecordingFailClosed {
+				continue
+			}
+			err = h.app.RecordSessionFrame(
+				ctx, sess.ID, model.RecordingDirectionInput, data,
+			)
+			if err != nil {
+				l.Error(err)
+				if !recordingFailed {
+					recordingFailed = true
+					err = publishRecordingFailure(
+						h.nats, id.Tenant, sess,
+						h.config.RecordingFailClosed,
+					)
+					if err != nil {
+						l.Error(err)
+					}
+				}
+				if h.config.RecordingFailClosed {
+					// the shell is stopped by publishRecordingFailure
+					sessionClosed = true
+					continue
+				}
+			}
 		}
 
 		err = h.nats.Publish(model.GetDeviceSubject(id.Tenant, sess.DeviceID), data)
 		if err != nil {
 			return err
 		}
+		tracker.addBytesToDevice(len(data))
+	}
+}
+
+// stopDeviceShell sends the message stopping the shell of the session to
+// the device.
+func (h ManagementController) stopDeviceShell(
+	ctx context.Context,
+	sess *model.Session,
+	closeReason, body string,
+) {
+	id := identity.FromContext(ctx)
+	data := newStopShellMessage(sess, closeReason, body)
+	err := h.nats.Publish(model.GetDeviceSubject(id.Tenant, sess.DeviceID), data)
+	if err != nil {
+		log.FromContext(ctx).Warnf(
+			"failed to propagate stop session message to device: %s",
+			err.Error(),
+		)
 	}
 }
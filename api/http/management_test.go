@@ -27,6 +27,7 @@ import (
 	"testing"
 	"time"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/gorilla/websocket"
 	"github.com/mendersoftware/deviceconnect/app"
 	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
@@ -191,47 +192,155 @@ func TestManagementGetDevice(t *testing.T) {
 	}
 }
 
-func TestManagementConnect(t *testing.T) {
-	prevPongWait := pongWait
-	prevWriteWait := writeWait
-	defer func() {
-		pongWait = prevPongWait
-		writeWait = prevWriteWait
-	}()
-	pongWait = time.Second
-	writeWait = time.Second
+func TestManagementGetDeviceSessions(t *testing.T) {
 	testCases := []struct {
-		Name                       string
-		DeviceID                   string
-		SessionID                  string
-		Identity                   identity.Identity
-		RBACHeader                 string
-		RemoteTerminalAllowedError error
-		RemoteTerminalAllowed      bool
+		Name     string
+		URL      string
+		DeviceID string
+		Query    string
+		Identity *identity.Identity
+
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+
+		Filter      *model.SessionFilter
+		Sessions    []model.Session
+		Count       int64
+		GetSessErr  error
+		HTTPStatus  int
+		TotalCount  string
+		LinkHeaders int
 	}{
 		{
-			Name:      "ok",
-			DeviceID:  "1234567890",
-			SessionID: "session_id",
-			Identity: identity.Identity{
+			Name:     "ok",
+			DeviceID: "1234567890",
+			Query:    "?page=2&per_page=1",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusConnected,
+				Skip:     1,
+				Limit:    1,
+			},
+			Sessions: []model.Session{{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000000",
+				DeviceID: "1234567890",
+				StartTS:  time.Now().UTC().Round(time.Second),
+			}},
+			Count: 3,
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "3",
+			LinkHeaders: 4,
+		},
+		{
+			Name:     "ok, history",
+			URL:      APIURLManagementDeviceHistory,
+			DeviceID: "1234567890",
+			Query:    "?user_id=00000000-0000-0000-0000-000000000000",
+			Identity: &identity.Identity{
 				Subject: "00000000-0000-0000-0000-000000000000",
 				Tenant:  "000000000000000000000000",
 				IsUser:  true,
-				Plan:    "professional",
 			},
+
+			Filter: &model.SessionFilter{
+				UserID:   "00000000-0000-0000-0000-000000000000",
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusDisconnected,
+				Limit:    20,
+			},
+			Sessions: []model.Session{{
+				ID:          "00000000-0000-0000-0000-000000000001",
+				UserID:      "00000000-0000-0000-0000-000000000000",
+				DeviceID:    "1234567890",
+				Status:      model.SessionStatusDisconnected,
+				StartTS:     time.Now().UTC().Round(time.Second),
+				Duration:    12.5,
+				CloseReason: model.SessionCloseReasonUserDisconnect,
+			}},
+			Count: 1,
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "1",
+			LinkHeaders: 2,
 		},
 		{
-			Name:      "ok with RBAC",
-			DeviceID:  "1234567890",
-			SessionID: "session_id",
-			Identity: identity.Identity{
+			Name:     "ok, device in the RBAC groups",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
 				Subject: "00000000-0000-0000-0000-000000000000",
 				Tenant:  "000000000000000000000000",
 				IsUser:  true,
-				Plan:    "enterprise",
 			},
-			RBACHeader:            "foo,bar",
+			RBACGroups:            "group1,group2",
 			RemoteTerminalAllowed: true,
+
+			Filter: &model.SessionFilter{
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusConnected,
+				Limit:    20,
+			},
+			Sessions: []model.Session{},
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "0",
+			LinkHeaders: 1,
+		},
+		{
+			Name:     "ko, device not in the RBAC groups",
+			URL:      APIURLManagementDeviceHistory,
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "group1,group2",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:     "ko, missing auth",
+			DeviceID: "1234567890",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:     "ko, bad paging parameters",
+			DeviceID: "1234567890",
+			Query:    "?page=foo",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, internal error",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusConnected,
+				Limit:    20,
+			},
+			GetSessErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
 		},
 	}
 
@@ -239,349 +348,3209 @@ func TestManagementConnect(t *testing.T) {
 		t.Run(tc.Name, func(t *testing.T) {
 			app := &app_mocks.App{}
 			defer app.AssertExpectations(t)
-			natsClient := NewNATSTestClient(t)
-			router, _ := NewRouter(app, natsClient)
 
-			headers := http.Header{}
-			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(tc.Identity))
+			router, _ := NewRouter(app, nil)
 
-			app.On("PrepareUserSession",
-				mock.MatchedBy(func(_ context.Context) bool {
-					return true
-				}),
-				mock.MatchedBy(func(sess *model.Session) bool {
-					sess.ID = tc.SessionID
-					return true
-				}),
-			).Return(nil)
-			app.On("FreeUserSession",
-				mock.MatchedBy(func(_ context.Context) bool {
-					return true
-				}),
-				tc.SessionID,
-			).Return(nil)
-			if len(tc.RBACHeader) > 0 {
+			url := tc.URL
+			if url == "" {
+				url = APIURLManagementDeviceSessions
+			}
+			url = strings.Replace(url, ":deviceId", tc.DeviceID, 1)
+			req, _ := http.NewRequest("GET", "http://localhost"+url+tc.Query, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.RBACGroups != "" {
+				req.Header.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
 				app.On("RemoteTerminalAllowed",
 					mock.MatchedBy(func(_ context.Context) bool {
 						return true
 					}),
 					tc.Identity.Tenant,
 					tc.DeviceID,
-					[]string{"foo", "bar"},
-				).Return(tc.RemoteTerminalAllowed, tc.RemoteTerminalAllowedError)
+					[]string{"group1", "group2"},
+				).Return(tc.RemoteTerminalAllowed, nil)
+			}
+			if tc.Filter != nil {
+				app.On("GetSessions",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					*tc.Filter,
+				).Return(tc.Sessions, tc.Count, tc.GetSessErr)
+			}
 
-				headers.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACHeader)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var sessions []model.Session
+				err := json.Unmarshal(w.Body.Bytes(), &sessions)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Sessions, sessions)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+				assert.Len(t, w.Header().Values(hdrLink), tc.LinkHeaders)
 			}
+		})
+	}
+}
 
-			s := httptest.NewServer(router)
-			defer s.Close()
+func TestManagementListDevices(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
 
-			url := "ws" + strings.TrimPrefix(s.URL, "http")
-			url = url + strings.Replace(
-				APIURLManagementDeviceConnect, ":deviceId",
-				tc.DeviceID, 1,
-			)
-			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
-			assert.NoError(t, err)
+		Filter      *model.DeviceFilter
+		Devices     []model.Device
+		Count       int64
+		SearchErr   error
+		HTTPStatus  int
+		TotalCount  string
+		LinkHeaders int
+	}{
+		{
+			Name:     "ok",
+			Query:    "?status=connected&page=1&per_page=1",
+			Identity: userID,
 
-			pingReceived := make(chan struct{}, 1)
-			conn.SetPingHandler(func(message string) error {
-				pingReceived <- struct{}{}
-				return conn.WriteControl(
-					websocket.PongMessage,
-					[]byte{},
-					time.Now().Add(writeWait),
-				)
-			})
-			pongReceived := make(chan struct{}, 1)
-			conn.SetPongHandler(func(message string) error {
-				pongReceived <- struct{}{}
-				return nil
-			})
+			Filter: &model.DeviceFilter{
+				Status: model.DeviceStatusConnected,
+				Sort:   model.SortDescending,
+				Limit:  1,
+			},
+			Devices: []model.Device{{
+				ID:        "1",
+				Status:    model.DeviceStatusConnected,
+				UpdatedTs: time.Now().UTC().Round(time.Second),
+			}},
+			Count: 2,
 
-			receivedMsg := make(chan []byte, 1)
-			go func() {
-				for {
-					_, data, err := conn.ReadMessage()
-					if err != nil {
-						break
-					}
-					receivedMsg <- data
-				}
-			}()
-			natsChan := make(chan *nats.Msg, 2)
-			sub, _ := natsClient.ChanSubscribe(
-				model.GetDeviceSubject(
-					tc.Identity.Tenant,
-					tc.DeviceID,
-				), natsChan,
-			)
-			defer sub.Unsubscribe()
-			msg := ws.ProtoMsg{
-				Header: ws.ProtoHdr{
-					Proto:   ws.ProtoTypeShell,
-					MsgType: "hello",
-				},
-			}
-			b, _ := msgpack.Marshal(msg)
-			err = conn.WriteMessage(websocket.BinaryMessage, b)
-			assert.NoError(t, err)
-			select {
-			case natsMsg := <-natsChan:
-				var rMsg ws.ProtoMsg
-				err = msgpack.Unmarshal(natsMsg.Data, &rMsg)
-				if assert.NoError(t, err) {
-					msg.Header.SessionID = tc.SessionID
-					msg.Header.Properties = map[string]interface{}{
-						"user_id": tc.Identity.Subject,
-					}
-					assert.Equal(t, msg, rMsg)
-				}
-			case <-time.After(time.Second * 5):
-				assert.Fail(t,
-					"api did not forward message to message bus",
-				)
-			}
-			err = conn.WriteControl(
-				websocket.PingMessage,
-				[]byte("1"),
-				time.Now().Add(time.Second),
-			)
-			assert.NoError(t, err)
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "2",
+			LinkHeaders: 3,
+		},
+		{
+			Name:     "ok, ascending",
+			Query:    "?sort=asc",
+			Identity: userID,
 
-			msg.Header.SessionID = tc.SessionID
-			b, _ = msgpack.Marshal(msg)
-			err = natsClient.Publish(
-				model.GetSessionSubject(tc.Identity.Tenant, tc.SessionID),
-				b,
-			)
-			assert.NoError(t, err)
-			select {
-			case p := <-receivedMsg:
-				assert.Equal(t, b, p)
-			case <-time.After(time.Second * 5):
-				assert.Fail(t, "timed out waiting for message from device")
-			}
+			Filter: &model.DeviceFilter{
+				Sort:  model.SortAscending,
+				Limit: 20,
+			},
+			Devices: []model.Device{},
 
-			// check that ping and pong works as expected
-			select {
-			case <-pingReceived:
-			case <-time.After(pongWait):
-				assert.Fail(t, "did not receive ping within pongWait")
-			}
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "0",
+			LinkHeaders: 1,
+		},
+		{
+			Name: "ko, missing auth",
 
-			select {
-			case <-pongReceived:
-			case <-time.After(pongWait):
-				assert.Fail(t, "did not receive pong within pongWait")
-			}
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "ko, device auth",
+			Identity: &identity.Identity{
+				Subject:  "1234567890",
+				Tenant:   "000000000000000000000000",
+				IsDevice: true,
+			},
 
-			// close the websocket
-			conn.Close()
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, bad status",
+			Query:    "?status=online",
+			Identity: userID,
 
-			select {
-			case msg := <-natsChan:
-				var stopMsg ws.ProtoMsg
-				err := msgpack.Unmarshal(msg.Data, &stopMsg)
-				if assert.NoError(t, err) {
-					assert.Equal(t,
-						ws.ProtoTypeShell,
-						stopMsg.Header.Proto,
-					)
-					assert.Equal(t,
-						shell.MessageTypeStopShell,
-						stopMsg.Header.MsgType,
-					)
-				}
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, bad paging parameters",
+			Query:    "?page=0",
+			Identity: userID,
 
-			case <-time.After(time.Second * 5):
-				assert.Fail(t,
-					"timeout waiting for stop message on nats channel",
-				)
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, internal error",
+			Identity: userID,
+
+			Filter: &model.DeviceFilter{
+				Sort:  model.SortDescending,
+				Limit: 20,
+			},
+			SearchErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("GET",
+				"http://localhost"+APIURLManagementDevices+tc.Query, nil,
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.Filter != nil {
+				app.On("SearchDevices",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					*tc.Filter,
+				).Return(tc.Devices, tc.Count, tc.SearchErr)
 			}
 
-			// wait 100ms to let the websocket fully shutdown on the server
-			time.Sleep(100 * time.Millisecond)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
 
-			app.AssertExpectations(t)
+			if tc.HTTPStatus == http.StatusOK {
+				var devices []model.Device
+				err := json.Unmarshal(w.Body.Bytes(), &devices)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Devices, devices)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+				assert.Len(t, w.Header().Values(hdrLink), tc.LinkHeaders)
+			}
 		})
 	}
 }
 
-func TestManagementConnectFailures(t *testing.T) {
+func TestManagementCreateWebhook(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
 	testCases := []struct {
-		Name                       string
-		DeviceID                   string
-		SessionID                  string
-		PrepareUserSessionErr      error
-		Authorization              string
-		Identity                   identity.Identity
-		RBACHeader                 string
-		RemoteTerminalAllowedError error
-		RemoteTerminalAllowed      bool
-		HTTPStatus                 int
-		HTTPError                  error
+		Name      string
+		Body      string
+		Identity  *identity.Identity
+		RBACRoles string
+
+		CreateErr  error
+		HTTPStatus int
 	}{
 		{
-			Name:      "ko, unable to upgrade",
-			SessionID: "1",
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			Authorization: "Bearer " + GenerateJWT(identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			}),
-			HTTPStatus: http.StatusBadRequest,
+			Name:     "ok",
+			Body:     `{"url": "https://example.com/hooks", "events": ["device_connected"]}`,
+			Identity: userID,
+
+			HTTPStatus: http.StatusCreated,
 		},
 		{
-			Name:                  "ko, session preparation failure",
-			SessionID:             "1",
-			PrepareUserSessionErr: errors.New("Error"),
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			Authorization: "Bearer " + GenerateJWT(identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			}),
-			HTTPStatus: http.StatusInternalServerError,
+			Name:      "ok, administrator",
+			Body:      `{"url": "https://example.com/hooks", "events": ["device_connected"]}`,
+			Identity:  userID,
+			RBACRoles: model.RBACRoleAdmin,
+
+			HTTPStatus: http.StatusCreated,
 		},
 		{
-			Name:                  "ko, device not found",
-			SessionID:             "1",
-			PrepareUserSessionErr: app.ErrDeviceNotFound,
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			Authorization: "Bearer " + GenerateJWT(identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			}),
-			HTTPStatus: http.StatusNotFound,
+			Name:      "ko, not an administrator",
+			Body:      `{"url": "https://example.com/hooks", "events": ["device_connected"]}`,
+			Identity:  userID,
+			RBACRoles: "RBAC_ROLE_REMOTE_TERMINAL",
+
+			HTTPStatus: http.StatusForbidden,
 		},
 		{
-			Name:       "ko, missing authorization header",
+			Name: "ko, missing auth",
+			Body: `{"url": "https://example.com/hooks", "events": ["device_connected"]}`,
+
 			HTTPStatus: http.StatusUnauthorized,
-			HTTPError:  errors.New("Authorization not present in header"),
 		},
 		{
-			Name: "ko, malformed authorization header",
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			Authorization: "malformed",
-			HTTPStatus:    http.StatusUnauthorized,
-			HTTPError:     errors.New("malformed Authorization header"),
+			Name:     "ko, bad payload",
+			Body:     `{"url": 1}`,
+			Identity: userID,
+
+			HTTPStatus: http.StatusBadRequest,
 		},
 		{
-			Name: "ko, RBAC - not allowed",
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			SessionID: "1",
-			Authorization: "Bearer " + GenerateJWT(identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			}),
-			RBACHeader:            "foo,bar",
-			RemoteTerminalAllowed: false,
-			HTTPStatus:            http.StatusForbidden,
+			Name:     "ko, invalid webhook",
+			Body:     `{"url": "http://example.com/hooks", "events": ["device_connected"]}`,
+			Identity: userID,
+
+			CreateErr: errors.Wrap(validation.Errors{
+				"url": errors.New("must be an HTTPS URL"),
+			}, "app: invalid webhook"),
+			HTTPStatus: http.StatusBadRequest,
 		},
 		{
-			Name:      "ko, RBAC - error",
-			SessionID: "1",
-			Identity: identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			},
-			Authorization: "Bearer " + GenerateJWT(identity.Identity{
-				Subject: "00000000-0000-0000-0000-000000000000",
-				Tenant:  "000000000000000000000000",
-				IsUser:  true,
-			}),
-			RBACHeader:                 "foo,bar",
-			RemoteTerminalAllowed:      false,
-			RemoteTerminalAllowedError: errors.New("foo"),
-			HTTPStatus:                 http.StatusInternalServerError,
-			HTTPError:                  errors.New("internal error"),
+			Name:     "ko, internal error",
+			Body:     `{"url": "https://example.com/hooks", "events": ["device_connected"]}`,
+			Identity: userID,
+
+			CreateErr:  errors.New("store: internal error"),
+			HTTPStatus: http.StatusInternalServerError,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
 			app := &app_mocks.App{}
-			if tc.SessionID != "" {
-				app.On("PrepareUserSession",
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("POST",
+				"http://localhost"+APIURLManagementWebhooks,
+				strings.NewReader(tc.Body),
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.RBACRoles != "" {
+				req.Header.Set(model.RBACHeaderRoles, tc.RBACRoles)
+			}
+			if tc.CreateErr != nil || tc.HTTPStatus == http.StatusCreated {
+				app.On("CreateWebhook",
 					mock.MatchedBy(func(_ context.Context) bool {
 						return true
 					}),
-					mock.MatchedBy(func(sess *model.Session) bool {
-						sess.ID = tc.SessionID
-						return true
-					}),
-				).Return(tc.PrepareUserSessionErr)
-				if tc.PrepareUserSessionErr == nil {
-					app.On("FreeUserSession",
-						mock.MatchedBy(func(_ context.Context) bool {
-							return true
-						}),
-						tc.SessionID,
-					).Return(nil)
-				}
+					tc.Identity.Tenant,
+					mock.AnythingOfType("*model.Webhook"),
+				).Run(func(args mock.Arguments) {
+					webhook := args.Get(2).(*model.Webhook)
+					webhook.ID = "00000000-0000-0000-0000-000000000001"
+					webhook.Secret = "0123456789abcdef"
+				}).Return(tc.CreateErr)
 			}
 
-			natsClient := NewNATSTestClient(t)
-			router, _ := NewRouter(app, natsClient)
-			url := strings.Replace(APIURLManagementDeviceConnect, ":deviceId", tc.DeviceID, 1)
-			req, err := http.NewRequest("GET", "http://localhost"+url, nil)
-			if !assert.NoError(t, err) {
-				t.FailNow()
-			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
 
-			if tc.Authorization != "" {
-				req.Header.Add("Authorization", tc.Authorization)
+			if tc.HTTPStatus == http.StatusCreated {
+				var webhook model.Webhook
+				err := json.Unmarshal(w.Body.Bytes(), &webhook)
+				assert.NoError(t, err)
+				assert.Equal(t, "00000000-0000-0000-0000-000000000001", webhook.ID)
+				assert.Equal(t, "0123456789abcdef", webhook.Secret)
 			}
+		})
+	}
+}
 
-			if len(tc.RBACHeader) > 0 {
-				app.On("RemoteTerminalAllowed",
+func TestManagementListWebhooks(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	webhooks := []model.Webhook{{
+		ID:     "00000000-0000-0000-0000-000000000001",
+		URL:    "https://example.com/hooks",
+		Events: []string{model.WebhookEventDeviceConnected},
+	}}
+
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	app.On("GetWebhooks",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		userID.Tenant,
+	).Return(webhooks, nil).Once()
+	app.On("GetWebhooks",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		userID.Tenant,
+	).Return(nil, errors.New("store: internal error")).Once()
+
+	router, _ := NewRouter(app, nil)
+	for _, status := range []int{
+		http.StatusOK,
+		http.StatusInternalServerError,
+	} {
+		req, _ := http.NewRequest("GET",
+			"http://localhost"+APIURLManagementWebhooks, nil,
+		)
+		req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*userID))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code)
+		if status == http.StatusOK {
+			var res []model.Webhook
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			assert.NoError(t, err)
+			assert.Equal(t, webhooks, res)
+		}
+	}
+}
+
+func TestManagementDeleteWebhook(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const webhookID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name      string
+		Identity  *identity.Identity
+		RBACRoles string
+
+		DeleteErr  error
+		HTTPStatus int
+	}{
+		{
+			Name:     "ok",
+			Identity: userID,
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:      "ko, not an administrator",
+			Identity:  userID,
+			RBACRoles: "RBAC_ROLE_REMOTE_TERMINAL",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name: "ko, device auth",
+			Identity: &identity.Identity{
+				Subject:  "1234567890",
+				Tenant:   "000000000000000000000000",
+				IsDevice: true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, not found",
+			Identity: userID,
+
+			DeleteErr:  app.ErrWebhookNotFound,
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:     "ko, internal error",
+			Identity: userID,
+
+			DeleteErr:  errors.New("store: internal error"),
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			deviceConnectApp := &app_mocks.App{}
+			defer deviceConnectApp.AssertExpectations(t)
+			if tc.Identity.IsUser && tc.HTTPStatus != http.StatusForbidden {
+				deviceConnectApp.On("DeleteWebhook",
 					mock.MatchedBy(func(_ context.Context) bool {
 						return true
 					}),
 					tc.Identity.Tenant,
-					tc.DeviceID,
-					[]string{"foo", "bar"},
-				).Return(tc.RemoteTerminalAllowed, tc.RemoteTerminalAllowedError)
+					webhookID,
+				).Return(tc.DeleteErr)
+			}
 
-				req.Header.Add(model.RBACHeaderRemoteTerminalGroups, tc.RBACHeader)
+			router, _ := NewRouter(deviceConnectApp, nil)
+
+			url := strings.Replace(APIURLManagementWebhook, ":webhookId", webhookID, 1)
+			req, _ := http.NewRequest("DELETE", "http://localhost"+url, nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			if tc.RBACRoles != "" {
+				req.Header.Set(model.RBACHeaderRoles, tc.RBACRoles)
 			}
 
 			w := httptest.NewRecorder()
 			router.ServeHTTP(w, req)
 			assert.Equal(t, tc.HTTPStatus, w.Code)
-
-			if tc.HTTPError != nil {
-				var response map[string]string
-				body := w.Body.Bytes()
-				_ = json.Unmarshal(body, &response)
-				value := response["error"]
-				assert.Equal(t, tc.HTTPError.Error(), value)
-			}
 		})
 	}
 }
+
+func TestManagementGetWebhookDeliveries(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const webhookID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		Filter     *model.WebhookDeliveryFilter
+		Deliveries []model.WebhookDelivery
+		Count      int64
+		FindErr    error
+
+		HTTPStatus  int
+		TotalCount  string
+		LinkHeaders int
+	}{
+		{
+			Name:     "ok",
+			Query:    "?page=2&per_page=1",
+			Identity: userID,
+
+			Filter: &model.WebhookDeliveryFilter{
+				WebhookID: webhookID,
+				Skip:      1,
+				Limit:     1,
+			},
+			Deliveries: []model.WebhookDelivery{{
+				ID:         "00000000-0000-0000-0000-000000000002",
+				WebhookID:  webhookID,
+				EventType:  model.WebhookEventDeviceConnected,
+				Status:     model.WebhookDeliveryStatusFailed,
+				Attempts:   5,
+				StatusCode: http.StatusBadGateway,
+				Timestamp:  time.Now().UTC().Round(time.Second),
+			}},
+			Count: 3,
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "3",
+			LinkHeaders: 4,
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:     "ko, bad paging parameters",
+			Query:    "?per_page=-1",
+			Identity: userID,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, internal error",
+			Identity: userID,
+
+			Filter: &model.WebhookDeliveryFilter{
+				WebhookID: webhookID,
+				Limit:     20,
+			},
+			FindErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			url := strings.Replace(APIURLManagementWebhookLog, ":webhookId", webhookID, 1)
+			req, _ := http.NewRequest("GET", "http://localhost"+url+tc.Query, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.Filter != nil {
+				app.On("GetWebhookDeliveries",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					*tc.Filter,
+				).Return(tc.Deliveries, tc.Count, tc.FindErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var deliveries []model.WebhookDelivery
+				err := json.Unmarshal(w.Body.Bytes(), &deliveries)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Deliveries, deliveries)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+				assert.Len(t, w.Header().Values(hdrLink), tc.LinkHeaders)
+			}
+		})
+	}
+}
+
+func TestManagementSearchDevices(t *testing.T) {
+	userID := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	lastSeen := time.Now().UTC().Round(time.Second)
+	testCases := []struct {
+		Name     string
+		Query    string
+		Body     string
+		Identity *identity.Identity
+
+		Filter      *model.DeviceFilter
+		Devices     []model.Device
+		Count       int64
+		SearchErr   error
+		HTTPStatus  int
+		TotalCount  string
+		LinkHeaders int
+	}{
+		{
+			Name:     "ok",
+			Query:    "?page=2&per_page=2",
+			Body:     `{"device_ids": ["1", "2", "3"], "status": "connected"}`,
+			Identity: userID,
+
+			Filter: &model.DeviceFilter{
+				IDs:    []string{"1", "2", "3"},
+				Status: model.DeviceStatusConnected,
+				Skip:   2,
+				Limit:  2,
+			},
+			Devices: []model.Device{{
+				ID:         "3",
+				Status:     model.DeviceStatusConnected,
+				CreatedTs:  time.Now().UTC().Round(time.Second),
+				UpdatedTs:  time.Now().UTC().Round(time.Second),
+				LastSeenTs: &lastSeen,
+			}},
+			Count: 3,
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "3",
+			LinkHeaders: 3,
+		},
+		{
+			Name:     "ok, no filter",
+			Identity: userID,
+
+			Filter: &model.DeviceFilter{
+				Limit: 20,
+			},
+			Devices: []model.Device{},
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "0",
+			LinkHeaders: 1,
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "ko, device auth",
+			Identity: &identity.Identity{
+				Subject:  "1234567890",
+				Tenant:   "000000000000000000000000",
+				IsDevice: true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, bad paging parameters",
+			Query:    "?per_page=foo",
+			Identity: userID,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, malformed body",
+			Body:     `{"device_ids": "1"}`,
+			Identity: userID,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, invalid filter",
+			Body:     `{"status": "online"}`,
+			Identity: userID,
+
+			Filter: &model.DeviceFilter{
+				Status: "online",
+				Limit:  20,
+			},
+			SearchErr: errors.Wrap(validation.Errors{
+				"status": errors.New("must be a valid value"),
+			}, "app: invalid device filter"),
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, internal error",
+			Identity: userID,
+
+			Filter: &model.DeviceFilter{
+				Limit: 20,
+			},
+			SearchErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("POST",
+				"http://localhost"+APIURLManagementDevicesSearch+tc.Query,
+				strings.NewReader(tc.Body),
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.Filter != nil {
+				app.On("SearchDevices",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					*tc.Filter,
+				).Return(tc.Devices, tc.Count, tc.SearchErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var devices []model.Device
+				err := json.Unmarshal(w.Body.Bytes(), &devices)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Devices, devices)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+				assert.Len(t, w.Header().Values(hdrLink), tc.LinkHeaders)
+			}
+		})
+	}
+}
+
+func TestManagementGetDeviceConnections(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		DeviceID string
+		Query    string
+		Identity *identity.Identity
+
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+
+		Filter      *model.ConnectionFilter
+		Events      []model.ConnectionEvent
+		Count       int64
+		GetErr      error
+		HTTPStatus  int
+		TotalCount  string
+		LinkHeaders int
+	}{
+		{
+			Name:     "ok",
+			DeviceID: "1234567890",
+			Query:    "?page=2&per_page=1",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.ConnectionFilter{
+				DeviceID: "1234567890",
+				Skip:     1,
+				Limit:    1,
+			},
+			Events: []model.ConnectionEvent{{
+				ID:         "00000000-0000-0000-0000-000000000001",
+				DeviceID:   "1234567890",
+				Type:       model.ConnectionEventDisconnected,
+				Timestamp:  time.Now().UTC().Round(time.Second),
+				RemoteAddr: "10.0.0.1",
+				InstanceID: "deviceconnect-1",
+				Reason:     model.DisconnectReasonTimeout,
+				Error:      "i/o timeout",
+			}},
+			Count: 3,
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "3",
+			LinkHeaders: 4,
+		},
+		{
+			Name:     "ok, device in the RBAC groups",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:            "group1,group2",
+			RemoteTerminalAllowed: true,
+
+			Filter: &model.ConnectionFilter{
+				DeviceID: "1234567890",
+				Limit:    20,
+			},
+			Events: []model.ConnectionEvent{},
+
+			HTTPStatus:  http.StatusOK,
+			TotalCount:  "0",
+			LinkHeaders: 1,
+		},
+		{
+			Name:     "ko, device not in the RBAC groups",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "group1,group2",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:     "ko, missing auth",
+			DeviceID: "1234567890",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:     "ko, device auth",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject:  "1234567890",
+				Tenant:   "000000000000000000000000",
+				IsDevice: true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, bad paging parameters",
+			DeviceID: "1234567890",
+			Query:    "?per_page=foo",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, internal error",
+			DeviceID: "1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.ConnectionFilter{
+				DeviceID: "1234567890",
+				Limit:    20,
+			},
+			GetErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			url := strings.Replace(
+				APIURLManagementDeviceConns, ":deviceId", tc.DeviceID, 1,
+			)
+			req, _ := http.NewRequest("GET", "http://localhost"+url+tc.Query, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.RBACGroups != "" {
+				req.Header.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					tc.DeviceID,
+					[]string{"group1", "group2"},
+				).Return(tc.RemoteTerminalAllowed, nil)
+			}
+			if tc.Filter != nil {
+				app.On("GetConnectionEvents",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					*tc.Filter,
+				).Return(tc.Events, tc.Count, tc.GetErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var events []model.ConnectionEvent
+				err := json.Unmarshal(w.Body.Bytes(), &events)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Events, events)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+				assert.Len(t, w.Header().Values(hdrLink), tc.LinkHeaders)
+			}
+		})
+	}
+}
+
+func TestManagementListSessions(t *testing.T) {
+	startTsFrom := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	startTsTo := time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+		GroupsDevices         []string
+		GroupsDevicesErr      error
+
+		Filter     *model.SessionFilter
+		Sessions   []model.Session
+		Count      int64
+		GetSessErr error
+
+		HTTPStatus int
+		TotalCount string
+	}{
+		{
+			Name: "ok",
+			Query: "?user_id=00000000-0000-0000-0000-000000000000" +
+				"&device_id=1234567890" +
+				"&start_ts_from=2020-12-01T00:00:00Z" +
+				"&start_ts_to=2020-12-31T00:00:00Z" +
+				"&sort=asc&page=1&per_page=10",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				UserID:      "00000000-0000-0000-0000-000000000000",
+				DeviceID:    "1234567890",
+				StartTsFrom: &startTsFrom,
+				StartTsTo:   &startTsTo,
+				Sort:        model.SortAscending,
+				Limit:       10,
+			},
+			Sessions: []model.Session{{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000000",
+				DeviceID: "1234567890",
+				StartTS:  startTsFrom.Add(time.Hour),
+			}},
+			Count: 1,
+
+			HTTPStatus: http.StatusOK,
+			TotalCount: "1",
+		},
+		{
+			Name:  "ok, sessions of the devices in the RBAC groups",
+			Query: "?user_id=00000000-0000-0000-0000-000000000000",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:    "group1,group2",
+			GroupsDevices: []string{"1234567890"},
+
+			Filter: &model.SessionFilter{
+				UserID:    "00000000-0000-0000-0000-000000000000",
+				DeviceIDs: []string{"1234567890"},
+				Limit:     20,
+			},
+			Sessions: []model.Session{{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000000",
+				DeviceID: "1234567890",
+				StartTS:  startTsFrom,
+			}},
+			Count: 1,
+
+			HTTPStatus: http.StatusOK,
+			TotalCount: "1",
+		},
+		{
+			Name:  "ok, device in the RBAC groups",
+			Query: "?device_id=1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:            "group1,group2",
+			RemoteTerminalAllowed: true,
+
+			Filter: &model.SessionFilter{
+				DeviceID: "1234567890",
+				Limit:    20,
+			},
+			Sessions: []model.Session{},
+
+			HTTPStatus: http.StatusOK,
+			TotalCount: "0",
+		},
+		{
+			Name:  "ko, device not in the RBAC groups",
+			Query: "?device_id=1234567890",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "group1,group2",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name: "ko, error looking up the devices of the RBAC groups",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:       "group1,group2",
+			GroupsDevicesErr: errors.New("inventory: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:  "ko, bad start_ts_from",
+			Query: "?start_ts_from=yesterday",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, start_ts range inverted",
+			Query: "?start_ts_from=2020-12-31T00:00:00Z" +
+				"&start_ts_to=2020-12-01T00:00:00Z",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:  "ko, bad sort",
+			Query: "?sort=sideways",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, internal error",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				Limit: 20,
+			},
+			GetSessErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("GET",
+				"http://localhost"+APIURLManagementSessions+tc.Query, nil,
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.RBACGroups != "" {
+				req.Header.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
+				ctxMatcher := mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				})
+				groups := []string{"group1", "group2"}
+				if strings.Contains(tc.Query, qDeviceID+"=") {
+					app.On("RemoteTerminalAllowed",
+						ctxMatcher,
+						tc.Identity.Tenant,
+						"1234567890",
+						groups,
+					).Return(tc.RemoteTerminalAllowed, nil)
+				} else {
+					app.On("GetGroupsDevices",
+						ctxMatcher,
+						tc.Identity.Tenant,
+						groups,
+					).Return(tc.GroupsDevices, tc.GroupsDevicesErr)
+				}
+			}
+			if tc.Filter != nil {
+				app.On("GetSessions",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					*tc.Filter,
+				).Return(tc.Sessions, tc.Count, tc.GetSessErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var sessions []model.Session
+				err := json.Unmarshal(w.Body.Bytes(), &sessions)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Sessions, sessions)
+				assert.Equal(t, tc.TotalCount, w.Header().Get(hdrTotalCount))
+			}
+		})
+	}
+}
+
+func TestManagementTerminateSession(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		SessionID string
+		Identity  *identity.Identity
+
+		// RBACRoles and RBACGroups are the RBAC headers of the request
+		RBACRoles             string
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+
+		GetSession    *model.Session
+		GetSessionErr error
+		FreeSessErr   error
+
+		HTTPStatus int
+	}{
+		{
+			Name:      "ok",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+			},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:      "ok, session freed concurrently",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+			},
+			FreeSessErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:      "ok, administrator with access to the device",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACRoles:             "RBAC_ROLE_OBSERVER," + model.RBACRoleAdmin,
+			RBACGroups:            "foo,bar",
+			RemoteTerminalAllowed: true,
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+			},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:      "ko, not an administrator",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACRoles: "RBAC_ROLE_REMOTE_TERMINAL",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:      "ko, restricted to device groups",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "foo,bar",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:      "ko, no access to the device (RBAC)",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACRoles:  model.RBACRoleAdmin,
+			RBACGroups: "foo,bar",
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+			},
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:      "ko, session already closed",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusDisconnected,
+			},
+
+			HTTPStatus: http.StatusConflict,
+		},
+		{
+			Name:      "ko, missing auth",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:      "ko, not found",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:      "ko, internal error",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSessionErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name:      "ko, error freeing session",
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+			},
+			FreeSessErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+
+			url := strings.Replace(
+				APIURLManagementSessionsID, ":sessionId", tc.SessionID, 1,
+			)
+			req, _ := http.NewRequest("DELETE", "http://localhost"+url, nil)
+			natsChan := make(chan *nats.Msg, 2)
+			if tc.RBACRoles != "" {
+				req.Header.Set(model.RBACHeaderRoles, tc.RBACRoles)
+			}
+			if tc.RBACGroups != "" {
+				req.Header.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
+			}
+			// the users restricted to device groups are not administrators
+			admin := tc.RBACRoles == "" && tc.RBACGroups == "" ||
+				strings.Contains(tc.RBACRoles, model.RBACRoleAdmin)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.Identity != nil && admin {
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.SessionID,
+				).Return(tc.GetSession, tc.GetSessionErr)
+				sub, _ := natsClient.ChanSubscribe(
+					model.GetDeviceSubject(tc.Identity.Tenant, "*"),
+					natsChan,
+				)
+				defer sub.Unsubscribe()
+				sub, _ = natsClient.ChanSubscribe(
+					model.GetSessionSubject(tc.Identity.Tenant, tc.SessionID),
+					natsChan,
+				)
+				defer sub.Unsubscribe()
+			}
+			closed := tc.GetSession != nil &&
+				tc.GetSession.Status == model.SessionStatusDisconnected
+			if tc.GetSession != nil && !closed && tc.RBACGroups != "" {
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					tc.GetSession.DeviceID,
+					strings.Split(tc.RBACGroups, ","),
+				).Return(tc.RemoteTerminalAllowed, nil)
+			}
+			denied := tc.RBACGroups != "" && !tc.RemoteTerminalAllowed
+			if tc.GetSession != nil && !closed && !denied {
+				app.On("FreeUserSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.SessionID,
+					model.SessionEnd{
+						Reason: model.SessionCloseReasonTerminated,
+					},
+				).Return(tc.FreeSessErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.GetSession == nil || closed || denied {
+				return
+			}
+			for i := 0; i < 2; i++ {
+				select {
+				case natsMsg := <-natsChan:
+					var msg ws.ProtoMsg
+					err := msgpack.Unmarshal(natsMsg.Data, &msg)
+					if assert.NoError(t, err) {
+						assert.Equal(t, shell.MessageTypeStopShell, msg.Header.MsgType)
+						assert.Equal(t, tc.SessionID, msg.Header.SessionID)
+						assert.Equal(t,
+							tc.Identity.Subject,
+							msg.Header.Properties[PropertyTerminatedBy],
+						)
+					}
+				case <-time.After(time.Second * 5):
+					assert.Fail(t, "timeout waiting for stop message")
+				}
+			}
+		})
+	}
+}
+
+func TestManagementConnect(t *testing.T) {
+	prevPongWait := pongWait
+	prevWriteWait := writeWait
+	defer func() {
+		pongWait = prevPongWait
+		writeWait = prevWriteWait
+	}()
+	pongWait = time.Second
+	writeWait = time.Second
+	testCases := []struct {
+		Name                       string
+		DeviceID                   string
+		SessionID                  string
+		Identity                   identity.Identity
+		RBACHeader                 string
+		RemoteTerminalAllowedError error
+		RemoteTerminalAllowed      bool
+	}{
+		{
+			Name:      "ok",
+			DeviceID:  "1234567890",
+			SessionID: "session_id",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+				Plan:    "professional",
+			},
+		},
+		{
+			Name:      "ok with RBAC",
+			DeviceID:  "1234567890",
+			SessionID: "session_id",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+				Plan:    "enterprise",
+			},
+			RBACHeader:            "foo,bar",
+			RemoteTerminalAllowed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(tc.Identity))
+
+			app.On("PrepareUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				mock.MatchedBy(func(sess *model.Session) bool {
+					sess.ID = tc.SessionID
+					return true
+				}),
+			).Return(nil)
+			app.On("FreeUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.SessionID,
+				mock.AnythingOfType("model.SessionEnd"),
+			).Return(nil)
+			if len(tc.RBACHeader) > 0 {
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					tc.DeviceID,
+					[]string{"foo", "bar"},
+				).Return(tc.RemoteTerminalAllowed, tc.RemoteTerminalAllowedError)
+
+				headers.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACHeader)
+			}
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			url = url + strings.Replace(
+				APIURLManagementDeviceConnect, ":deviceId",
+				tc.DeviceID, 1,
+			)
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			assert.NoError(t, err)
+
+			pingReceived := make(chan struct{}, 1)
+			conn.SetPingHandler(func(message string) error {
+				pingReceived <- struct{}{}
+				return conn.WriteControl(
+					websocket.PongMessage,
+					[]byte{},
+					time.Now().Add(writeWait),
+				)
+			})
+			pongReceived := make(chan struct{}, 1)
+			conn.SetPongHandler(func(message string) error {
+				pongReceived <- struct{}{}
+				return nil
+			})
+
+			receivedMsg := make(chan []byte, 1)
+			go func() {
+				for {
+					_, data, err := conn.ReadMessage()
+					if err != nil {
+						break
+					}
+					receivedMsg <- data
+				}
+			}()
+			natsChan := make(chan *nats.Msg, 2)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(
+					tc.Identity.Tenant,
+					tc.DeviceID,
+				), natsChan,
+			)
+			defer sub.Unsubscribe()
+			msg := ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ws.ProtoTypeShell,
+					MsgType: shell.MessageTypeShellCommand,
+				},
+			}
+			b, _ := msgpack.Marshal(msg)
+			err = conn.WriteMessage(websocket.BinaryMessage, b)
+			assert.NoError(t, err)
+			select {
+			case natsMsg := <-natsChan:
+				var rMsg ws.ProtoMsg
+				err = msgpack.Unmarshal(natsMsg.Data, &rMsg)
+				if assert.NoError(t, err) {
+					msg.Header.SessionID = tc.SessionID
+					msg.Header.Properties = map[string]interface{}{
+						"user_id": tc.Identity.Subject,
+					}
+					assert.Equal(t, msg, rMsg)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t,
+					"api did not forward message to message bus",
+				)
+			}
+			err = conn.WriteControl(
+				websocket.PingMessage,
+				[]byte("1"),
+				time.Now().Add(time.Second),
+			)
+			assert.NoError(t, err)
+
+			msg.Header.SessionID = tc.SessionID
+			b, _ = msgpack.Marshal(msg)
+			err = natsClient.Publish(
+				model.GetSessionSubject(tc.Identity.Tenant, tc.SessionID),
+				b,
+			)
+			assert.NoError(t, err)
+			select {
+			case p := <-receivedMsg:
+				assert.Equal(t, b, p)
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timed out waiting for message from device")
+			}
+
+			// check that ping and pong works as expected
+			select {
+			case <-pingReceived:
+			case <-time.After(pongWait):
+				assert.Fail(t, "did not receive ping within pongWait")
+			}
+
+			select {
+			case <-pongReceived:
+			case <-time.After(pongWait):
+				assert.Fail(t, "did not receive pong within pongWait")
+			}
+
+			// close the websocket
+			conn.Close()
+
+			select {
+			case msg := <-natsChan:
+				var stopMsg ws.ProtoMsg
+				err := msgpack.Unmarshal(msg.Data, &stopMsg)
+				if assert.NoError(t, err) {
+					assert.Equal(t,
+						ws.ProtoTypeShell,
+						stopMsg.Header.Proto,
+					)
+					assert.Equal(t,
+						shell.MessageTypeStopShell,
+						stopMsg.Header.MsgType,
+					)
+				}
+
+			case <-time.After(time.Second * 5):
+				assert.Fail(t,
+					"timeout waiting for stop message on nats channel",
+				)
+			}
+
+			// wait 100ms to let the websocket fully shutdown on the server
+			time.Sleep(100 * time.Millisecond)
+
+			app.AssertExpectations(t)
+		})
+	}
+}
+
+func TestManagementConnectFailures(t *testing.T) {
+	testCases := []struct {
+		Name                       string
+		DeviceID                   string
+		SessionID                  string
+		PrepareUserSessionErr      error
+		Authorization              string
+		Identity                   identity.Identity
+		RBACHeader                 string
+		RemoteTerminalAllowedError error
+		RemoteTerminalAllowed      bool
+		HTTPStatus                 int
+		HTTPError                  error
+	}{
+		{
+			Name:      "ko, unable to upgrade",
+			SessionID: "1",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:                  "ko, session preparation failure",
+			SessionID:             "1",
+			PrepareUserSessionErr: errors.New("Error"),
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name:                  "ko, device not found",
+			SessionID:             "1",
+			PrepareUserSessionErr: app.ErrDeviceNotFound,
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:                  "ko, session limit reached",
+			SessionID:             "1",
+			PrepareUserSessionErr: app.ErrDeviceSessionLimit,
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusTooManyRequests,
+		},
+		{
+			Name:                  "ko, remote terminal not supported",
+			SessionID:             "1",
+			PrepareUserSessionErr: app.ErrShellNotSupported,
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusConflict,
+			HTTPError:  app.ErrShellNotSupported,
+		},
+		{
+			Name:       "ko, missing authorization header",
+			HTTPStatus: http.StatusUnauthorized,
+			HTTPError:  errors.New("Authorization not present in header"),
+		},
+		{
+			Name: "ko, malformed authorization header",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "malformed",
+			HTTPStatus:    http.StatusUnauthorized,
+			HTTPError:     errors.New("malformed Authorization header"),
+		},
+		{
+			Name: "ko, RBAC - not allowed",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			SessionID: "1",
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			RBACHeader:            "foo,bar",
+			RemoteTerminalAllowed: false,
+			HTTPStatus:            http.StatusForbidden,
+		},
+		{
+			Name:      "ko, RBAC - error",
+			SessionID: "1",
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			RBACHeader:                 "foo,bar",
+			RemoteTerminalAllowed:      false,
+			RemoteTerminalAllowedError: errors.New("foo"),
+			HTTPStatus:                 http.StatusInternalServerError,
+			HTTPError:                  errors.New("internal error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			if tc.SessionID != "" {
+				app.On("PrepareUserSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					mock.MatchedBy(func(sess *model.Session) bool {
+						sess.ID = tc.SessionID
+						return true
+					}),
+				).Return(tc.PrepareUserSessionErr)
+				if tc.PrepareUserSessionErr == nil {
+					app.On("FreeUserSession",
+						mock.MatchedBy(func(_ context.Context) bool {
+							return true
+						}),
+						tc.SessionID,
+						mock.AnythingOfType("model.SessionEnd"),
+					).Return(nil)
+				}
+			}
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+			url := strings.Replace(APIURLManagementDeviceConnect, ":deviceId", tc.DeviceID, 1)
+			req, err := http.NewRequest("GET", "http://localhost"+url, nil)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			if tc.Authorization != "" {
+				req.Header.Add("Authorization", tc.Authorization)
+			}
+
+			if len(tc.RBACHeader) > 0 {
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					tc.DeviceID,
+					[]string{"foo", "bar"},
+				).Return(tc.RemoteTerminalAllowed, tc.RemoteTerminalAllowedError)
+
+				req.Header.Add(model.RBACHeaderRemoteTerminalGroups, tc.RBACHeader)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPError != nil {
+				var response map[string]string
+				body := w.Body.Bytes()
+				_ = json.Unmarshal(body, &response)
+				value := response["error"]
+				assert.Equal(t, tc.HTTPError.Error(), value)
+			}
+		})
+	}
+}
+
+func TestManagementGetSettings(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Identity *identity.Identity
+
+		Settings    *model.TenantSettings
+		SettingsErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Settings: &model.TenantSettings{RecordSessions: true},
+
+			HTTPStatus: http.StatusOK,
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "ko, internal error",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			SettingsErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("GET",
+				"http://localhost"+APIURLManagementSettings, nil,
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+				app.On("GetTenantSettings",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+				).Return(tc.Settings, tc.SettingsErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var settings *model.TenantSettings
+				err := json.Unmarshal(w.Body.Bytes(), &settings)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Settings, settings)
+			}
+		})
+	}
+}
+
+func TestManagementUpdateSettings(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		Identity  *identity.Identity
+		RBACRoles string
+		Body      string
+
+		Settings    *model.TenantSettings
+		SettingsErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Body: `{"record_sessions": true, "idle_timeout": 10}`,
+
+			Settings: &model.TenantSettings{
+				RecordSessions: true,
+				IdleTimeout:    10,
+			},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name: "ok, administrator",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACRoles: model.RBACRoleAdmin,
+			Body:      `{"record_sessions": false}`,
+
+			Settings: &model.TenantSettings{},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name: "ko, not an administrator",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACRoles: "RBAC_ROLE_REMOTE_TERMINAL",
+			Body:      `{"record_sessions": false}`,
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name: "ko, negative timeout",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Body: `{"max_session_duration": -1}`,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, missing auth",
+			Body: `{"record_sessions": true}`,
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "ko, bad payload",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Body: `{"record_sessions": "yes"}`,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, internal error",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Body: `{"record_sessions": false}`,
+
+			Settings:    &model.TenantSettings{},
+			SettingsErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			req, _ := http.NewRequest("PUT",
+				"http://localhost"+APIURLManagementSettings,
+				strings.NewReader(tc.Body),
+			)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			if tc.RBACRoles != "" {
+				req.Header.Set(model.RBACHeaderRoles, tc.RBACRoles)
+			}
+			if tc.Settings != nil {
+				app.On("UpdateTenantSettings",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					tc.Settings,
+				).Return(tc.SettingsErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+		})
+	}
+}
+
+func TestManagementPlayback(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	start := time.Now().UTC()
+	frame := func(offset time.Duration, direction, body string) model.RecordingFrame {
+		data, _ := msgpack.Marshal(ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   shell.MessageTypeShellCommand,
+				SessionID: sessionID,
+			},
+			Body: []byte(body),
+		})
+		return model.RecordingFrame{
+			SessionID: sessionID,
+			Timestamp: start.Add(offset),
+			Direction: direction,
+			Data:      data,
+		}
+	}
+	frames := []model.RecordingFrame{
+		frame(0, model.RecordingDirectionInput, "ls\n"),
+		frame(100*time.Millisecond, model.RecordingDirectionOutput, "foo"),
+		frame(time.Second, model.RecordingDirectionOutput, "bar"),
+		frame(3*time.Second, model.RecordingDirectionOutput, "baz"),
+	}
+
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		GetSessionErr         error
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+
+		Frames       []model.RecordingFrame
+		RecordingErr error
+
+		HTTPStatus int
+		Bodies     []string
+		MinTime    time.Duration
+		MaxTime    time.Duration
+	}{
+		{
+			Name:  "ok",
+			Query: "?speed=10&seek=0.5",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Frames: frames,
+
+			HTTPStatus: http.StatusSwitchingProtocols,
+			Bodies:     []string{"foo", "bar", "baz"},
+			// (3s - 0.5s) / 10
+			MinTime: 250 * time.Millisecond,
+			MaxTime: time.Second,
+		},
+		{
+			Name:  "ok, with RBAC",
+			Query: "?speed=100",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:            "foo,bar",
+			RemoteTerminalAllowed: true,
+
+			Frames: frames,
+
+			HTTPStatus: http.StatusSwitchingProtocols,
+			Bodies:     []string{"foo", "bar", "baz"},
+			MaxTime:    time.Second,
+		},
+		{
+			Name: "ko, RBAC denied",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "foo,bar",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name: "ko, session not found",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:  "ko, bad speed",
+			Query: "?speed=0",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:  "ko, bad seek",
+			Query: "?seek=-1",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, not recorded",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			RecordingErr: app.ErrSessionNotRecorded,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name: "ko, internal error",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			RecordingErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			sess := &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				Recorded: true,
+			}
+			if tc.Frames != nil || tc.RecordingErr != nil ||
+				tc.GetSessionErr != nil || tc.RBACGroups != "" {
+				if tc.GetSessionErr != nil {
+					sess = nil
+				}
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(sess, tc.GetSessionErr)
+			}
+			if tc.RBACGroups != "" {
+				headers.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					sess.DeviceID,
+					strings.Split(tc.RBACGroups, ","),
+				).Return(tc.RemoteTerminalAllowed, nil)
+			}
+			if tc.Frames != nil || tc.RecordingErr != nil {
+				app.On("GetSessionRecording",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sess,
+				).Return(tc.Frames, tc.RecordingErr)
+			}
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				strings.Replace(
+					APIURLManagementPlayback, ":sessionId", sessionID, 1,
+				) + tc.Query
+			begin := time.Now()
+			conn, rsp, err := websocket.DefaultDialer.Dial(url, headers)
+			if assert.NotNil(t, rsp) {
+				assert.Equal(t, tc.HTTPStatus, rsp.StatusCode)
+			}
+			if tc.HTTPStatus != http.StatusSwitchingProtocols {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			var bodies []string
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					assert.True(t, websocket.IsCloseError(
+						err, websocket.CloseNormalClosure,
+					))
+					break
+				}
+				var msg ws.ProtoMsg
+				err = msgpack.Unmarshal(data, &msg)
+				if assert.NoError(t, err) {
+					bodies = append(bodies, string(msg.Body))
+				}
+			}
+			assert.Equal(t, tc.Bodies, bodies)
+			elapsed := time.Since(begin)
+			assert.GreaterOrEqual(t, int64(elapsed), int64(tc.MinTime))
+			assert.Less(t, int64(elapsed), int64(tc.MaxTime))
+		})
+	}
+}
+
+func TestManagementGetRecording(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	data, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sessionID,
+		},
+		Body: []byte("foo"),
+	})
+	frames := []model.RecordingFrame{{
+		SessionID: sessionID,
+		Timestamp: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Direction: model.RecordingDirectionOutput,
+		Data:      data,
+	}}
+
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		GetSessionErr         error
+		RBACGroups            string
+		RemoteTerminalAllowed bool
+
+		Frames       []model.RecordingFrame
+		RecordingErr error
+
+		HTTPStatus int
+		Body       string
+	}{
+		{
+			Name:  "ok",
+			Query: "?format=asciicast",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Frames: frames,
+
+			HTTPStatus: http.StatusOK,
+			Body: `{"version":2,"width":80,"height":24,"timestamp":1609459200}
+[0,"o","foo"]
+`,
+		},
+		{
+			Name:  "ok, with RBAC",
+			Query: "?format=asciicast",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups:            "foo,bar",
+			RemoteTerminalAllowed: true,
+
+			Frames: frames,
+
+			HTTPStatus: http.StatusOK,
+			Body: `{"version":2,"width":80,"height":24,"timestamp":1609459200}
+[0,"o","foo"]
+`,
+		},
+		{
+			Name:  "ko, RBAC denied",
+			Query: "?format=asciicast",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			RBACGroups: "foo,bar",
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:  "ko, missing auth",
+			Query: "?format=asciicast",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:  "ko, unsupported format",
+			Query: "?format=ttyrec",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:  "ko, not found",
+			Query: "?format=asciicast",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:  "ko, internal error",
+			Query: "?format=asciicast",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			RecordingErr: errors.New("store: internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil)
+
+			url := strings.Replace(
+				APIURLManagementRecording, ":sessionId", sessionID, 1,
+			)
+			req, _ := http.NewRequest("GET", "http://localhost"+url+tc.Query, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+			sess := &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				Recorded: true,
+			}
+			if tc.Frames != nil || tc.RecordingErr != nil ||
+				tc.GetSessionErr != nil || tc.RBACGroups != "" {
+				if tc.GetSessionErr != nil {
+					sess = nil
+				}
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(sess, tc.GetSessionErr)
+			}
+			if tc.RBACGroups != "" {
+				req.Header.Set(model.RBACHeaderRemoteTerminalGroups, tc.RBACGroups)
+				app.On("RemoteTerminalAllowed",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Identity.Tenant,
+					sess.DeviceID,
+					strings.Split(tc.RBACGroups, ","),
+				).Return(tc.RemoteTerminalAllowed, nil)
+			}
+			if tc.Frames != nil || tc.RecordingErr != nil {
+				app.On("GetSessionRecording",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sess,
+				).Return(tc.Frames, tc.RecordingErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				assert.Equal(t, tc.Body, w.Body.String())
+				assert.Equal(t,
+					"application/x-asciicast",
+					w.Header().Get("Content-Type"),
+				)
+			}
+		})
+	}
+}
+
+func TestManagementObserve(t *testing.T) {
+	prevPongWait := pongWait
+	prevWriteWait := writeWait
+	defer func() {
+		pongWait = prevPongWait
+		writeWait = prevWriteWait
+	}()
+	pongWait = time.Second
+	writeWait = time.Second
+
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name     string
+		Identity *identity.Identity
+
+		GetSession    *model.Session
+		GetSessionErr error
+		ObserveErr    error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       sessionID,
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusConnected,
+			},
+
+			HTTPStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			Name: "ko, not found",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name: "ko, session closed",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       sessionID,
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusDisconnected,
+			},
+
+			HTTPStatus: http.StatusConflict,
+		},
+		{
+			Name: "ko, session closed while attaching",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			GetSession: &model.Session{
+				ID:       sessionID,
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				DeviceID: "1234567890",
+				Status:   model.SessionStatusConnected,
+			},
+			ObserveErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			app.On("GetSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(tc.GetSession, tc.GetSessionErr)
+			observing := tc.GetSession != nil &&
+				tc.GetSession.Status == model.SessionStatusConnected
+			if observing {
+				observer := &model.SessionObserver{
+					ID:     "00000000-0000-0000-0000-000000000003",
+					UserID: tc.Identity.Subject,
+				}
+				if tc.ObserveErr != nil {
+					observer = nil
+				}
+				app.On("ObserveSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+					tc.Identity.Subject,
+				).Return(observer, tc.ObserveErr)
+			}
+			stopped := make(chan struct{})
+			if observing && tc.ObserveErr == nil {
+				app.On("StopObservingSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+					"00000000-0000-0000-0000-000000000003",
+				).Run(func(args mock.Arguments) {
+					close(stopped)
+				}).Return(nil)
+			}
+
+			deviceChan := make(chan *nats.Msg, 1)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(tc.Identity.Tenant, "1234567890"),
+				deviceChan,
+			)
+			defer sub.Unsubscribe()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				strings.Replace(
+					APIURLManagementObserve, ":sessionId", sessionID, 1,
+				)
+			conn, rsp, err := websocket.DefaultDialer.Dial(url, headers)
+			if assert.NotNil(t, rsp) {
+				assert.Equal(t, tc.HTTPStatus, rsp.StatusCode)
+			}
+			if tc.HTTPStatus != http.StatusSwitchingProtocols {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			msg, _ := msgpack.Marshal(ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   shell.MessageTypeShellCommand,
+					SessionID: sessionID,
+				},
+				Body: []byte("output"),
+			})
+			// wait for the subscription to be established
+			time.Sleep(100 * time.Millisecond)
+			err = natsClient.Publish(
+				model.GetSessionSubject(tc.Identity.Tenant, sessionID), msg,
+			)
+			assert.NoError(t, err)
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, data, err := conn.ReadMessage()
+			if assert.NoError(t, err) {
+				assert.Equal(t, msg, data)
+			}
+
+			// the input of observers is dropped
+			err = conn.WriteMessage(websocket.BinaryMessage, msg)
+			assert.NoError(t, err)
+			select {
+			case <-deviceChan:
+				assert.Fail(t, "observer input forwarded to the device")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			conn.Close()
+			select {
+			case <-stopped:
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for the observer to detach")
+			}
+		})
+	}
+}
+
+func TestManagementConnectExpiry(t *testing.T) {
+	prevPongWait := pongWait
+	prevWriteWait := writeWait
+	prevLimitUnit := sessionLimitUnit
+	prevCheckPeriod := sessionLimitsCheckPeriod
+	prevWarning := sessionExpiryWarning
+	defer func() {
+		pongWait = prevPongWait
+		writeWait = prevWriteWait
+		sessionLimitUnit = prevLimitUnit
+		sessionLimitsCheckPeriod = prevCheckPeriod
+		sessionExpiryWarning = prevWarning
+	}()
+	pongWait = time.Second
+	writeWait = time.Second
+	sessionLimitUnit = 300 * time.Millisecond
+	sessionLimitsCheckPeriod = 10 * time.Millisecond
+	sessionExpiryWarning = 200 * time.Millisecond
+
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		deviceID  = "1234567890"
+	)
+	id := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name string
+
+		IdleTimeout int
+		MaxDuration int
+
+		Reason string
+	}{{
+		Name: "idle timeout",
+
+		IdleTimeout: 1,
+
+		Reason: model.SessionCloseReasonIdleTimeout,
+	}, {
+		Name: "maximum duration",
+
+		IdleTimeout: 5,
+		MaxDuration: 1,
+
+		Reason: model.SessionCloseReasonMaxDuration,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			app.On("PrepareUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				mock.MatchedBy(func(sess *model.Session) bool {
+					sess.ID = sessionID
+					sess.IdleTimeout = tc.IdleTimeout
+					sess.MaxDuration = tc.MaxDuration
+					return true
+				}),
+			).Return(nil)
+			freed := make(chan model.SessionEnd, 1)
+			app.On("FreeUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				mock.AnythingOfType("model.SessionEnd"),
+			).Run(func(args mock.Arguments) {
+				freed <- args.Get(2).(model.SessionEnd)
+			}).Return(nil).Once()
+
+			deviceChan := make(chan *nats.Msg, 2)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(id.Tenant, deviceID), deviceChan,
+			)
+			defer sub.Unsubscribe()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				strings.Replace(
+					APIURLManagementDeviceConnect, ":deviceId", deviceID, 1,
+				)
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			var msg ws.ProtoMsg
+			_, data, err := conn.ReadMessage()
+			if assert.NoError(t, err) {
+				_ = msgpack.Unmarshal(data, &msg)
+				assert.Equal(t, shell.MessageTypeShellCommand, msg.Header.MsgType)
+				assert.EqualValues(t,
+					shell.ControlMessage, msg.Header.Properties["status"],
+				)
+				assert.Contains(t, string(msg.Body), "warning")
+			}
+			_, data, err = conn.ReadMessage()
+			if assert.NoError(t, err) {
+				stop, isStop := parseStopMessage(data)
+				if assert.True(t, isStop) {
+					assert.Equal(t, tc.Reason, stop.closeReason)
+				}
+			}
+			_, data, err = conn.ReadMessage()
+			if assert.NoError(t, err) {
+				assertErrorMessage(t, data, CloseSessionExpired)
+			}
+			_, _, err = conn.ReadMessage()
+			if assert.IsType(t, &websocket.CloseError{}, err) {
+				assert.Equal(t,
+					CloseSessionExpired,
+					err.(*websocket.CloseError).Code,
+				)
+				assert.Equal(t,
+					sessionExpiryText(tc.Reason),
+					err.(*websocket.CloseError).Text,
+				)
+			}
+
+			select {
+			case msg := <-deviceChan:
+				stop, isStop := parseStopMessage(msg.Data)
+				if assert.True(t, isStop) {
+					assert.Equal(t, tc.Reason, stop.closeReason)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for stop message")
+			}
+			select {
+			case end := <-freed:
+				assert.Equal(t, tc.Reason, end.Reason)
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for the session to be freed")
+			}
+			select {
+			case <-deviceChan:
+				assert.Fail(t, "shell stopped twice")
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestManagementReconnect(t *testing.T) {
+	prevPongWait := pongWait
+	prevWriteWait := writeWait
+	defer func() {
+		pongWait = prevPongWait
+		writeWait = prevWriteWait
+	}()
+	prevLimitUnit := sessionLimitUnit
+	prevLimitsCheckPeriod := sessionLimitsCheckPeriod
+	defer func() {
+		sessionLimitUnit = prevLimitUnit
+		sessionLimitsCheckPeriod = prevLimitsCheckPeriod
+	}()
+	pongWait = time.Second
+	writeWait = time.Second
+	sessionLimitUnit = 500 * time.Millisecond
+	sessionLimitsCheckPeriod = 50 * time.Millisecond
+
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		deviceID  = "1234567890"
+	)
+	id := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name string
+
+		Reconnect   bool
+		GoingAway   bool
+		IdleTimeout int
+
+		CloseReason string
+		StopBody    string
+	}{{
+		Name: "ok, user reconnects",
+
+		Reconnect: true,
+
+		CloseReason: model.SessionCloseReasonUserDisconnect,
+		StopBody:    "user disconnected",
+	}, {
+		Name: "ok, grace period expires",
+
+		CloseReason: model.SessionCloseReasonUserDisconnect,
+		StopBody:    "user disconnected",
+	}, {
+		Name: "ok, user navigates away",
+
+		GoingAway: true,
+
+		CloseReason: model.SessionCloseReasonUserDisconnect,
+		StopBody:    "user disconnected",
+	}, {
+		Name: "ok, session expires while suspended",
+
+		IdleTimeout: 1,
+
+		CloseReason: model.SessionCloseReasonIdleTimeout,
+		StopBody:    "session closed due to inactivity",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, Config{
+				SessionGracePeriod: 2 * time.Second,
+				SessionBufferSize:  1024,
+			})
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			app.On("PrepareUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				mock.MatchedBy(func(sess *model.Session) bool {
+					sess.ID = sessionID
+					sess.StartTS = time.Now()
+					sess.IdleTimeout = tc.IdleTimeout
+					return true
+				}),
+			).Return(nil)
+			freed := make(chan model.SessionEnd, 1)
+			app.On("FreeUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				mock.AnythingOfType("model.SessionEnd"),
+			).Run(func(args mock.Arguments) {
+				freed <- args.Get(2).(model.SessionEnd)
+			}).Return(nil).Once()
+			if tc.Reconnect {
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(&model.Session{
+					ID:       sessionID,
+					UserID:   id.Subject,
+					DeviceID: deviceID,
+					Status:   model.SessionStatusConnected,
+				}, nil)
+			}
+
+			deviceChan := make(chan *nats.Msg, 2)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(id.Tenant, deviceID), deviceChan,
+			)
+			defer sub.Unsubscribe()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				strings.Replace(
+					APIURLManagementDeviceConnect, ":deviceId", deviceID, 1,
+				)
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			if tc.GoingAway {
+				_ = conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(
+						websocket.CloseGoingAway, "",
+					),
+					time.Now().Add(writeWait),
+				)
+			} else {
+				// break the connection without the closing handshake
+				conn.UnderlyingConn().Close()
+			}
+
+			output, _ := msgpack.Marshal(ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   shell.MessageTypeShellCommand,
+					SessionID: sessionID,
+				},
+				Body: []byte("output"),
+			})
+			// wait for the session to be suspended
+			time.Sleep(100 * time.Millisecond)
+			err = natsClient.Publish(
+				model.GetSessionSubject(id.Tenant, sessionID), output,
+			)
+			assert.NoError(t, err)
+
+			if tc.Reconnect {
+				url := "ws" + strings.TrimPrefix(s.URL, "http") +
+					strings.Replace(
+						APIURLManagementReconnect, ":sessionId", sessionID, 1,
+					)
+				conn, _, err = websocket.DefaultDialer.Dial(url, headers)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, data, err := conn.ReadMessage()
+				if assert.NoError(t, err) {
+					assert.Equal(t, output, data)
+				}
+				select {
+				case <-deviceChan:
+					assert.Fail(t, "shell stopped on reconnect")
+				case <-freed:
+					assert.Fail(t, "session freed on reconnect")
+				default:
+				}
+				_ = conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(
+						websocket.CloseNormalClosure, "",
+					),
+					time.Now().Add(writeWait),
+				)
+			}
+
+			select {
+			case end := <-freed:
+				assert.Equal(t, tc.CloseReason, end.Reason)
+				if !tc.GoingAway {
+					assert.Equal(t,
+						int64(len(output)), end.BytesFromDevice,
+					)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for the session to be freed")
+			}
+			select {
+			case msg := <-deviceChan:
+				stop, isStop := parseStopMessage(msg.Data)
+				if assert.True(t, isStop) {
+					assert.Equal(t, tc.StopBody, stop.body)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for stop message")
+			}
+		})
+	}
+}
+
+func TestManagementReconnectFailures(t *testing.T) {
+	prevResumeTimeout := resumeTimeout
+	defer func() {
+		resumeTimeout = prevResumeTimeout
+	}()
+	resumeTimeout = 100 * time.Millisecond
+
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	id := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name string
+
+		GetSession    *model.Session
+		GetSessionErr error
+
+		HTTPStatus int
+	}{{
+		Name: "ko, session not suspended",
+
+		GetSession: &model.Session{
+			ID:       sessionID,
+			UserID:   id.Subject,
+			DeviceID: "1234567890",
+			Status:   model.SessionStatusConnected,
+		},
+
+		HTTPStatus: http.StatusConflict,
+	}, {
+		Name: "ko, session of another user",
+
+		GetSession: &model.Session{
+			ID:       sessionID,
+			UserID:   "00000000-0000-0000-0000-000000000002",
+			DeviceID: "1234567890",
+			Status:   model.SessionStatusConnected,
+		},
+
+		HTTPStatus: http.StatusForbidden,
+	}, {
+		Name: "ko, session closed",
+
+		GetSession: &model.Session{
+			ID:       sessionID,
+			UserID:   id.Subject,
+			DeviceID: "1234567890",
+			Status:   model.SessionStatusDisconnected,
+		},
+
+		HTTPStatus: http.StatusConflict,
+	}, {
+		Name: "ko, session not found",
+
+		GetSessionErr: app.ErrSessionNotFound,
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name: "ko, internal error",
+
+		GetSessionErr: errors.New("internal error"),
+
+		HTTPStatus: http.StatusInternalServerError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient)
+			app.On("GetSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(tc.GetSession, tc.GetSessionErr)
+
+			req, _ := http.NewRequest(http.MethodGet,
+				"http://localhost"+strings.Replace(
+					APIURLManagementReconnect, ":sessionId", sessionID, 1,
+				), nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+		})
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	buf := &outputBuffer{limit: 5}
+	buf.push([]byte("ab"))
+	buf.push([]byte("cd"))
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte("cd")}, buf.frames)
+	buf.push([]byte("ef"))
+	assert.Equal(t, [][]byte{[]byte("cd"), []byte("ef")}, buf.frames)
+	buf.push([]byte("ghijkl"))
+	assert.Empty(t, buf.frames)
+	assert.Equal(t, 0, buf.size)
+}
+
+func TestParseStopMessage(t *testing.T) {
+	stop, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Properties: map[string]interface{}{
+				PropertyTerminatedBy: "00000000-0000-0000-0000-000000000000",
+			},
+		},
+	})
+	res, isStop := parseStopMessage(stop)
+	if assert.True(t, isStop) {
+		assert.Equal(t,
+			"00000000-0000-0000-0000-000000000000",
+			res.terminatedBy,
+		)
+	}
+
+	deviceStop, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: "00000000-0000-0000-0000-000000000001",
+		},
+	})
+	res, isStop = parseStopMessage(deviceStop)
+	if assert.True(t, isStop) {
+		assert.Empty(t, res.terminatedBy)
+		assert.Empty(t, res.closeReason)
+	}
+
+	serverStop, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: "00000000-0000-0000-0000-000000000001",
+			Properties: map[string]interface{}{
+				PropertyCloseReason: model.SessionCloseReasonRecordingFailed,
+			},
+		},
+		Body: []byte("recording failed"),
+	})
+	res, isStop = parseStopMessage(serverStop)
+	if assert.True(t, isStop) {
+		assert.Equal(t,
+			model.SessionCloseReasonRecordingFailed,
+			res.closeReason,
+		)
+		assert.Equal(t, "recording failed", res.body)
+	}
+
+	_, isStop = parseStopMessage([]byte("garbage"))
+	assert.False(t, isStop)
+}
+
+func TestSessionTrackerSessionEnd(t *testing.T) {
+	tracker := &sessionTracker{}
+	assert.Equal(t, model.SessionEnd{
+		Reason: model.SessionCloseReasonUserDisconnect,
+	}, tracker.sessionEnd())
+
+	tracker.addBytesToDevice(10)
+	tracker.addBytesFromDevice(20)
+	tracker.setCloseReason(model.SessionCloseReasonTerminated)
+	tracker.setCloseReason(model.SessionCloseReasonTimeout)
+	assert.Equal(t, model.SessionEnd{
+		Reason:          model.SessionCloseReasonTerminated,
+		BytesToDevice:   10,
+		BytesFromDevice: 20,
+	}, tracker.sessionEnd())
+}
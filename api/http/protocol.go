@@ -0,0 +1,252 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+)
+
+// Protocol validation modes of the messages read from the websockets
+const (
+	// ProtocolValidationOff forwards every message as is
+	ProtocolValidationOff = "off"
+	// ProtocolValidationLenient drops the invalid messages and closes the
+	// connection after MaxProtocolViolations of them
+	ProtocolValidationLenient = "lenient"
+	// ProtocolValidationStrict closes the connection on the first invalid
+	// message
+	ProtocolValidationStrict = "strict"
+)
+
+// Shell message types sent by the newer clients, not yet defined by the
+// shell package.
+const (
+	MessageTypeResizeShell = "resize"
+	MessageTypePingShell   = "ping"
+	MessageTypePongShell   = "pong"
+)
+
+// Kinds of protocol violations, the violations of a connection are counted
+// by kind.
+const (
+	violationUnknownProto    = "unknown_protocol"
+	violationUnknownMsgType  = "unknown_message_type"
+	violationMissingSession  = "missing_session_id"
+	violationInvalidProperty = "invalid_property"
+	violationForeignSession  = "foreign_session"
+	violationInvalidBody     = "invalid_body"
+)
+
+var (
+	// knownMessageTypes are the message types allowed for each protocol
+	// known to the service
+	knownMessageTypes = map[ws.ProtoType]map[string]bool{
+		ws.ProtoTypeShell: {
+			shell.MessageTypeShellCommand: true,
+			shell.MessageTypeSpawnShell:   true,
+			shell.MessageTypeStopShell:    true,
+			MessageTypeResizeShell:        true,
+			MessageTypePingShell:          true,
+			MessageTypePongShell:          true,
+		},
+	}
+
+	// controlMessageTypes are the control messages sent by the devices
+	controlMessageTypes = map[string]bool{
+		MessageTypeHello: true,
+	}
+
+	// integerProperties and stringProperties are the known properties of
+	// the messages with their expected type.
+	integerProperties = []string{
+		"status",
+		PropertyTerminalWidth,
+		PropertyTerminalHeight,
+	}
+	stringProperties = []string{
+		PropertyUserID,
+		PropertyTerminatedBy,
+		PropertyCloseReason,
+	}
+)
+
+// validProtocolValidation returns true if mode is a known validation mode;
+// the empty mode stands for the default lenient mode.
+func validProtocolValidation(mode string) bool {
+	switch mode {
+	case "", ProtocolValidationOff,
+		ProtocolValidationLenient,
+		ProtocolValidationStrict:
+		return true
+	}
+	return false
+}
+
+// protocolViolation describes why a message violates the protocol
+type protocolViolation struct {
+	kind   string
+	reason string
+}
+
+func (v *protocolViolation) Error() string {
+	return v.reason
+}
+
+// validateProtoHdr checks the header of a message read from a websocket:
+// the message type must be known for the protocols known to the service and
+// the properties must have the expected types. The message types of the
+// other protocols, such as the ones advertised by the newer devices, are
+// relayed as they are. The messages of the devices must carry the session
+// ID, except the control messages which only devices may send.
+func validateProtoHdr(hdr *ws.ProtoHdr, device bool) error {
+	if hdr.Proto == ProtoTypeControl {
+		if !device {
+			return &protocolViolation{
+				kind: violationUnknownProto,
+				reason: fmt.Sprintf(
+					"unknown protocol 0x%04x", uint16(hdr.Proto),
+				),
+			}
+		} else if !controlMessageTypes[hdr.MsgType] {
+			return &protocolViolation{
+				kind: violationUnknownMsgType,
+				reason: fmt.Sprintf(
+					"unknown control message type %q", hdr.MsgType,
+				),
+			}
+		}
+		return nil
+	}
+	msgTypes, ok := knownMessageTypes[hdr.Proto]
+	if ok && !msgTypes[hdr.MsgType] {
+		return &protocolViolation{
+			kind: violationUnknownMsgType,
+			reason: fmt.Sprintf(
+				"unknown message type %q for protocol 0x%04x",
+				hdr.MsgType, uint16(hdr.Proto),
+			),
+		}
+	}
+	if device && hdr.SessionID == "" {
+		return &protocolViolation{
+			kind:   violationMissingSession,
+			reason: "message missing required session ID",
+		}
+	}
+	for _, key := range integerProperties {
+		if _, found := hdr.Properties[key]; !found {
+			continue
+		}
+		if _, ok := propertyInt(hdr.Properties, key); !ok {
+			return &protocolViolation{
+				kind:   violationInvalidProperty,
+				reason: fmt.Sprintf("property %q is not an integer", key),
+			}
+		}
+	}
+	for _, key := range stringProperties {
+		value, found := hdr.Properties[key]
+		if !found {
+			continue
+		}
+		if _, ok := value.(string); !ok {
+			return &protocolViolation{
+				kind:   violationInvalidProperty,
+				reason: fmt.Sprintf("property %q is not a string", key),
+			}
+		}
+	}
+	return nil
+}
+
+// protocolValidator validates the messages read from a websocket and counts
+// the protocol violations of the connection.
+type protocolValidator struct {
+	mode          string
+	maxViolations int
+	// device is set if the peer is a device
+	device bool
+
+	violations int
+	counts     map[string]int
+}
+
+func newProtocolValidator(config Config, device bool) *protocolValidator {
+	return &protocolValidator{
+		mode:          config.ProtocolValidation,
+		maxViolations: config.MaxProtocolViolations,
+		device:        device,
+		counts:        make(map[string]int),
+	}
+}
+
+// validate returns true if the message can be forwarded; the returned error
+// is set if the connection must be closed because of the violation.
+func (v *protocolValidator) validate(
+	ctx context.Context,
+	hdr *ws.ProtoHdr,
+) (bool, error) {
+	if v.mode == ProtocolValidationOff {
+		return true, nil
+	}
+	err := validateProtoHdr(hdr, v.device)
+	if err == nil {
+		return true, nil
+	}
+	return false, v.violate(ctx, err.(*protocolViolation))
+}
+
+// violate counts a message violating the protocol, which is dropped; the
+// returned error is set if the connection must be closed because of it.
+// Nothing is counted when the validation is off.
+func (v *protocolValidator) violate(
+	ctx context.Context,
+	violation *protocolViolation,
+) error {
+	if v.mode == ProtocolValidationOff {
+		return nil
+	}
+	v.violations++
+	v.counts[violation.kind]++
+	if v.mode == ProtocolValidationStrict {
+		return newProtocolError(violation.reason)
+	}
+	log.FromContext(ctx).Warnf(
+		"dropping message violating the protocol (%d so far): %s",
+		v.violations, violation.reason,
+	)
+	if v.maxViolations > 0 && v.violations >= v.maxViolations {
+		return newProtocolError(fmt.Sprintf(
+			"too many violations, the last one: %s", violation.reason,
+		))
+	}
+	return nil
+}
+
+// logSummary logs the protocol violations of the connection, if any
+func (v *protocolValidator) logSummary(ctx context.Context) {
+	if v.violations == 0 {
+		return
+	}
+	log.FromContext(ctx).Warnf(
+		"connection closed after %d protocol violations: %v",
+		v.violations, v.counts,
+	)
+}
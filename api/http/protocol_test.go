@@ -0,0 +1,349 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vmihailenco/msgpack/v5"
+
+	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+)
+
+func TestValidateProtoHdr(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Header ws.ProtoHdr
+		Device bool
+
+		Kind string
+	}{
+		{
+			Name: "ok",
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   shell.MessageTypeShellCommand,
+				SessionID: "session",
+				Properties: map[string]interface{}{
+					"status":               int8(shell.NormalMessage),
+					PropertyTerminalWidth:  uint16(120),
+					PropertyTerminalHeight: uint8(40),
+					PropertyUserID:         "user",
+				},
+			},
+			Device: true,
+		},
+		{
+			Name: "ok, session ID not required",
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: MessageTypeResizeShell,
+			},
+		},
+		{
+			Name: "ok, protocol unknown to the service",
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoType(0x1234),
+				MsgType:   "put_file",
+				SessionID: "session",
+			},
+			Device: true,
+		},
+		{
+			Name: "error, session ID of a protocol unknown to the service",
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoType(0x1234),
+				MsgType: "put_file",
+			},
+			Device: true,
+
+			Kind: violationMissingSession,
+		},
+		{
+			Name: "error, control message of a user",
+			Header: ws.ProtoHdr{
+				Proto:   ProtoTypeControl,
+				MsgType: MessageTypeHello,
+			},
+
+			Kind: violationUnknownProto,
+		},
+		{
+			Name: "error, unknown message type",
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   "hello",
+				SessionID: "session",
+			},
+			Device: true,
+
+			Kind: violationUnknownMsgType,
+		},
+		{
+			Name: "error, missing session ID",
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeStopShell,
+			},
+			Device: true,
+
+			Kind: violationMissingSession,
+		},
+		{
+			Name: "error, integer property",
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: MessageTypeResizeShell,
+				Properties: map[string]interface{}{
+					PropertyTerminalWidth: "120",
+				},
+			},
+
+			Kind: violationInvalidProperty,
+		},
+		{
+			Name: "error, string property",
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeStopShell,
+				Properties: map[string]interface{}{
+					PropertyCloseReason: 1,
+				},
+			},
+
+			Kind: violationInvalidProperty,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := validateProtoHdr(&tc.Header, tc.Device)
+			if tc.Kind != "" {
+				if assert.IsType(t, &protocolViolation{}, err) {
+					assert.Equal(t, tc.Kind, err.(*protocolViolation).kind)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProtocolValidator(t *testing.T) {
+	valid := &ws.ProtoHdr{
+		Proto:   ws.ProtoTypeShell,
+		MsgType: shell.MessageTypeShellCommand,
+	}
+	invalid := &ws.ProtoHdr{
+		Proto:   ws.ProtoTypeShell,
+		MsgType: "hello",
+	}
+	testCases := []struct {
+		Name   string
+		Config Config
+
+		// Results is the expected outcome of validating invalid
+		// messages until the connection is closed
+		Results []bool
+	}{
+		{
+			Name:    "off",
+			Config:  Config{ProtocolValidation: ProtocolValidationOff},
+			Results: []bool{true, true, true},
+		},
+		{
+			Name:    "strict",
+			Config:  Config{ProtocolValidation: ProtocolValidationStrict},
+			Results: []bool{false},
+		},
+		{
+			Name: "lenient",
+			Config: Config{
+				ProtocolValidation:    ProtocolValidationLenient,
+				MaxProtocolViolations: 3,
+			},
+			Results: []bool{false, false, false},
+		},
+		{
+			Name:    "lenient, never closed",
+			Config:  Config{},
+			Results: []bool{false, false, false, false},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			validator := newProtocolValidator(tc.Config, false)
+			for i, result := range tc.Results {
+				ok, err := validator.validate(ctx, valid)
+				assert.True(t, ok)
+				assert.NoError(t, err)
+
+				ok, err = validator.validate(ctx, invalid)
+				assert.Equal(t, result, ok)
+				closed := tc.Config.MaxProtocolViolations == i+1 ||
+					tc.Config.ProtocolValidation == ProtocolValidationStrict
+				if closed {
+					assert.IsType(t, &protocolError{}, err)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+			if tc.Config.ProtocolValidation != ProtocolValidationOff {
+				assert.Equal(t, len(tc.Results), validator.violations)
+				assert.Equal(t, len(tc.Results),
+					validator.counts[violationUnknownMsgType])
+			} else {
+				// the violations found past the header are not
+				// counted either
+				err := validator.violate(ctx, &protocolViolation{
+					kind:   violationForeignSession,
+					reason: "foreign session",
+				})
+				assert.NoError(t, err)
+				assert.Equal(t, 0, validator.violations)
+			}
+			validator.logSummary(ctx)
+		})
+	}
+}
+
+func TestDeviceConnectProtocolViolation(t *testing.T) {
+	id := identity.Identity{
+		Subject:  "00000000-0000-0000-0000-000000000000",
+		Tenant:   "000000000000000000000000",
+		IsDevice: true,
+	}
+	testCases := []struct {
+		Name   string
+		Config Config
+
+		Messages int
+	}{
+		{
+			Name:     "strict",
+			Config:   Config{ProtocolValidation: ProtocolValidationStrict},
+			Messages: 1,
+		},
+		{
+			Name:     "lenient",
+			Config:   Config{MaxProtocolViolations: 2},
+			Messages: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			app.On("ConnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(int64(1), nil)
+			disconnected := make(chan struct{})
+			app.On("DisconnectDevice",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+				int64(1),
+			).Run(func(mock.Arguments) {
+				close(disconnected)
+			}).Return(nil)
+			app.On("UpdateDeviceLastSeen",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				id.Subject,
+			).Return(nil).Maybe()
+			app.On("RecordConnectionEvent",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				id.Tenant,
+				mock.AnythingOfType("*model.ConnectionEvent"),
+			).Return(nil)
+
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, tc.Config)
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http") +
+				APIURLDevicesConnect
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			msg, _ := msgpack.Marshal(ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ws.ProtoTypeShell,
+					MsgType: shell.MessageTypeShellCommand,
+				},
+			})
+			for i := 0; i < tc.Messages; i++ {
+				err = conn.WriteMessage(websocket.BinaryMessage, msg)
+				assert.NoError(t, err)
+			}
+
+			err = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+			assert.NoError(t, err)
+			_, data, err := conn.ReadMessage()
+			if assert.NoError(t, err) {
+				assertErrorMessage(t, data, CloseProtocolViolation)
+			}
+			_, _, err = conn.ReadMessage()
+			assert.True(t,
+				websocket.IsCloseError(err, CloseProtocolViolation),
+				"unexpected error: %v", err)
+
+			select {
+			case <-disconnected:
+			case <-time.After(time.Second * 2):
+				assert.Fail(t, "the connection did not terminate")
+			}
+			// wait for the connection events to be recorded
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+}
+
+func TestNewRouterProtocolValidation(t *testing.T) {
+	_, err := NewRouter(nil, nil, Config{ProtocolValidation: "paranoid"})
+	assert.EqualError(t, err, `invalid protocol validation mode: "paranoid"`)
+
+	_, err = NewRouter(nil, nil, Config{
+		ProtocolValidation: ProtocolValidationStrict,
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+)
+
+// publishRecordingFailure notifies the user that the session could not be
+// recorded. If recording is fail-closed, the shell is also stopped on the
+// device and the websocket of the user is closed.
+func publishRecordingFailure(
+	nc *nats.Conn,
+	tenantID string,
+	sess *model.Session,
+	failClosed bool,
+) error {
+	if !failClosed {
+		msg := ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   shell.MessageTypeShellCommand,
+				SessionID: sess.ID,
+				Properties: map[string]interface{}{
+					"status": shell.ControlMessage,
+				},
+			},
+			Body: []byte("warning: failed to record the session"),
+		}
+		data, _ := msgpack.Marshal(msg)
+		return nc.Publish(model.GetSessionSubject(tenantID, sess.ID), data)
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: sess.ID,
+			Properties: map[string]interface{}{
+				"status":            shell.ErrorMessage,
+				PropertyUserID:      sess.UserID,
+				PropertyCloseReason: model.SessionCloseReasonRecordingFailed,
+			},
+		},
+		Body: []byte("session stopped: failed to record the session"),
+	}
+	data, _ := msgpack.Marshal(msg)
+	for _, subject := range []string{
+		model.GetDeviceSubject(tenantID, sess.DeviceID),
+		model.GetSessionSubject(tenantID, sess.ID),
+	} {
+		if err := nc.Publish(subject, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Default terminal size used if the recording does not contain the size
+const (
+	asciicastDefaultWidth  = 80
+	asciicastDefaultHeight = 24
+)
+
+// asciicastHeader is the header line of an asciicast v2 file
+type asciicastHeader struct {
+	Version   int   `json:"version"`
+	Width     int   `json:"width"`
+	Height    int   `json:"height"`
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// writeAsciicast writes the recorded frames as an asciicast v2 file: the
+// terminal size is taken from the properties of the message spawning the
+// shell and the shell output is written as "o" events.
+func writeAsciicast(w io.Writer, frames []model.RecordingFrame) error {
+	header := asciicastHeader{
+		Version: 2,
+		Width:   asciicastDefaultWidth,
+		Height:  asciicastDefaultHeight,
+	}
+	msgs := make([]ws.ProtoMsg, len(frames))
+	for i, frame := range frames {
+		if err := msgpack.Unmarshal(frame.Data, &msgs[i]); err != nil {
+			continue
+		}
+		if frame.Direction == model.RecordingDirectionInput &&
+			msgs[i].Header.MsgType == shell.MessageTypeSpawnShell {
+			props := msgs[i].Header.Properties
+			if width, ok := propertyInt(props, PropertyTerminalWidth); ok {
+				header.Width = width
+			}
+			if height, ok := propertyInt(props, PropertyTerminalHeight); ok {
+				header.Height = height
+			}
+		}
+	}
+	if len(frames) > 0 {
+		header.Timestamp = frames[0].Timestamp.Unix()
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for i, frame := range frames {
+		msg := msgs[i]
+		if frame.Direction != model.RecordingDirectionOutput ||
+			msg.Header.Proto != ws.ProtoTypeShell ||
+			msg.Header.MsgType != shell.MessageTypeShellCommand {
+			continue
+		}
+		event := []interface{}{
+			frame.Timestamp.Sub(frames[0].Timestamp).Seconds(),
+			"o",
+			string(msg.Body),
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// propertyInt returns the integer value of a ProtoMsg property; msgpack
+// decodes integers into the smallest fitting type.
+func propertyInt(props map[string]interface{}, key string) (int, bool) {
+	switch value := props[key].(type) {
+	case int8:
+		return int(value), true
+	case int16:
+		return int(value), true
+	case int32:
+		return int(value), true
+	case int64:
+		return int(value), true
+	case int:
+		return value, true
+	case uint8:
+		return int(value), true
+	case uint16:
+		return int(value), true
+	case uint32:
+		return int(value), true
+	case uint64:
+		return int(value), true
+	case uint:
+		return int(value), true
+	case float32:
+		return int(value), true
+	case float64:
+		return int(value), true
+	}
+	return 0, false
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+)
+
+func TestPublishRecordingFailure(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+	}
+	testCases := []struct {
+		Name       string
+		FailClosed bool
+
+		SessionMsgType string
+		DeviceMsg      bool
+	}{{
+		Name: "fail-open",
+
+		SessionMsgType: shell.MessageTypeShellCommand,
+	}, {
+		Name:       "fail-closed",
+		FailClosed: true,
+
+		SessionMsgType: shell.MessageTypeStopShell,
+		DeviceMsg:      true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			natsClient := NewNATSTestClient(t)
+			sessChan := make(chan *nats.Msg, 1)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetSessionSubject(tenantID, sess.ID), sessChan,
+			)
+			defer sub.Unsubscribe()
+			devChan := make(chan *nats.Msg, 1)
+			sub, _ = natsClient.ChanSubscribe(
+				model.GetDeviceSubject(tenantID, sess.DeviceID), devChan,
+			)
+			defer sub.Unsubscribe()
+
+			err := publishRecordingFailure(
+				natsClient, tenantID, sess, tc.FailClosed,
+			)
+			assert.NoError(t, err)
+
+			select {
+			case natsMsg := <-sessChan:
+				var msg ws.ProtoMsg
+				err := msgpack.Unmarshal(natsMsg.Data, &msg)
+				if assert.NoError(t, err) {
+					assert.Equal(t, tc.SessionMsgType, msg.Header.MsgType)
+					assert.Equal(t, sess.ID, msg.Header.SessionID)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for session message")
+			}
+
+			select {
+			case natsMsg := <-devChan:
+				if !tc.DeviceMsg {
+					assert.Fail(t, "unexpected message to the device")
+					break
+				}
+				stop, isStop := parseStopMessage(natsMsg.Data)
+				if assert.True(t, isStop) {
+					assert.Equal(t,
+						model.SessionCloseReasonRecordingFailed,
+						stop.closeReason,
+					)
+				}
+			case <-time.After(time.Millisecond * 100):
+				if tc.DeviceMsg {
+					assert.Fail(t, "timeout waiting for device message")
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAsciicast(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := func(
+		offset time.Duration,
+		direction, msgType, body string,
+		props map[string]interface{},
+	) model.RecordingFrame {
+		data, _ := msgpack.Marshal(ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeShell,
+				MsgType:    msgType,
+				SessionID:  "00000000-0000-0000-0000-000000000000",
+				Properties: props,
+			},
+			Body: []byte(body),
+		})
+		return model.RecordingFrame{
+			Timestamp: start.Add(offset),
+			Direction: direction,
+			Data:      data,
+		}
+	}
+
+	testCases := []struct {
+		Name   string
+		Frames []model.RecordingFrame
+		Output string
+	}{{
+		Name: "ok",
+		Frames: []model.RecordingFrame{
+			frame(0, model.RecordingDirectionInput,
+				shell.MessageTypeSpawnShell, "",
+				map[string]interface{}{
+					PropertyTerminalWidth:  120,
+					PropertyTerminalHeight: 40,
+				},
+			),
+			frame(500*time.Millisecond, model.RecordingDirectionInput,
+				shell.MessageTypeShellCommand, "ls\n", nil,
+			),
+			frame(1500*time.Millisecond, model.RecordingDirectionOutput,
+				shell.MessageTypeShellCommand, "foo\r\n", nil,
+			),
+			frame(2*time.Second, model.RecordingDirectionOutput,
+				shell.MessageTypeStopShell, "", nil,
+			),
+		},
+		Output: `{"version":2,"width":120,"height":40,"timestamp":1609459200}
+[1.5,"o","foo\r\n"]
+`,
+	}, {
+		Name:   "ok, empty recording",
+		Output: `{"version":2,"width":80,"height":24}` + "\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeAsciicast(&buf, tc.Frames)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Output, buf.String())
+		})
+	}
+}
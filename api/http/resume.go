@@ -0,0 +1,190 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+)
+
+var (
+	// ErrSessionNotSuspended is returned when reconnecting to a session
+	// that is not waiting for the user to reconnect.
+	ErrSessionNotSuspended = errors.New(
+		"session is not waiting for a reconnection",
+	)
+)
+
+// resumeTimeout is the time to wait for the handler holding a suspended
+// session to hand it over.
+var resumeTimeout = time.Second * 2
+
+// resumeRequest is published on the resume subject of a session to take
+// over a suspended session.
+type resumeRequest struct {
+	UserID string `msgpack:"user_id"`
+}
+
+// resumeResponse is the reply to a resumeRequest: it contains the output
+// buffered while the session was suspended and the byte counts so far.
+type resumeResponse struct {
+	Frames          [][]byte `msgpack:"frames"`
+	BytesToDevice   int64    `msgpack:"bytes_to_device"`
+	BytesFromDevice int64    `msgpack:"bytes_from_device"`
+}
+
+// outputBuffer keeps the most recent messages up to limit bytes
+type outputBuffer struct {
+	limit  int
+	size   int
+	frames [][]byte
+}
+
+func (b *outputBuffer) push(data []byte) {
+	b.frames = append(b.frames, data)
+	b.size += len(data)
+	for b.size > b.limit && len(b.frames) > 0 {
+		b.size -= len(b.frames[0])
+		b.frames = b.frames[1:]
+	}
+}
+
+// suspendSession keeps the shell on the device alive for the grace period
+// after the websocket of the user broke, buffering the output until the user
+// reconnects; the idle timeout and the maximum duration of the session keep
+// running meanwhile. It returns true if the session was handed over to a new
+// connection, expired or was stopped by the device, in which case the shell
+// must not be stopped.
+func (h ManagementController) suspendSession(
+	ctx context.Context,
+	sess *model.Session,
+	deviceChan <-chan *nats.Msg,
+	tracker *sessionTracker,
+) bool {
+	l := log.FromContext(ctx)
+	id := identity.FromContext(ctx)
+
+	resumeChan := make(chan *nats.Msg, 1)
+	sub, err := h.nats.ChanSubscribe(sess.ResumeSubject(id.Tenant), resumeChan)
+	if err != nil {
+		l.Errorf("failed to suspend session %s: %s", sess.ID, err.Error())
+		return false
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	l.Infof("session %s suspended, waiting for the user to reconnect", sess.ID)
+	buf := &outputBuffer{limit: h.config.SessionBufferSize}
+	timer := time.NewTimer(h.config.SessionGracePeriod)
+	defer timer.Stop()
+	var limitsC <-chan time.Time
+	limits := newSessionLimits(sess)
+	if limits.enabled() {
+		limitsTicker := time.NewTicker(sessionLimitsCheckPeriod)
+		defer limitsTicker.Stop()
+		limitsC = limitsTicker.C
+	}
+	for {
+		select {
+		case msg := <-deviceChan:
+			tracker.addBytesFromDevice(len(msg.Data))
+			if stop, isStop := parseStopMessage(msg.Data); isStop {
+				switch {
+				case stop.terminatedBy != "":
+					tracker.setCloseReason(
+						model.SessionCloseReasonTerminated,
+					)
+				case stop.closeReason != "":
+					tracker.setCloseReason(stop.closeReason)
+				default:
+					tracker.setCloseReason(
+						model.SessionCloseReasonDeviceDisconnect,
+					)
+				}
+				return true
+			}
+			buf.push(msg.Data)
+
+		case msg := <-resumeChan:
+			var req resumeRequest
+			err := msgpack.Unmarshal(msg.Data, &req)
+			if err != nil || req.UserID != sess.UserID {
+				l.Warnf("rejected request to resume session %s", sess.ID)
+				continue
+			}
+			end := tracker.sessionEnd()
+			data, _ := msgpack.Marshal(resumeResponse{
+				Frames:          buf.frames,
+				BytesToDevice:   end.BytesToDevice,
+				BytesFromDevice: end.BytesFromDevice,
+			})
+			if err := msg.Respond(data); err != nil {
+				l.Errorf("failed to resume session %s: %s",
+					sess.ID, err.Error())
+				continue
+			}
+			tracker.setResumed()
+			l.Infof("session %s resumed", sess.ID)
+			return true
+
+		case now := <-limitsC:
+			deadline, reason := limits.deadline(tracker.lastInputTime())
+			if now.Before(deadline) {
+				continue
+			}
+			l.Infof("suspended session %s expired: %s", sess.ID, reason)
+			tracker.setCloseReason(reason)
+			tracker.setStopped()
+			h.stopDeviceShell(ctx, sess, reason, sessionExpiryText(reason))
+			return true
+
+		case <-timer.C:
+			l.Infof("session %s expired waiting for the user to reconnect",
+				sess.ID)
+			return false
+		}
+	}
+}
+
+// resumeSession requests the handler holding the suspended session to hand
+// it over to the caller.
+func (h ManagementController) resumeSession(
+	ctx context.Context,
+	sess *model.Session,
+) (*resumeResponse, error) {
+	id := identity.FromContext(ctx)
+	data, _ := msgpack.Marshal(resumeRequest{UserID: sess.UserID})
+	msg, err := h.nats.Request(
+		sess.ResumeSubject(id.Tenant), data, resumeTimeout,
+	)
+	if err == nats.ErrTimeout {
+		return nil, ErrSessionNotSuspended
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to resume session")
+	}
+	res := &resumeResponse{}
+	if err := msgpack.Unmarshal(msg.Data, res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode resumed session")
+	}
+	return res, nil
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
 
 	"github.com/mendersoftware/deviceconnect/app"
 	"github.com/mendersoftware/go-lib-micro/accesslog"
@@ -39,18 +40,100 @@ const (
 	APIURLInternalAlive     = APIURLInternal + "/alive"
 	APIURLInternalHealth    = APIURLInternal + "/health"
 	APIURLInternalTenants   = APIURLInternal + "/tenants"
+	APIURLInternalLimits    = APIURLInternal + "/tenants/:tenantId/limits"
 	APIURLInternalDevices   = APIURLInternal + "/tenants/:tenantId/devices"
 	APIURLInternalDevicesID = APIURLInternal + "/tenants/:tenantId/devices/:deviceId"
 
-	APIURLManagementDevice        = APIURLManagement + "/devices/:deviceId"
-	APIURLManagementDeviceConnect = APIURLManagement + "/devices/:deviceId/connect"
+	APIURLManagementDevices        = APIURLManagement + "/devices"
+	APIURLManagementDevicesSearch  = APIURLManagement + "/devices/search"
+	APIURLManagementDevice         = APIURLManagement + "/devices/:deviceId"
+	APIURLManagementDeviceConnect  = APIURLManagement + "/devices/:deviceId/connect"
+	APIURLManagementDeviceSessions = APIURLManagement + "/devices/:deviceId/sessions"
+	APIURLManagementDeviceHistory  = APIURLManagement + "/devices/:deviceId/sessions/history"
+	APIURLManagementDeviceConns    = APIURLManagement + "/devices/:deviceId/connections"
+	APIURLManagementSessions       = APIURLManagement + "/sessions"
+	APIURLManagementSessionsID     = APIURLManagement + "/sessions/:sessionId"
+	APIURLManagementPlayback       = APIURLManagement + "/sessions/:sessionId/playback"
+	APIURLManagementRecording      = APIURLManagement + "/sessions/:sessionId/recording"
+	APIURLManagementObserve        = APIURLManagement + "/sessions/:sessionId/observe"
+	APIURLManagementReconnect      = APIURLManagement + "/sessions/:sessionId/reconnect"
+	APIURLManagementSettings       = APIURLManagement + "/settings"
+	APIURLManagementWebhooks       = APIURLManagement + "/webhooks"
+	APIURLManagementWebhook        = APIURLManagement + "/webhooks/:webhookId"
+	APIURLManagementWebhookLog     = APIURLManagement + "/webhooks/:webhookId/deliveries"
 )
 
+// Config holds the configuration of the HTTP handlers
+type Config struct {
+	// RecordingFailClosed stops recorded sessions when the recording fails,
+	// otherwise the user is only warned and the session goes on.
+	RecordingFailClosed bool
+	// SessionGracePeriod is the time a session is kept alive on the device
+	// after the websocket of the user broke, waiting for the user to
+	// reconnect; zero disables resuming sessions.
+	SessionGracePeriod time.Duration
+	// SessionBufferSize is the maximum number of bytes of output buffered
+	// while a session waits for the user to reconnect.
+	SessionBufferSize int
+	// DeviceLastSeenInterval is the minimum interval between updates of
+	// the last seen time of a connected device; zero updates it every
+	// time the device is heard from.
+	DeviceLastSeenInterval time.Duration
+	// DevicePresenceLease is the validity of the presence lease of the
+	// connected devices, renewed every third of it while the websocket
+	// lives; zero disables the lease.
+	DevicePresenceLease time.Duration
+	// MaxMessageSize is the maximum size in bytes of the messages read
+	// from the websockets; zero means unlimited.
+	MaxMessageSize int64
+	// ProtocolValidation is the validation mode of the messages read from
+	// the websockets: off, lenient or strict; defaults to lenient.
+	ProtocolValidation string
+	// MaxProtocolViolations is the number of invalid messages after which
+	// a connection is closed in lenient mode; zero never closes it.
+	MaxProtocolViolations int
+}
+
 // NewRouter returns the gin router
 func NewRouter(
 	app app.App,
 	natsClient *nats.Conn,
+	config ...Config,
 ) (*gin.Engine, error) {
+	conf := Config{}
+	for _, cfgIn := range config {
+		if cfgIn.RecordingFailClosed {
+			conf.RecordingFailClosed = true
+		}
+		if cfgIn.SessionGracePeriod > 0 {
+			conf.SessionGracePeriod = cfgIn.SessionGracePeriod
+		}
+		if cfgIn.SessionBufferSize > 0 {
+			conf.SessionBufferSize = cfgIn.SessionBufferSize
+		}
+		if cfgIn.DeviceLastSeenInterval > 0 {
+			conf.DeviceLastSeenInterval = cfgIn.DeviceLastSeenInterval
+		}
+		if cfgIn.DevicePresenceLease > 0 {
+			conf.DevicePresenceLease = cfgIn.DevicePresenceLease
+		}
+		if cfgIn.MaxMessageSize > 0 {
+			conf.MaxMessageSize = cfgIn.MaxMessageSize
+		}
+		if cfgIn.ProtocolValidation != "" {
+			conf.ProtocolValidation = cfgIn.ProtocolValidation
+		}
+		if cfgIn.MaxProtocolViolations > 0 {
+			conf.MaxProtocolViolations = cfgIn.MaxProtocolViolations
+		}
+	}
+	if !validProtocolValidation(conf.ProtocolValidation) {
+		return nil, errors.Errorf(
+			"invalid protocol validation mode: %q",
+			conf.ProtocolValidation,
+		)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 
@@ -86,6 +169,7 @@ func NewRouter(
 		ExposeHeaders: []string{
 			"Location",
 			"Link",
+			hdrTotalCount,
 		},
 		MaxAge: time.Hour * 12,
 	}))
@@ -96,15 +180,35 @@ func NewRouter(
 
 	tenants := NewTenantsController(app)
 	router.POST(APIURLInternalTenants, tenants.Provision)
+	router.GET(APIURLInternalLimits, tenants.GetSessionLimits)
+	router.PUT(APIURLInternalLimits, tenants.UpdateSessionLimits)
 
-	device := NewDeviceController(app, natsClient)
+	device := NewDeviceController(app, natsClient, conf)
 	router.GET(APIURLDevicesConnect, device.Connect)
+	router.GET(APIURLInternalDevices, device.List)
 	router.POST(APIURLInternalDevices, device.Provision)
 	router.DELETE(APIURLInternalDevicesID, device.Delete)
 
-	management := NewManagementController(app, natsClient)
+	management := NewManagementController(app, natsClient, conf)
+	router.GET(APIURLManagementDevices, management.ListDevices)
+	router.POST(APIURLManagementDevicesSearch, management.SearchDevices)
 	router.GET(APIURLManagementDevice, management.GetDevice)
 	router.GET(APIURLManagementDeviceConnect, management.Connect)
+	router.GET(APIURLManagementDeviceSessions, management.GetDeviceSessions)
+	router.GET(APIURLManagementDeviceHistory, management.GetDeviceSessionsHistory)
+	router.GET(APIURLManagementDeviceConns, management.GetDeviceConnections)
+	router.GET(APIURLManagementSessions, management.ListSessions)
+	router.DELETE(APIURLManagementSessionsID, management.TerminateSession)
+	router.GET(APIURLManagementPlayback, management.Playback)
+	router.GET(APIURLManagementRecording, management.GetRecording)
+	router.GET(APIURLManagementObserve, management.Observe)
+	router.GET(APIURLManagementReconnect, management.Reconnect)
+	router.GET(APIURLManagementSettings, management.GetSettings)
+	router.PUT(APIURLManagementSettings, management.UpdateSettings)
+	router.GET(APIURLManagementWebhooks, management.ListWebhooks)
+	router.POST(APIURLManagementWebhooks, management.CreateWebhook)
+	router.DELETE(APIURLManagementWebhook, management.DeleteWebhook)
+	router.GET(APIURLManagementWebhookLog, management.GetWebhookDeliveries)
 
 	return router, nil
 }
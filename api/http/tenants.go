@@ -67,3 +67,52 @@ func (h TenantsController) Provision(c *gin.Context) {
 
 	c.Writer.WriteHeader(http.StatusCreated)
 }
+
+// GetSessionLimits responds to GET /tenants/:tenantId/limits
+func (h TenantsController) GetSessionLimits(c *gin.Context) {
+	ctx := c.Request.Context()
+	limits, err := h.app.GetSessionLimits(ctx, c.Param("tenantId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errors.Wrap(err, "error retrieving the session limits").Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, limits)
+}
+
+// UpdateSessionLimits responds to PUT /tenants/:tenantId/limits
+func (h TenantsController) UpdateSessionLimits(c *gin.Context) {
+	rawData, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	limits := &model.SessionLimits{}
+	if err = json.Unmarshal(rawData, limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	} else if err = limits.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.app.UpdateSessionLimits(ctx, c.Param("tenantId"), limits)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errors.Wrap(err, "error updating the session limits").Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
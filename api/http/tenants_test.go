@@ -97,3 +97,122 @@ func TestProvision(t *testing.T) {
 		})
 	}
 }
+
+func TestGetSessionLimits(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		Limits    *model.SessionLimits
+		LimitsErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name:       "ok",
+			Limits:     &model.SessionLimits{MaxPerDevice: 5},
+			HTTPStatus: http.StatusOK,
+		},
+		{
+			Name:       "ko, error",
+			LimitsErr:  errors.New("error"),
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			deviceConnectApp := &app_mocks.App{}
+			defer deviceConnectApp.AssertExpectations(t)
+			deviceConnectApp.On("GetSessionLimits",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				"1234",
+			).Return(tc.Limits, tc.LimitsErr)
+
+			router, _ := NewRouter(deviceConnectApp, nil)
+
+			req, _ := http.NewRequest("GET",
+				strings.Replace(APIURLInternalLimits, ":tenantId", "1234", 1),
+				nil,
+			)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.HTTPStatus == http.StatusOK {
+				assert.JSONEq(t,
+					`{"max_sessions_per_device": 5,`+
+						`"max_sessions_per_user": 0,`+
+						`"max_sessions_per_tenant": 0}`,
+					w.Body.String(),
+				)
+			}
+		})
+	}
+}
+
+func TestUpdateSessionLimits(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Body string
+
+		Limits    *model.SessionLimits
+		LimitsErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+			Body: `{"max_sessions_per_device": 1, "max_sessions_per_user": 2}`,
+
+			Limits: &model.SessionLimits{MaxPerDevice: 1, MaxPerUser: 2},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:       "ko, bad payload",
+			Body:       `...`,
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "ko, negative limit",
+			Body:       `{"max_sessions_per_tenant": -1}`,
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, error",
+			Body: `{"max_sessions_per_device": 1}`,
+
+			Limits:    &model.SessionLimits{MaxPerDevice: 1},
+			LimitsErr: errors.New("error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			deviceConnectApp := &app_mocks.App{}
+			defer deviceConnectApp.AssertExpectations(t)
+			if tc.Limits != nil {
+				deviceConnectApp.On("UpdateSessionLimits",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					"1234",
+					tc.Limits,
+				).Return(tc.LimitsErr)
+			}
+
+			router, _ := NewRouter(deviceConnectApp, nil)
+
+			req, _ := http.NewRequest("PUT",
+				strings.Replace(APIURLInternalLimits, ":tenantId", "1234", 1),
+				strings.NewReader(tc.Body),
+			)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+		})
+	}
+}
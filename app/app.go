@@ -16,21 +16,43 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/mendersoftware/deviceconnect/client/inventory"
+	"github.com/mendersoftware/deviceconnect/client/webhooks"
 	"github.com/mendersoftware/deviceconnect/client/workflows"
 	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
 )
 
 // App errors
 var (
 	ErrDeviceNotFound     = errors.New("device not found")
 	ErrDeviceNotConnected = errors.New("device not connected")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrRecordingFailed    = errors.New("failed to record session")
+	ErrSessionNotRecorded = errors.New("session is not recorded")
+	ErrWebhookNotFound    = errors.New("webhook not found")
+	ErrShellNotSupported  = errors.New(
+		"the device does not support the remote terminal",
+	)
+
+	ErrDeviceSessionLimit = errors.New(
+		"the device reached the maximum number of concurrent sessions",
+	)
+	ErrUserSessionLimit = errors.New(
+		"the user reached the maximum number of concurrent sessions",
+	)
+	ErrTenantSessionLimit = errors.New(
+		"the tenant reached the maximum number of concurrent sessions",
+	)
 )
 
 // App interface describes app objects
@@ -42,10 +64,36 @@ type App interface {
 	ProvisionDevice(ctx context.Context, tenantID string, device *model.Device) error
 	GetDevice(ctx context.Context, tenantID, deviceID string) (*model.Device, error)
 	DeleteDevice(ctx context.Context, tenantID, deviceID string) error
+	SearchDevices(ctx context.Context, tenantID string, filter model.DeviceFilter) ([]model.Device, int64, error)
 	UpdateDeviceStatus(ctx context.Context, tenantID, deviceID, status string) error
+	ConnectDevice(ctx context.Context, tenantID, deviceID string) (int64, error)
+	DisconnectDevice(ctx context.Context, tenantID, deviceID string, generation int64) error
+	UpdateDeviceLastSeen(ctx context.Context, tenantID, deviceID string) error
+	UpdateDeviceCapabilities(ctx context.Context, tenantID, deviceID string, capabilities *model.DeviceCapabilities) error
+	RenewDevicePresence(ctx context.Context, tenantID, deviceID string, lease time.Duration) error
 	PrepareUserSession(ctx context.Context, sess *model.Session) error
-	FreeUserSession(ctx context.Context, sessionID string) error
+	FreeUserSession(ctx context.Context, sessionID string, end model.SessionEnd) error
+	GetSession(ctx context.Context, sessionID string) (*model.Session, error)
+	GetSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error)
 	RemoteTerminalAllowed(ctx context.Context, tenantID, deviceID string, groups []string) (bool, error)
+	GetGroupsDevices(ctx context.Context, tenantID string, groups []string) ([]string, error)
+	GetTenantSettings(ctx context.Context, tenantID string) (*model.TenantSettings, error)
+	UpdateTenantSettings(ctx context.Context, tenantID string, settings *model.TenantSettings) error
+	GetSessionLimits(ctx context.Context, tenantID string) (*model.SessionLimits, error)
+	UpdateSessionLimits(ctx context.Context, tenantID string, limits *model.SessionLimits) error
+	RecordSessionFrame(ctx context.Context, sessionID, direction string, data []byte) error
+	GetSessionRecording(ctx context.Context, sess *model.Session) ([]model.RecordingFrame, error)
+	ObserveSession(ctx context.Context, sessionID, userID string) (*model.SessionObserver, error)
+	StopObservingSession(ctx context.Context, sessionID, observerID string) error
+	RecordConnectionEvent(ctx context.Context, tenantID string, event *model.ConnectionEvent) error
+	GetConnectionEvents(ctx context.Context, tenantID string, filter model.ConnectionFilter) ([]model.ConnectionEvent, int64, error)
+	CreateWebhook(ctx context.Context, tenantID string, webhook *model.Webhook) error
+	GetWebhooks(ctx context.Context, tenantID string) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, tenantID, webhookID string) error
+	GetWebhookDeliveries(ctx context.Context, tenantID string, filter model.WebhookDeliveryFilter) ([]model.WebhookDelivery, int64, error)
+	Reconcile(ctx context.Context, instanceIDs []string) error
+	RebuildSessionCounters(ctx context.Context) error
+	Close()
 }
 
 // app is an app object
@@ -53,11 +101,42 @@ type app struct {
 	store     store.DataStore
 	inventory inventory.Client
 	workflows workflows.Client
+	// inventoryQueue holds the status changes waiting to be pushed to
+	// the inventory, nil if the inventory sync is disabled.
+	inventoryQueue chan inventoryUpdate
+	// webhookQueue holds the events waiting to be delivered to the
+	// webhooks, nil if the webhooks are disabled.
+	webhookQueue chan webhookJob
+	// workers are the goroutines draining the queues
+	workers sync.WaitGroup
 	Config
 }
 
 type Config struct {
 	HaveAuditLogs bool
+	// SessionLimits are the default limits of concurrent sessions, the
+	// tenants may have their own limits.
+	SessionLimits model.SessionLimits
+	// InstanceID identifies the instance of the service in the
+	// connection history of the devices.
+	InstanceID string
+	// Publisher publishes the status changes of the devices for the other
+	// services; nil disables the events.
+	Publisher Publisher
+	// Webhooks delivers the events to the webhooks of the tenants; nil
+	// disables the webhooks.
+	Webhooks webhooks.Client
+	// WebhookMaxAttempts is the maximum number of attempts to deliver an
+	// event to a webhook, waiting WebhookBackoff before the first retry
+	// and doubling it after every attempt.
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	// Shutdown is closed when the service shuts down, for the webhook
+	// deliveries to stop retrying.
+	Shutdown <-chan struct{}
+	// InventoryStatusSync pushes the status of the devices to the
+	// inventory in the background every time it changes.
+	InventoryStatusSync bool
 }
 
 // NewApp initialize a new deviceconnect App
@@ -67,13 +146,59 @@ func New(ds store.DataStore, inv inventory.Client, wf workflows.Client, config .
 		if cfgIn.HaveAuditLogs {
 			conf.HaveAuditLogs = true
 		}
+		if cfgIn.SessionLimits != (model.SessionLimits{}) {
+			conf.SessionLimits = cfgIn.SessionLimits
+		}
+		if cfgIn.InstanceID != "" {
+			conf.InstanceID = cfgIn.InstanceID
+		}
+		if cfgIn.Publisher != nil {
+			conf.Publisher = cfgIn.Publisher
+		}
+		if cfgIn.Webhooks != nil {
+			conf.Webhooks = cfgIn.Webhooks
+		}
+		if cfgIn.WebhookMaxAttempts > 0 {
+			conf.WebhookMaxAttempts = cfgIn.WebhookMaxAttempts
+		}
+		if cfgIn.WebhookBackoff > 0 {
+			conf.WebhookBackoff = cfgIn.WebhookBackoff
+		}
+		if cfgIn.Shutdown != nil {
+			conf.Shutdown = cfgIn.Shutdown
+		}
+		if cfgIn.InventoryStatusSync {
+			conf.InventoryStatusSync = true
+		}
 	}
-	return &app{
+	a := &app{
 		store:     ds,
 		inventory: inv,
 		workflows: wf,
 		Config:    conf,
 	}
+	if conf.InventoryStatusSync && inv != nil {
+		a.inventoryQueue = make(chan inventoryUpdate, inventoryQueueSize)
+		a.workers.Add(1)
+		go a.inventoryWorker()
+	}
+	if conf.Webhooks != nil {
+		a.webhookQueue = make(chan webhookJob, webhookQueueSize)
+		a.startWebhookWorkers(conf.Shutdown)
+	}
+	return a
+}
+
+// Close stops queueing the status changes and the webhook events and waits
+// for the queued ones to be delivered; the app must not be used afterwards.
+func (a *app) Close() {
+	if a.inventoryQueue != nil {
+		close(a.inventoryQueue)
+	}
+	if a.webhookQueue != nil {
+		close(a.webhookQueue)
+	}
+	a.workers.Wait()
 }
 
 // HealthCheck performs a health check and returns an error if it fails
@@ -107,20 +232,176 @@ func (a *app) GetDevice(
 	} else if device == nil {
 		return nil, ErrDeviceNotFound
 	}
+	// the instance holding the connection stopped renewing the lease
+	if device.PresenceExpired(time.Now()) {
+		a.expireDevicePresence(ctx, tenantID, device)
+	}
 	return device, nil
 }
 
+// expireDevicePresence reports the device disconnected once the instance
+// holding its connection stopped renewing the presence lease; the first
+// caller persisting the status notifies the status change.
+func (a *app) expireDevicePresence(
+	ctx context.Context,
+	tenantID string,
+	device *model.Device,
+) {
+	device.Status = model.DeviceStatusDisconnected
+	expired, err := a.store.ExpireDevicePresence(ctx, tenantID, device.ID)
+	if err != nil {
+		log.FromContext(ctx).Errorf(
+			"failed to expire the presence of the device %s: %s",
+			device.ID, err.Error(),
+		)
+	} else if expired {
+		a.deviceStatusChanged(ctx, tenantID, device.ID,
+			model.DeviceStatusConnected, model.DeviceStatusDisconnected)
+	}
+}
+
+// SearchDevices returns the devices matching the filter and the total count
+// of matching devices
+func (a *app) SearchDevices(
+	ctx context.Context,
+	tenantID string,
+	filter model.DeviceFilter,
+) ([]model.Device, int64, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, -1, errors.Wrap(err, "app: invalid device filter")
+	}
+	devices, count, err := a.store.FindDevices(ctx, tenantID, filter)
+	if err != nil {
+		return nil, -1, err
+	}
+	now := time.Now()
+	for i := range devices {
+		if devices[i].PresenceExpired(now) {
+			a.expireDevicePresence(ctx, tenantID, &devices[i])
+		}
+	}
+	return devices, count, nil
+}
+
 // DeleteDevice provisions a new tenant
 func (a *app) DeleteDevice(ctx context.Context, tenantID, deviceID string) error {
 	return a.store.DeleteDevice(ctx, tenantID, deviceID)
 }
 
-// UpdateDeviceStatus provisions a new tenant
+// UpdateDeviceStatus updates the status of a device and publishes the
+// change, if any
 func (a *app) UpdateDeviceStatus(
 	ctx context.Context,
 	tenantID, deviceID, status string,
 ) error {
-	return a.store.UpsertDeviceStatus(ctx, tenantID, deviceID, status)
+	previous, err := a.store.UpsertDeviceStatus(ctx, tenantID, deviceID, status)
+	if err != nil {
+		return err
+	}
+	a.deviceStatusChanged(ctx, tenantID, deviceID, previous, status)
+	return nil
+}
+
+// ConnectDevice marks the device connected and returns the generation of
+// the new connection.
+func (a *app) ConnectDevice(
+	ctx context.Context,
+	tenantID, deviceID string,
+) (int64, error) {
+	generation, previous, err := a.store.SetDeviceConnected(
+		ctx, tenantID, deviceID, a.InstanceID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	a.deviceStatusChanged(ctx, tenantID, deviceID,
+		previous, model.DeviceStatusConnected)
+	return generation, nil
+}
+
+// DisconnectDevice marks the device disconnected, unless the connection of
+// the given generation was replaced by a newer one.
+func (a *app) DisconnectDevice(
+	ctx context.Context,
+	tenantID, deviceID string,
+	generation int64,
+) error {
+	previous, err := a.store.SetDeviceDisconnected(
+		ctx, tenantID, deviceID, generation,
+	)
+	if err != nil {
+		return err
+	} else if previous != "" {
+		a.deviceStatusChanged(ctx, tenantID, deviceID,
+			previous, model.DeviceStatusDisconnected)
+	}
+	return nil
+}
+
+// UpdateDeviceLastSeen records that the device was heard from now
+func (a *app) UpdateDeviceLastSeen(
+	ctx context.Context,
+	tenantID, deviceID string,
+) error {
+	return a.store.UpdateDeviceLastSeen(ctx, tenantID, deviceID, time.Now())
+}
+
+// UpdateDeviceCapabilities stores the capabilities advertised by the device
+func (a *app) UpdateDeviceCapabilities(
+	ctx context.Context,
+	tenantID, deviceID string,
+	capabilities *model.DeviceCapabilities,
+) error {
+	if err := capabilities.Validate(); err != nil {
+		return errors.Wrap(err, "app: invalid device capabilities")
+	}
+	capabilities.UpdatedTs = time.Now().UTC()
+	return a.store.SetDeviceCapabilities(
+		ctx, tenantID, deviceID, capabilities,
+	)
+}
+
+// RenewDevicePresence extends the presence lease of a connected device held
+// by this instance of the service.
+func (a *app) RenewDevicePresence(
+	ctx context.Context,
+	tenantID, deviceID string,
+	lease time.Duration,
+) error {
+	return a.store.RenewDeviceLease(
+		ctx, tenantID, deviceID, a.InstanceID, time.Now().Add(lease),
+	)
+}
+
+// RecordConnectionEvent appends an event to the connection history of a device
+func (a *app) RecordConnectionEvent(
+	ctx context.Context,
+	tenantID string,
+	event *model.ConnectionEvent,
+) error {
+	if event.ID == "" {
+		eventID, err := uuid.NewRandom()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate event ID")
+		}
+		event.ID = eventID.String()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	if event.InstanceID == "" {
+		event.InstanceID = a.InstanceID
+	}
+	return a.store.InsertConnectionEvent(ctx, tenantID, event)
+}
+
+// GetConnectionEvents returns the connection history of a device
+func (a *app) GetConnectionEvents(
+	ctx context.Context,
+	tenantID string,
+	filter model.ConnectionFilter,
+) ([]model.ConnectionEvent, int64, error) {
+	return a.store.FindConnectionEvents(ctx, tenantID, filter)
 }
 
 // PrepareUserSession prepares a new user session
@@ -138,23 +419,45 @@ func (a *app) PrepareUserSession(
 		}
 		sess.ID = sessID.String()
 	}
+	sess.Status = model.SessionStatusConnected
 	if err := sess.Validate(); err != nil {
 		return errors.Wrap(err, "app: cannot create invalid Session")
 	}
 
-	device, err := a.store.GetDevice(ctx, sess.TenantID, sess.DeviceID)
+	device, err := a.GetDevice(ctx, sess.TenantID, sess.DeviceID)
 	if err != nil {
 		return err
-	} else if device == nil {
-		return ErrDeviceNotFound
 	} else if device.Status != model.DeviceStatusConnected {
 		return ErrDeviceNotConnected
+	} else if !device.SupportsProtocol(model.ProtocolShell) {
+		return ErrShellNotSupported
+	}
+	sess.DeviceGeneration = device.Generation
+
+	settings, err := a.store.GetTenantSettings(ctx, sess.TenantID)
+	if err != nil {
+		return err
 	}
+	sess.Recorded = settings.RecordSessions
+	sess.IdleTimeout = settings.IdleTimeout
+	sess.MaxDuration = settings.MaxSessionDuration
 
-	err = a.store.AllocateSession(ctx, sess)
+	limits, err := a.GetSessionLimits(ctx, sess.TenantID)
 	if err != nil {
 		return err
 	}
+	err = a.store.AllocateSession(ctx, sess, *limits)
+	switch err {
+	case nil:
+	case store.ErrDeviceSessionLimit:
+		return ErrDeviceSessionLimit
+	case store.ErrUserSessionLimit:
+		return ErrUserSessionLimit
+	case store.ErrTenantSessionLimit:
+		return ErrTenantSessionLimit
+	default:
+		return err
+	}
 
 	if a.HaveAuditLogs {
 		err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
@@ -188,37 +491,81 @@ func (a *app) PrepareUserSession(
 		}
 	}
 
+	a.notifyWebhooks(ctx, sess.TenantID, model.WebhookEventSessionStarted, sess)
 	return nil
 }
 
-// FreeUserSession releases the session
+// FreeUserSession releases the session, keeping it in the session history
+// as disconnected. If the session is released by a user other than the
+// session owner, the audit log records the releasing user.
 func (a *app) FreeUserSession(
 	ctx context.Context,
 	sessionID string,
+	end model.SessionEnd,
 ) error {
-	sess, err := a.store.DeleteSession(ctx, sessionID)
-	if err != nil {
+	sess, err := a.store.CloseSession(ctx, sessionID, end)
+	if err == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	} else if err != nil {
 		return err
 	}
+	a.notifyWebhooks(ctx, sess.TenantID, model.WebhookEventSessionEnded, sess)
 	if a.HaveAuditLogs {
+		actor := workflows.Actor{
+			ID:   sess.UserID,
+			Type: workflows.ActorUser,
+		}
+		var change string
+		id := identity.FromContext(ctx)
+		if id != nil && id.IsUser && id.Subject != sess.UserID {
+			actor.ID = id.Subject
+			change = "User terminated the terminal session of user " +
+				sess.UserID
+		} else if end.Reason == model.SessionCloseReasonIdleTimeout {
+			change = "Terminal session closed after the idle timeout"
+		} else if end.Reason == model.SessionCloseReasonMaxDuration {
+			change = "Terminal session closed after reaching " +
+				"the maximum duration"
+		} else if end.Reason == model.SessionCloseReasonDeviceDisconnect {
+			change = "Terminal session closed after the device " +
+				"disconnected"
+		}
 		err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
 			Action: workflows.ActionDelete,
-			Actor: workflows.Actor{
-				ID:   sess.UserID,
-				Type: workflows.ActorUser,
-			},
+			Actor:  actor,
 			Object: workflows.Object{
 				ID:   sess.ID,
 				Type: workflows.ObjectTerminal,
 				Terminal: &workflows.Terminal{
-					DeviceID: sess.ID,
+					DeviceID: sess.DeviceID,
 				},
 			},
+			Change: change,
 		})
 	}
 	return err
 }
 
+// GetSession returns a session
+func (a *app) GetSession(
+	ctx context.Context,
+	sessionID string,
+) (*model.Session, error) {
+	sess, err := a.store.GetSession(ctx, sessionID)
+	if err == store.ErrSessionNotFound {
+		return nil, ErrSessionNotFound
+	}
+	return sess, err
+}
+
+// GetSessions returns the sessions matching the filter and the total count
+func (a *app) GetSessions(
+	ctx context.Context,
+	filter model.SessionFilter,
+) ([]model.Session, int64, error) {
+	return a.store.FindSessions(ctx, filter)
+}
+
 func buildRBACFilter(deviceID string, groups []string) model.SearchParams {
 	searchParams := model.SearchParams{
 		Page:    1,
@@ -249,3 +596,357 @@ func (a *app) RemoteTerminalAllowed(
 	}
 	return true, nil
 }
+
+// groupsDevicesPageSize is the number of devices fetched per inventory
+// search when looking up the devices of RBAC groups
+const groupsDevicesPageSize = 500
+
+// GetGroupsDevices returns the IDs of the devices of the tenant which belong
+// to one of the groups
+func (a *app) GetGroupsDevices(
+	ctx context.Context,
+	tenantID string,
+	groups []string,
+) ([]string, error) {
+	deviceIDs := []string{}
+	for page := 1; ; page++ {
+		devices, num, err := a.inventory.Search(ctx, tenantID,
+			model.SearchParams{
+				Page:    page,
+				PerPage: groupsDevicesPageSize,
+				Filters: []model.FilterPredicate{
+					{
+						Scope:     model.InventoryGroupScope,
+						Attribute: model.InventoryGroupAttributeName,
+						Type:      "$in",
+						Value:     groups,
+					},
+				},
+			})
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range devices {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+		if len(devices) < groupsDevicesPageSize || len(deviceIDs) >= num {
+			return deviceIDs, nil
+		}
+	}
+}
+
+// GetTenantSettings returns the settings of the tenant
+func (a *app) GetTenantSettings(
+	ctx context.Context,
+	tenantID string,
+) (*model.TenantSettings, error) {
+	return a.store.GetTenantSettings(ctx, tenantID)
+}
+
+// UpdateTenantSettings replaces the settings of the tenant; the change is
+// recorded in the audit log with the user making it.
+func (a *app) UpdateTenantSettings(
+	ctx context.Context,
+	tenantID string,
+	settings *model.TenantSettings,
+) error {
+	err := a.store.UpsertTenantSettings(ctx, tenantID, settings)
+	if err != nil || !a.HaveAuditLogs {
+		return err
+	}
+	var userID string
+	if id := identity.FromContext(ctx); id != nil && id.IsUser {
+		userID = id.Subject
+	}
+	change, _ := json.Marshal(settings)
+	err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: workflows.ActionUpdate,
+		Actor: workflows.Actor{
+			ID:   userID,
+			Type: workflows.ActorUser,
+		},
+		Object: workflows.Object{
+			ID:   tenantID,
+			Type: workflows.ObjectSettings,
+		},
+		Change:  "User updated the terminal settings: " + string(change),
+		EventTS: time.Now(),
+	})
+	return errors.Wrap(err, "failed to submit audit log for the settings")
+}
+
+// GetSessionLimits returns the limits of concurrent sessions of the tenant,
+// or the default limits if the tenant has none
+func (a *app) GetSessionLimits(
+	ctx context.Context,
+	tenantID string,
+) (*model.SessionLimits, error) {
+	limits, err := a.store.GetSessionLimits(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	} else if limits == nil {
+		limits = &model.SessionLimits{}
+		*limits = a.SessionLimits
+	}
+	return limits, nil
+}
+
+// UpdateSessionLimits replaces the limits of concurrent sessions of the
+// tenant
+func (a *app) UpdateSessionLimits(
+	ctx context.Context,
+	tenantID string,
+	limits *model.SessionLimits,
+) error {
+	return a.store.UpsertSessionLimits(ctx, tenantID, limits)
+}
+
+// RecordSessionFrame stores a message relayed in a recorded session
+func (a *app) RecordSessionFrame(
+	ctx context.Context,
+	sessionID, direction string,
+	data []byte,
+) error {
+	err := a.store.InsertRecordingFrame(ctx, &model.RecordingFrame{
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Direction: direction,
+		Data:      data,
+	})
+	if err != nil {
+		return errors.Wrap(err, ErrRecordingFailed.Error())
+	}
+	return nil
+}
+
+// GetSessionRecording returns the recorded frames of a session; the access
+// to the recording is recorded in the audit log with the user accessing it.
+func (a *app) GetSessionRecording(
+	ctx context.Context,
+	sess *model.Session,
+) ([]model.RecordingFrame, error) {
+	if !sess.Recorded {
+		return nil, ErrSessionNotRecorded
+	}
+	frames, err := a.store.GetRecordingFrames(ctx, sess.ID)
+	if err != nil || !a.HaveAuditLogs {
+		return frames, err
+	}
+	var userID string
+	if id := identity.FromContext(ctx); id != nil && id.IsUser {
+		userID = id.Subject
+	}
+	err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: workflows.ActionCreate,
+		Actor: workflows.Actor{
+			ID:   userID,
+			Type: workflows.ActorUser,
+		},
+		Object: workflows.Object{
+			ID:   sess.ID,
+			Type: workflows.ObjectTerminal,
+			Terminal: &workflows.Terminal{
+				DeviceID: sess.DeviceID,
+			},
+		},
+		Change: "User accessed the recording of the terminal session " +
+			"of user " + sess.UserID,
+		EventTS: time.Now(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err,
+			"failed to submit audit log for the session recording",
+		)
+	}
+	return frames, nil
+}
+
+// ObserveSession attaches the user to a connected session as a read-only
+// observer
+func (a *app) ObserveSession(
+	ctx context.Context,
+	sessionID, userID string,
+) (*model.SessionObserver, error) {
+	observerID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate observer ID")
+	}
+	observer := &model.SessionObserver{
+		ID:      observerID.String(),
+		UserID:  userID,
+		StartTS: time.Now().UTC(),
+	}
+	sess, err := a.store.AddSessionObserver(ctx, sessionID, observer)
+	if err == store.ErrSessionNotFound {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if a.HaveAuditLogs {
+		err = a.submitObserverAuditLog(ctx, sess, observer,
+			workflows.ActionCreate,
+			"User started observing the terminal session of user "+
+				sess.UserID,
+		)
+		if err != nil {
+			_, e := a.store.CloseSessionObserver(ctx, sessionID, observer.ID)
+			if e != nil {
+				err = errors.Errorf(
+					"%s: failed to clean up session observer: %s",
+					err.Error(), e.Error(),
+				)
+			}
+			return nil, err
+		}
+	}
+	return observer, nil
+}
+
+// StopObservingSession detaches the observer from the session
+func (a *app) StopObservingSession(
+	ctx context.Context,
+	sessionID, observerID string,
+) error {
+	sess, err := a.store.CloseSessionObserver(ctx, sessionID, observerID)
+	if err == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	if a.HaveAuditLogs {
+		for i := range sess.Observers {
+			if sess.Observers[i].ID != observerID {
+				continue
+			}
+			return a.submitObserverAuditLog(ctx, sess, &sess.Observers[i],
+				workflows.ActionDelete,
+				"User stopped observing the terminal session of user "+
+					sess.UserID,
+			)
+		}
+	}
+	return nil
+}
+
+func (a *app) submitObserverAuditLog(
+	ctx context.Context,
+	sess *model.Session,
+	observer *model.SessionObserver,
+	action workflows.Action,
+	change string,
+) error {
+	err := a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: action,
+		Actor: workflows.Actor{
+			ID:   observer.UserID,
+			Type: workflows.ActorUser,
+		},
+		Object: workflows.Object{
+			ID:   sess.ID,
+			Type: workflows.ObjectTerminal,
+			Terminal: &workflows.Terminal{
+				DeviceID: sess.DeviceID,
+			},
+		},
+		Change:  change,
+		EventTS: time.Now(),
+	})
+	return errors.Wrap(err, "failed to submit audit log for session observer")
+}
+
+// Reconcile disconnects the devices of all the tenants reported connected by
+// the given instances of the service, which no longer exist, or whose
+// presence lease expired; then it closes the sessions of the devices which
+// are not connected, or which reconnected since.
+func (a *app) Reconcile(ctx context.Context, instanceIDs []string) error {
+	l := log.FromContext(ctx)
+	tenantIDs, err := a.store.GetTenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tenantID := range tenantIDs {
+		deviceIDs, err := a.store.ResetStaleDevices(ctx, tenantID, instanceIDs)
+		for _, deviceID := range deviceIDs {
+			a.deviceStatusChanged(ctx, tenantID, deviceID,
+				model.DeviceStatusConnected, model.DeviceStatusDisconnected)
+		}
+		if err != nil {
+			return err
+		}
+		sessions, err := a.closeOrphanedSessions(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		if len(deviceIDs) > 0 || sessions > 0 {
+			l.Infof("reconciled tenant %q: %d stale devices disconnected, "+
+				"%d orphaned sessions closed",
+				tenantID, len(deviceIDs), sessions)
+		}
+	}
+	return nil
+}
+
+// RebuildSessionCounters recomputes the counters of open sessions of all the
+// tenants from their connected sessions. The counters are not locked: the
+// sessions opened or closed by the running instances meanwhile may skew
+// them, which is why the rebuild is left to the reconcile command.
+func (a *app) RebuildSessionCounters(ctx context.Context) error {
+	tenantIDs, err := a.store.GetTenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tenantID := range tenantIDs {
+		err = a.store.RebuildSessionCounters(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeOrphanedSessions closes the connected sessions of the devices of the
+// tenant which are not connected, or which reconnected since the session
+// started, as the device disconnections would have, returning the number of
+// sessions closed.
+func (a *app) closeOrphanedSessions(
+	ctx context.Context,
+	tenantID string,
+) (int, error) {
+	ctx = identity.WithContext(ctx, &identity.Identity{Tenant: tenantID})
+	sessions, _, err := a.store.FindSessions(ctx, model.SessionFilter{
+		Status: model.SessionStatusConnected,
+	})
+	if err != nil {
+		return 0, err
+	}
+	closed := 0
+	devices := make(map[string]*model.Device)
+	for _, sess := range sessions {
+		device, ok := devices[sess.DeviceID]
+		if !ok {
+			device, err = a.GetDevice(ctx, tenantID, sess.DeviceID)
+			if err != nil && err != ErrDeviceNotFound {
+				return closed, err
+			}
+			devices[sess.DeviceID] = device
+		}
+		// the sessions relayed by a crashed instance are left open while
+		// the device reconnects to another instance
+		if device != nil &&
+			device.Status == model.DeviceStatusConnected &&
+			(sess.DeviceGeneration == 0 ||
+				sess.DeviceGeneration == device.Generation) {
+			continue
+		}
+		err = a.FreeUserSession(ctx, sess.ID, model.SessionEnd{
+			Reason: model.SessionCloseReasonDeviceDisconnect,
+		})
+		if err == ErrSessionNotFound {
+			continue
+		} else if err != nil {
+			return closed, err
+		}
+		closed++
+	}
+	return closed, nil
+}
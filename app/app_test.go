@@ -16,8 +16,11 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,7 +32,9 @@ import (
 	"github.com/mendersoftware/deviceconnect/client/workflows"
 	wf_mocks "github.com/mendersoftware/deviceconnect/client/workflows/mocks"
 	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
 	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+	"github.com/mendersoftware/go-lib-micro/identity"
 )
 
 func TestHealthCheck(t *testing.T) {
@@ -151,7 +156,13 @@ func TestGetDevice(t *testing.T) {
 		deviceID,
 	).Return(device, nil)
 
-	app := New(store, nil, nil)
+	var subjects []string
+	app := New(store, nil, nil, Config{
+		Publisher: publisherFunc(func(subject string, _ []byte) error {
+			subjects = append(subjects, subject)
+			return nil
+		}),
+	})
 
 	ctx := context.Background()
 	_, res := app.GetDevice(ctx, tenantID, "error")
@@ -164,9 +175,140 @@ func TestGetDevice(t *testing.T) {
 	assert.NoError(t, res)
 	assert.Equal(t, dev, device)
 
+	// the presence lease of the device expired
+	store.On("GetDevice",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			return true
+		}),
+		tenantID,
+		"expired",
+	).Return(&model.Device{
+		ID:             "expired",
+		Status:         model.DeviceStatusConnected,
+		InstanceID:     "deviceconnect-1",
+		LeaseExpiresTs: time.Now().Add(-time.Second),
+	}, nil)
+	store.On("ExpireDevicePresence",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			return true
+		}),
+		tenantID,
+		"expired",
+	).Return(true, nil)
+
+	dev, res = app.GetDevice(ctx, tenantID, "expired")
+	assert.NoError(t, res)
+	assert.Equal(t, model.DeviceStatusDisconnected, dev.Status)
+	assert.Equal(t, []string{
+		model.GetDeviceStatusSubject(tenantID, "expired"),
+	}, subjects)
+
 	store.AssertExpectations(t)
 }
 
+func TestSearchDevices(t *testing.T) {
+	const tenantID = "1234"
+	testCases := []struct {
+		Name   string
+		Filter model.DeviceFilter
+
+		StoreDevices []model.Device
+		StoreErr     error
+
+		Statuses []string
+		Error    error
+	}{
+		{
+			Name: "ok",
+			Filter: model.DeviceFilter{
+				IDs:   []string{"a", "b", "c"},
+				Limit: 20,
+			},
+			StoreDevices: []model.Device{{
+				ID:     "a",
+				Status: model.DeviceStatusConnected,
+			}, {
+				ID:             "b",
+				Status:         model.DeviceStatusConnected,
+				LeaseExpiresTs: time.Now().Add(-time.Second),
+			}, {
+				ID:     "c",
+				Status: model.DeviceStatusDisconnected,
+			}},
+			Statuses: []string{
+				model.DeviceStatusConnected,
+				model.DeviceStatusDisconnected,
+				model.DeviceStatusDisconnected,
+			},
+		},
+		{
+			Name: "error, invalid filter",
+			Filter: model.DeviceFilter{
+				IDs: []string{""},
+			},
+			Error: errors.New("app: invalid device filter: " +
+				"device_ids: (0: cannot be blank.)."),
+		},
+		{
+			Name:     "error, store error",
+			StoreErr: errors.New("store: internal error"),
+			Error:    errors.New("store: internal error"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			if tc.Error == nil || tc.StoreErr != nil {
+				ds.On("FindDevices", ctx, tenantID, tc.Filter).
+					Return(tc.StoreDevices, int64(len(tc.StoreDevices)),
+						tc.StoreErr)
+			}
+			for _, device := range tc.StoreDevices {
+				if device.PresenceExpired(time.Now()) {
+					ds.On("ExpireDevicePresence",
+						ctx, tenantID, device.ID,
+					).Return(true, nil)
+				}
+			}
+
+			app := New(ds, nil, nil)
+			devices, count, err := app.SearchDevices(ctx, tenantID, tc.Filter)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(tc.Statuses)), count)
+			for i, device := range devices {
+				assert.Equal(t, tc.Statuses[i], device.Status)
+			}
+		})
+	}
+}
+
+func TestRenewDevicePresence(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	ctx := context.Background()
+	before := time.Now()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("RenewDeviceLease", ctx, tenantID, deviceID, "deviceconnect-1",
+		mock.MatchedBy(func(ts time.Time) bool {
+			return !ts.Before(before.Add(time.Minute))
+		}),
+	).Return(nil)
+
+	app := New(ds, nil, nil, Config{InstanceID: "deviceconnect-1"})
+	err := app.RenewDevicePresence(ctx, tenantID, deviceID, time.Minute)
+	assert.NoError(t, err)
+}
+
 func TestUpdateDeviceStatus(t *testing.T) {
 	err := errors.New("error")
 	const tenantID = "1234"
@@ -180,7 +322,7 @@ func TestUpdateDeviceStatus(t *testing.T) {
 		tenantID,
 		deviceID,
 		mock.AnythingOfType("string"),
-	).Return(err)
+	).Return("", err)
 
 	app := New(store, nil, nil)
 
@@ -191,12 +333,435 @@ func TestUpdateDeviceStatus(t *testing.T) {
 	store.AssertExpectations(t)
 }
 
+// publisherFunc is a Publisher calling itself
+type publisherFunc func(subject string, data []byte) error
+
+func (f publisherFunc) Publish(subject string, data []byte) error {
+	return f(subject, data)
+}
+
+func TestPublishDeviceStatus(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	testCases := []struct {
+		Name string
+
+		Update     func(a App) error
+		Previous   string
+		PublishErr error
+
+		Event *model.DeviceStatusEvent
+	}{
+		{
+			Name: "ok, device connected",
+			Update: func(a App) error {
+				_, err := a.ConnectDevice(
+					context.Background(), tenantID, deviceID,
+				)
+				return err
+			},
+			Previous: model.DeviceStatusDisconnected,
+
+			Event: &model.DeviceStatusEvent{
+				OldStatus: model.DeviceStatusDisconnected,
+				NewStatus: model.DeviceStatusConnected,
+			},
+		},
+		{
+			Name: "ok, connection replaced",
+			Update: func(a App) error {
+				_, err := a.ConnectDevice(
+					context.Background(), tenantID, deviceID,
+				)
+				return err
+			},
+			Previous: model.DeviceStatusConnected,
+		},
+		{
+			Name: "ok, device disconnected",
+			Update: func(a App) error {
+				return a.DisconnectDevice(
+					context.Background(), tenantID, deviceID, 2,
+				)
+			},
+			Previous: model.DeviceStatusConnected,
+
+			Event: &model.DeviceStatusEvent{
+				OldStatus: model.DeviceStatusConnected,
+				NewStatus: model.DeviceStatusDisconnected,
+			},
+		},
+		{
+			Name: "ok, stale disconnection",
+			Update: func(a App) error {
+				return a.DisconnectDevice(
+					context.Background(), tenantID, deviceID, 2,
+				)
+			},
+		},
+		{
+			Name: "ok, status updated",
+			Update: func(a App) error {
+				return a.UpdateDeviceStatus(
+					context.Background(), tenantID, deviceID,
+					model.DeviceStatusConnected,
+				)
+			},
+			Previous:   model.DeviceStatusUnknown,
+			PublishErr: errors.New("nats: connection closed"),
+
+			Event: &model.DeviceStatusEvent{
+				OldStatus: model.DeviceStatusUnknown,
+				NewStatus: model.DeviceStatusConnected,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ds := new(store_mocks.DataStore)
+			ds.On("SetDeviceConnected",
+				mock.Anything, tenantID, deviceID, "deviceconnect-1",
+			).Return(int64(2), tc.Previous, nil).Maybe()
+			ds.On("SetDeviceDisconnected",
+				mock.Anything, tenantID, deviceID, int64(2),
+			).Return(tc.Previous, nil).Maybe()
+			ds.On("UpsertDeviceStatus",
+				mock.Anything, tenantID, deviceID, mock.AnythingOfType("string"),
+			).Return(tc.Previous, nil).Maybe()
+
+			var events []model.DeviceStatusEvent
+			publisher := publisherFunc(func(subject string, data []byte) error {
+				assert.Equal(t,
+					model.GetDeviceStatusSubject(tenantID, deviceID),
+					subject,
+				)
+				var event model.DeviceStatusEvent
+				err := json.Unmarshal(data, &event)
+				assert.NoError(t, err)
+				events = append(events, event)
+				return tc.PublishErr
+			})
+
+			app := New(ds, nil, nil, Config{
+				InstanceID: "deviceconnect-1",
+				Publisher:  publisher,
+			})
+			err := tc.Update(app)
+			assert.NoError(t, err)
+
+			if tc.Event == nil {
+				assert.Empty(t, events)
+				return
+			}
+			if assert.Len(t, events, 1) {
+				assert.WithinDuration(t,
+					time.Now(), events[0].Timestamp, time.Minute)
+				expected := *tc.Event
+				expected.TenantID = tenantID
+				expected.DeviceID = deviceID
+				expected.InstanceID = "deviceconnect-1"
+				expected.Timestamp = events[0].Timestamp
+				assert.Equal(t, expected, events[0])
+			}
+		})
+	}
+}
+
+func TestSyncInventoryStatus(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	lastSeen := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+	testCases := []struct {
+		Name string
+
+		Sync         bool
+		Status       string
+		Previous     string
+		Device       *model.Device
+		GetDeviceErr error
+		InvErr       error
+
+		Connected string
+		LastSeen  string
+	}{
+		{
+			Name:     "ok, device connected",
+			Sync:     true,
+			Status:   model.DeviceStatusConnected,
+			Previous: model.DeviceStatusDisconnected,
+			Device: &model.Device{
+				ID:         deviceID,
+				LastSeenTs: &lastSeen,
+			},
+
+			Connected: "true",
+			LastSeen:  lastSeen.Format(time.RFC3339),
+		},
+		{
+			Name:     "ok, device disconnected",
+			Sync:     true,
+			Status:   model.DeviceStatusDisconnected,
+			Previous: model.DeviceStatusConnected,
+			Device: &model.Device{
+				ID:         deviceID,
+				LastSeenTs: &lastSeen,
+			},
+			InvErr: errors.New("inventory: internal error"),
+
+			Connected: "false",
+			LastSeen:  lastSeen.Format(time.RFC3339),
+		},
+		{
+			Name:     "ok, device never seen",
+			Sync:     true,
+			Status:   model.DeviceStatusDisconnected,
+			Previous: model.DeviceStatusUnknown,
+			Device:   &model.Device{ID: deviceID},
+
+			Connected: "false",
+		},
+		{
+			Name:         "ok, last seen time not found",
+			Sync:         true,
+			Status:       model.DeviceStatusDisconnected,
+			Previous:     model.DeviceStatusConnected,
+			GetDeviceErr: errors.New("store: internal error"),
+
+			Connected: "false",
+		},
+		{
+			Name:     "ok, status unchanged",
+			Sync:     true,
+			Status:   model.DeviceStatusConnected,
+			Previous: model.DeviceStatusConnected,
+		},
+		{
+			Name:     "ok, sync disabled",
+			Status:   model.DeviceStatusConnected,
+			Previous: model.DeviceStatusDisconnected,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("UpsertDeviceStatus", ctx, tenantID, deviceID, tc.Status).
+				Return(tc.Previous, nil)
+
+			inv := new(inv_mocks.Client)
+			defer inv.AssertExpectations(t)
+			synced := make(chan struct{})
+			if tc.Connected != "" {
+				ds.On("GetDevice", mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}), tenantID, deviceID).Return(tc.Device, tc.GetDeviceErr)
+				expected := []model.DeviceAttribute{{
+					Name:  model.InventoryConnectedAttributeName,
+					Value: tc.Connected,
+					Scope: model.InventoryDeviceconnectScope,
+				}}
+				if tc.LastSeen != "" {
+					expected = append(expected, model.DeviceAttribute{
+						Name:  model.InventoryLastSeenAttributeName,
+						Value: tc.LastSeen,
+						Scope: model.InventoryDeviceconnectScope,
+					})
+				}
+				inv.On("UpdateDeviceAttributes",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tenantID, deviceID,
+					model.InventoryDeviceconnectScope,
+					expected,
+				).Run(func(mock.Arguments) {
+					close(synced)
+				}).Return(tc.InvErr)
+			}
+
+			app := New(ds, inv, nil, Config{InventoryStatusSync: tc.Sync})
+			err := app.UpdateDeviceStatus(ctx, tenantID, deviceID, tc.Status)
+			assert.NoError(t, err)
+			if tc.Connected != "" {
+				// the inventory is updated in the background
+				select {
+				case <-synced:
+				case <-time.After(time.Second):
+					assert.Fail(t, "timeout waiting for the inventory sync")
+				}
+			}
+		})
+	}
+}
+
+func TestSyncInventoryStatusQueueFull(t *testing.T) {
+	// without a worker draining the queue, the status change is dropped
+	app := &app{
+		inventory:      new(inv_mocks.Client),
+		inventoryQueue: make(chan inventoryUpdate),
+	}
+	app.syncInventoryStatus(context.Background(), &model.DeviceStatusEvent{
+		DeviceID:  "00000000-0000-0000-0000-000000000000",
+		NewStatus: model.DeviceStatusConnected,
+	})
+	assert.Len(t, app.inventoryQueue, 0)
+}
+
+func TestClose(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	ctx := context.Background()
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("UpsertDeviceStatus", ctx, tenantID, deviceID,
+		model.DeviceStatusConnected).
+		Return(model.DeviceStatusDisconnected, nil)
+
+	ds.On("GetDevice", mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	}), tenantID, deviceID).Return(&model.Device{ID: deviceID}, nil)
+
+	inv := new(inv_mocks.Client)
+	inv.On("UpdateDeviceAttributes",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		tenantID, deviceID,
+		model.InventoryDeviceconnectScope,
+		mock.AnythingOfType("[]model.DeviceAttribute"),
+	).Return(nil)
+
+	app := New(ds, inv, nil, Config{InventoryStatusSync: true})
+	err := app.UpdateDeviceStatus(ctx, tenantID, deviceID,
+		model.DeviceStatusConnected)
+	assert.NoError(t, err)
+
+	// closing the app waits for the queued status changes
+	app.Close()
+	inv.AssertExpectations(t)
+}
+
 type brokenReader struct{}
 
 func (r brokenReader) Read(b []byte) (int, error) {
 	return 0, errors.New("broken reader")
 }
 
+func TestConnectDevice(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("SetDeviceConnected", ctx, tenantID, deviceID, "deviceconnect-1").
+		Return(int64(2), model.DeviceStatusDisconnected, nil)
+	ds.On("SetDeviceDisconnected", ctx, tenantID, deviceID, int64(2)).
+		Return("", errors.New("store: internal error"))
+
+	app := New(ds, nil, nil, Config{InstanceID: "deviceconnect-1"})
+	generation, err := app.ConnectDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), generation)
+
+	err = app.DisconnectDevice(ctx, tenantID, deviceID, generation)
+	assert.EqualError(t, err, "store: internal error")
+}
+
+func TestUpdateDeviceLastSeen(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	ctx := context.Background()
+	before := time.Now()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("UpdateDeviceLastSeen", ctx, tenantID, deviceID,
+		mock.MatchedBy(func(ts time.Time) bool {
+			return !ts.Before(before)
+		}),
+	).Return(nil)
+
+	app := New(ds, nil, nil)
+	err := app.UpdateDeviceLastSeen(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+}
+
+func TestUpdateDeviceCapabilities(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	testCases := []struct {
+		Name         string
+		Capabilities *model.DeviceCapabilities
+
+		StoreErr error
+		Error    error
+	}{
+		{
+			Name: "ok",
+			Capabilities: &model.DeviceCapabilities{
+				AgentVersion: "2.0.0",
+				Protocols: []string{
+					model.ProtocolShell,
+					model.ProtocolFileTransfer,
+				},
+				Shells: []string{"/bin/sh"},
+			},
+		},
+		{
+			Name:         "error, invalid capabilities",
+			Capabilities: &model.DeviceCapabilities{AgentVersion: "2.0.0"},
+			Error: errors.New("app: invalid device capabilities: " +
+				"protocols: cannot be blank."),
+		},
+		{
+			Name: "error, store error",
+			Capabilities: &model.DeviceCapabilities{
+				Protocols: []string{model.ProtocolShell},
+			},
+			StoreErr: errors.New("store: internal error"),
+			Error:    errors.New("store: internal error"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			if tc.Error == nil || tc.StoreErr != nil {
+				ds.On("SetDeviceCapabilities", ctx, tenantID, deviceID,
+					mock.MatchedBy(func(c *model.DeviceCapabilities) bool {
+						return c == tc.Capabilities && !c.UpdatedTs.IsZero()
+					}),
+				).Return(tc.StoreErr)
+			}
+
+			app := New(ds, nil, nil)
+			err := app.UpdateDeviceCapabilities(
+				ctx, tenantID, deviceID, tc.Capabilities,
+			)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestPrepareUserSession(t *testing.T) {
 	testCases := []struct {
 		Name string
@@ -210,6 +775,12 @@ func TestPrepareUserSession(t *testing.T) {
 		StoreGetDevice    *model.Device
 		StoreGetDeviceErr error
 
+		StoreSettings    *model.TenantSettings
+		StoreSettingsErr error
+
+		StoreLimits    *model.SessionLimits
+		StoreLimitsErr error
+
 		StoreAllocSessErr error
 
 		HaveAuditLogs         bool
@@ -228,13 +799,33 @@ func TestPrepareUserSession(t *testing.T) {
 			StartTS:  time.Now(),
 		},
 		StoreGetDevice: &model.Device{
-			ID:     "00000000-0000-0000-0000-000000000000",
-			Status: model.DeviceStatusConnected,
+			ID:         "00000000-0000-0000-0000-000000000000",
+			Status:     model.DeviceStatusConnected,
+			Generation: 3,
 		},
 		StoreGetDeviceErr: nil,
 		StoreAllocSessErr: nil,
 
 		WorkflowsError: nil,
+	}, {
+		Name: "ok, recorded",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreSettings: &model.TenantSettings{
+			RecordSessions:     true,
+			IdleTimeout:        10,
+			MaxSessionDuration: 60,
+		},
 	}, {
 		Name: "ok, with auditlogs",
 
@@ -330,6 +921,40 @@ func TestPrepareUserSession(t *testing.T) {
 			Status: model.DeviceStatusDisconnected,
 		},
 		Erre: errors.New("device not connected"),
+	}, {
+		Name: "error, remote terminal not supported",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+			Capabilities: &model.DeviceCapabilities{
+				Protocols: []string{model.ProtocolFileTransfer},
+			},
+		},
+		Erre: ErrShellNotSupported,
+	}, {
+		Name: "error, GetTenantSettings internal error",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreSettingsErr: errors.New("store: internal error"),
+		Erre:             errors.New("^store: internal error$"),
 	}, {
 		Name: "error, AllocateSession internal error",
 
@@ -346,6 +971,71 @@ func TestPrepareUserSession(t *testing.T) {
 		},
 		StoreAllocSessErr: errors.New("store: internal error"),
 		Erre:              errors.New("store: internal error"),
+	}, {
+		Name: "error, device session limit reached",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreLimits:       &model.SessionLimits{MaxPerDevice: 1},
+		StoreAllocSessErr: store.ErrDeviceSessionLimit,
+		Erre:              ErrDeviceSessionLimit,
+	}, {
+		Name: "error, user session limit reached",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreAllocSessErr: store.ErrUserSessionLimit,
+		Erre:              ErrUserSessionLimit,
+	}, {
+		Name: "error, tenant session limit reached",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreAllocSessErr: store.ErrTenantSessionLimit,
+		Erre:              ErrTenantSessionLimit,
+	}, {
+		Name: "error, GetSessionLimits internal error",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreLimitsErr: errors.New("store: internal error"),
+		Erre:           errors.New("^store: internal error$"),
 	}, {
 		Name: "error, SubmitAuditLog http error",
 
@@ -401,9 +1091,13 @@ func TestPrepareUserSession(t *testing.T) {
 			defer inv.AssertExpectations(t)
 			uuid.SetRand(tc.Rand)
 			defer uuid.SetRand(nil)
+			limits := model.SessionLimits{MaxPerDevice: 5, MaxPerUser: 10}
 			app := New(
 				ds, inv,
-				wf, Config{HaveAuditLogs: tc.HaveAuditLogs},
+				wf, Config{
+					HaveAuditLogs: tc.HaveAuditLogs,
+					SessionLimits: limits,
+				},
 			)
 			if tc.BadParameters {
 				goto execTest
@@ -417,11 +1111,37 @@ func TestPrepareUserSession(t *testing.T) {
 				(tc.StoreGetDeviceErr == nil &&
 					tc.StoreGetDevice == nil) ||
 				tc.StoreGetDevice.Status !=
-					model.DeviceStatusConnected {
+					model.DeviceStatusConnected ||
+				!tc.StoreGetDevice.SupportsProtocol(model.ProtocolShell) {
+				goto execTest
+			}
+			if tc.StoreSettings == nil && tc.StoreSettingsErr == nil {
+				tc.StoreSettings = &model.TenantSettings{}
+			}
+			ds.On("GetTenantSettings", tc.CTX, tc.Session.TenantID).
+				Return(tc.StoreSettings, tc.StoreSettingsErr)
+			if tc.StoreSettingsErr != nil {
+				goto execTest
+			}
+			ds.On("GetSessionLimits", tc.CTX, tc.Session.TenantID).
+				Return(tc.StoreLimits, tc.StoreLimitsErr)
+			if tc.StoreLimitsErr != nil {
 				goto execTest
 			}
-			ds.On("AllocateSession", tc.CTX, tc.Session).
-				Return(tc.StoreAllocSessErr)
+			if tc.StoreLimits == nil {
+				tc.StoreLimits = &limits
+			}
+			ds.On("AllocateSession", tc.CTX,
+				mock.MatchedBy(func(sess *model.Session) bool {
+					return sess.Recorded == tc.StoreSettings.RecordSessions &&
+						sess.IdleTimeout == tc.StoreSettings.IdleTimeout &&
+						sess.MaxDuration ==
+							tc.StoreSettings.MaxSessionDuration &&
+						sess.DeviceGeneration ==
+							tc.StoreGetDevice.Generation
+				}),
+				*tc.StoreLimits,
+			).Return(tc.StoreAllocSessErr)
 			if tc.StoreAllocSessErr != nil {
 				goto execTest
 			}
@@ -463,8 +1183,8 @@ func TestFreeUserSession(t *testing.T) {
 
 		SessionID string
 
-		StoreDeleteSession    *model.Session
-		StoreDeleteSessionErr error
+		StoreCloseSession    *model.Session
+		StoreCloseSessionErr error
 
 		HaveAuditLogs bool
 		WorkflowsErr  error
@@ -475,7 +1195,7 @@ func TestFreeUserSession(t *testing.T) {
 
 		SessionID: "00000000-0000-0000-0000-000000000000",
 
-		StoreDeleteSession: &model.Session{
+		StoreCloseSession: &model.Session{
 			ID:       "00000000-0000-0000-0000-000000000000",
 			DeviceID: "00000000-0000-0000-0000-000000000001",
 			UserID:   "00000000-0000-0000-0000-000000000002",
@@ -487,7 +1207,7 @@ func TestFreeUserSession(t *testing.T) {
 
 		SessionID: "00000000-0000-0000-0000-000000000000",
 
-		StoreDeleteSession: &model.Session{
+		StoreCloseSession: &model.Session{
 			ID:       "00000000-0000-0000-0000-000000000000",
 			DeviceID: "00000000-0000-0000-0000-000000000001",
 			UserID:   "00000000-0000-0000-0000-000000000002",
@@ -496,20 +1216,28 @@ func TestFreeUserSession(t *testing.T) {
 		},
 		HaveAuditLogs: true,
 	}, {
-		Name: "error, store.DeleteSession internal error",
+		Name: "error, store.CloseSession internal error",
 
 		SessionID: "00000000-0000-0000-0000-000000000000",
 
 		HaveAuditLogs:         true,
-		StoreDeleteSessionErr: errors.New("store: internal error"),
+		StoreCloseSessionErr: errors.New("store: internal error"),
 
 		Erre: errors.New("store: internal error$"),
+	}, {
+		Name: "error, session not found",
+
+		SessionID: "00000000-0000-0000-0000-000000000000",
+
+		StoreCloseSessionErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
 	}, {
 		Name: "error, SubmitAuditLogs http error",
 
 		SessionID: "00000000-0000-0000-0000-000000000000",
 
-		StoreDeleteSession: &model.Session{
+		StoreCloseSession: &model.Session{
 			ID:       "00000000-0000-0000-0000-000000000000",
 			DeviceID: "00000000-0000-0000-0000-000000000001",
 			UserID:   "00000000-0000-0000-0000-000000000002",
@@ -537,18 +1265,23 @@ func TestFreeUserSession(t *testing.T) {
 			defer wf.AssertExpectations(t)
 			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
 			ctx := context.Background()
+			end := model.SessionEnd{
+				Reason:          model.SessionCloseReasonUserDisconnect,
+				BytesToDevice:   10,
+				BytesFromDevice: 20,
+			}
 
-			ds.On("DeleteSession", ctx, tc.SessionID).
-				Return(tc.StoreDeleteSession, tc.StoreDeleteSessionErr)
-			if tc.StoreDeleteSessionErr != nil || !tc.HaveAuditLogs {
+			ds.On("CloseSession", ctx, tc.SessionID, end).
+				Return(tc.StoreCloseSession, tc.StoreCloseSessionErr)
+			if tc.StoreCloseSessionErr != nil || !tc.HaveAuditLogs {
 				goto execTest
 			}
 			wf.On("SubmitAuditLog", ctx,
-				mock.MatchedBy(workflowsMatcher(tc.StoreDeleteSession))).
+				mock.MatchedBy(workflowsMatcher(tc.StoreCloseSession))).
 				Return(tc.WorkflowsErr)
 
 		execTest:
-			err := app.FreeUserSession(ctx, tc.SessionID)
+			err := app.FreeUserSession(ctx, tc.SessionID, end)
 			if tc.Erre != nil {
 				if assert.Error(t, err) {
 					assert.Regexp(t,
@@ -563,6 +1296,112 @@ func TestFreeUserSession(t *testing.T) {
 	}
 }
 
+func TestFreeUserSessionByOtherUser(t *testing.T) {
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		TenantID: "000000000000000000000000",
+		StartTS:  time.Now().Add(-time.Hour),
+	}
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000003",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	})
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	wf := new(wf_mocks.Client)
+	defer wf.AssertExpectations(t)
+
+	end := model.SessionEnd{Reason: model.SessionCloseReasonTerminated}
+	ds.On("CloseSession", ctx, sess.ID, end).Return(sess, nil)
+	wf.On("SubmitAuditLog", ctx,
+		mock.MatchedBy(func(log workflows.AuditLog) bool {
+			return log.Action == workflows.ActionDelete &&
+				log.Actor.ID == "00000000-0000-0000-0000-000000000003" &&
+				log.Object.Terminal.DeviceID == sess.DeviceID &&
+				log.Change != ""
+		}),
+	).Return(nil)
+
+	app := New(ds, nil, wf, Config{HaveAuditLogs: true})
+	err := app.FreeUserSession(ctx, sess.ID, end)
+	assert.NoError(t, err)
+}
+
+func TestFreeUserSessionExpired(t *testing.T) {
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		TenantID: "000000000000000000000000",
+		StartTS:  time.Now().Add(-time.Hour),
+	}
+	testCases := map[string]string{
+		model.SessionCloseReasonIdleTimeout: "Terminal session closed " +
+			"after the idle timeout",
+		model.SessionCloseReasonMaxDuration: "Terminal session closed " +
+			"after reaching the maximum duration",
+	}
+	for reason, change := range testCases {
+		reason, change := reason, change
+		t.Run(reason, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			wf := new(wf_mocks.Client)
+			defer wf.AssertExpectations(t)
+
+			end := model.SessionEnd{Reason: reason}
+			ds.On("CloseSession", ctx, sess.ID, end).Return(sess, nil)
+			wf.On("SubmitAuditLog", ctx,
+				mock.MatchedBy(func(log workflows.AuditLog) bool {
+					return log.Action == workflows.ActionDelete &&
+						log.Actor.ID == sess.UserID &&
+						log.Change == change
+				}),
+			).Return(nil)
+
+			app := New(ds, nil, wf, Config{HaveAuditLogs: true})
+			err := app.FreeUserSession(ctx, sess.ID, end)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	sess := &model.Session{
+		ID:       sessionID,
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		StartTS:  time.Now(),
+	}
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetSession", ctx, sessionID).Return(sess, nil).Once()
+	ds.On("GetSession", ctx, sessionID).
+		Return(nil, store.ErrSessionNotFound).Once()
+	ds.On("GetSession", ctx, sessionID).
+		Return(nil, errors.New("store: internal error")).Once()
+
+	app := New(ds, nil, nil)
+
+	res, err := app.GetSession(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, sess, res)
+
+	_, err = app.GetSession(ctx, sessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	_, err = app.GetSession(ctx, sessionID)
+	assert.EqualError(t, err, "store: internal error")
+}
+
 func TestRemoteTerminalAllowed(t *testing.T) {
 	testCases := []struct {
 		name                    string
@@ -639,3 +1478,669 @@ func TestRemoteTerminalAllowed(t *testing.T) {
 		})
 	}
 }
+
+func TestGetGroupsDevices(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	groups := []string{"a", "b"}
+	searchParams := func(page int) model.SearchParams {
+		return model.SearchParams{
+			Page:    page,
+			PerPage: groupsDevicesPageSize,
+			Filters: []model.FilterPredicate{
+				{
+					Scope:     model.InventoryGroupScope,
+					Attribute: model.InventoryGroupAttributeName,
+					Type:      "$in",
+					Value:     groups,
+				},
+			},
+		}
+	}
+	firstPage := make([]model.InvDevice, groupsDevicesPageSize)
+	deviceIDs := make([]string, groupsDevicesPageSize+1)
+	for i := range firstPage {
+		firstPage[i].ID = fmt.Sprintf("device-%d", i)
+		deviceIDs[i] = firstPage[i].ID
+	}
+	deviceIDs[groupsDevicesPageSize] = "device-last"
+	ctxMatcher := mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	})
+
+	t.Run("ok, several pages", func(t *testing.T) {
+		inv := &inv_mocks.Client{}
+		defer inv.AssertExpectations(t)
+		inv.On("Search", ctxMatcher, tenantID, searchParams(1)).
+			Return(firstPage, groupsDevicesPageSize+1, nil)
+		inv.On("Search", ctxMatcher, tenantID, searchParams(2)).
+			Return([]model.InvDevice{{ID: "device-last"}},
+				groupsDevicesPageSize+1, nil)
+
+		app := New(nil, inv, nil)
+		res, err := app.GetGroupsDevices(context.Background(), tenantID, groups)
+		assert.NoError(t, err)
+		assert.Equal(t, deviceIDs, res)
+	})
+
+	t.Run("ok, no device", func(t *testing.T) {
+		inv := &inv_mocks.Client{}
+		defer inv.AssertExpectations(t)
+		inv.On("Search", ctxMatcher, tenantID, searchParams(1)).
+			Return([]model.InvDevice{}, 0, nil)
+
+		app := New(nil, inv, nil)
+		res, err := app.GetGroupsDevices(context.Background(), tenantID, groups)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{}, res)
+	})
+
+	t.Run("ko, inventory error", func(t *testing.T) {
+		inv := &inv_mocks.Client{}
+		defer inv.AssertExpectations(t)
+		inv.On("Search", ctxMatcher, tenantID, searchParams(1)).
+			Return(nil, -1, errors.New("search error"))
+
+		app := New(nil, inv, nil)
+		res, err := app.GetGroupsDevices(context.Background(), tenantID, groups)
+		assert.EqualError(t, err, "search error")
+		assert.Nil(t, res)
+	})
+}
+
+func TestGetSessions(t *testing.T) {
+	err := errors.New("error")
+	filter := model.SessionFilter{
+		DeviceID: "00000000-0000-0000-0000-000000000000",
+		Limit:    20,
+	}
+	sessions := []model.Session{{
+		ID:       "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		DeviceID: "00000000-0000-0000-0000-000000000000",
+		StartTS:  time.Now(),
+	}}
+
+	store := &store_mocks.DataStore{}
+	store.On("FindSessions",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			return true
+		}),
+		filter,
+	).Return(sessions, int64(1), nil).Once()
+	store.On("FindSessions",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			return true
+		}),
+		filter,
+	).Return(nil, int64(-1), err).Once()
+
+	app := New(store, nil, nil)
+
+	ctx := context.Background()
+	res, count, e := app.GetSessions(ctx, filter)
+	assert.NoError(t, e)
+	assert.Equal(t, sessions, res)
+	assert.Equal(t, int64(1), count)
+
+	_, _, e = app.GetSessions(ctx, filter)
+	assert.Equal(t, err, e)
+
+	store.AssertExpectations(t)
+}
+
+func TestReconcile(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	instanceIDs := []string{"deviceconnect-1"}
+	matchTenant := func(tenantID string) interface{} {
+		return mock.MatchedBy(func(ctx context.Context) bool {
+			id := identity.FromContext(ctx)
+			return id != nil && id.Tenant == tenantID
+		})
+	}
+	sessions := []model.Session{{
+		ID:       "00000000-0000-0000-0000-000000000001",
+		DeviceID: "connected",
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000002",
+		DeviceID: "disconnected",
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000003",
+		DeviceID: "disconnected",
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000004",
+		DeviceID: "deleted",
+	}, {
+		ID:               "00000000-0000-0000-0000-000000000005",
+		DeviceID:         "connected",
+		DeviceGeneration: 1,
+	}, {
+		ID:               "00000000-0000-0000-0000-000000000006",
+		DeviceID:         "connected",
+		DeviceGeneration: 2,
+	}}
+	end := model.SessionEnd{Reason: model.SessionCloseReasonDeviceDisconnect}
+
+	testCases := []struct {
+		Name string
+
+		TenantIDsErr  error
+		ResetErr      error
+		FindErr       error
+		GetDeviceErr  error
+		CloseErr      error
+		ExpectedError error
+	}{{
+		Name: "ok",
+	}, {
+		Name:          "error, get tenants",
+		TenantIDsErr:  errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}, {
+		Name:          "error, reset devices",
+		ResetErr:      errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}, {
+		Name:          "error, find sessions",
+		FindErr:       errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}, {
+		Name:          "error, get device",
+		GetDeviceErr:  errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}, {
+		Name:          "error, close session",
+		CloseErr:      errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+
+			ds.On("GetTenantIDs", ctx).
+				Return([]string{"", tenantID}, tc.TenantIDsErr)
+			if tc.TenantIDsErr != nil {
+				goto execTest
+			}
+			ds.On("ResetStaleDevices", ctx, "", instanceIDs).
+				Return([]string{}, tc.ResetErr)
+			if tc.ResetErr != nil {
+				goto execTest
+			}
+			ds.On("FindSessions", matchTenant(""), model.SessionFilter{
+				Status: model.SessionStatusConnected,
+			}).Return(nil, int64(0), nil)
+			ds.On("ResetStaleDevices", ctx, tenantID, instanceIDs).
+				Return([]string{"stale"}, nil)
+			ds.On("FindSessions", matchTenant(tenantID), model.SessionFilter{
+				Status: model.SessionStatusConnected,
+			}).Return(sessions, int64(len(sessions)), tc.FindErr)
+			if tc.FindErr != nil {
+				goto execTest
+			}
+			ds.On("GetDevice", matchTenant(tenantID), tenantID, "connected").
+				Return(&model.Device{
+					ID:         "connected",
+					Status:     model.DeviceStatusConnected,
+					Generation: 2,
+				}, tc.GetDeviceErr)
+			if tc.GetDeviceErr != nil {
+				goto execTest
+			}
+			ds.On("GetDevice", matchTenant(tenantID), tenantID, "disconnected").
+				Return(&model.Device{
+					ID:     "disconnected",
+					Status: model.DeviceStatusDisconnected,
+				}, nil).Once()
+			if tc.CloseErr != nil {
+				ds.On("CloseSession", matchTenant(tenantID), sessions[1].ID, end).
+					Return(nil, tc.CloseErr)
+				goto execTest
+			}
+			ds.On("CloseSession", matchTenant(tenantID), sessions[1].ID, end).
+				Return(&sessions[1], nil)
+			ds.On("CloseSession", matchTenant(tenantID), sessions[2].ID, end).
+				Return(nil, store.ErrSessionNotFound)
+			ds.On("GetDevice", matchTenant(tenantID), tenantID, "deleted").
+				Return(nil, nil)
+			ds.On("CloseSession", matchTenant(tenantID), sessions[3].ID, end).
+				Return(&sessions[3], nil)
+			// the device reconnected since the session started
+			ds.On("CloseSession", matchTenant(tenantID), sessions[4].ID, end).
+				Return(&sessions[4], nil)
+
+		execTest:
+			// the orphaned sessions are audited as closed by the device
+			wf := new(wf_mocks.Client)
+			defer wf.AssertExpectations(t)
+			if tc.ExpectedError == nil {
+				for _, sess := range []model.Session{
+					sessions[1], sessions[3], sessions[4],
+				} {
+					sess := sess
+					wf.On("SubmitAuditLog", matchTenant(tenantID),
+						mock.MatchedBy(func(log workflows.AuditLog) bool {
+							return log.Object.ID == sess.ID &&
+								log.Action == workflows.ActionDelete &&
+								log.Change == "Terminal session "+
+									"closed after the device disconnected"
+						}),
+					).Return(nil)
+				}
+			}
+			var subjects []string
+			app := New(ds, nil, wf, Config{
+				HaveAuditLogs: true,
+				Publisher: publisherFunc(func(subject string, _ []byte) error {
+					subjects = append(subjects, subject)
+					return nil
+				}),
+			})
+			err := app.Reconcile(ctx, instanceIDs)
+			if tc.ExpectedError != nil {
+				assert.EqualError(t, err, tc.ExpectedError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.TenantIDsErr == nil && tc.ResetErr == nil {
+				// the stale devices are notified as disconnected
+				assert.Equal(t, []string{
+					model.GetDeviceStatusSubject(tenantID, "stale"),
+				}, subjects)
+			}
+		})
+	}
+}
+
+func TestRebuildSessionCounters(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	testCases := []struct {
+		Name string
+
+		TenantIDsErr  error
+		RebuildErr    error
+		ExpectedError error
+	}{{
+		Name: "ok",
+	}, {
+		Name:          "error, get tenants",
+		TenantIDsErr:  errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}, {
+		Name:          "error, rebuild session counters",
+		RebuildErr:    errors.New("store: internal error"),
+		ExpectedError: errors.New("store: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("GetTenantIDs", ctx).
+				Return([]string{"", tenantID}, tc.TenantIDsErr)
+			if tc.TenantIDsErr == nil {
+				ds.On("RebuildSessionCounters", ctx, "").
+					Return(tc.RebuildErr)
+			}
+			if tc.TenantIDsErr == nil && tc.RebuildErr == nil {
+				ds.On("RebuildSessionCounters", ctx, tenantID).
+					Return(nil)
+			}
+
+			app := New(ds, nil, nil)
+			err := app.RebuildSessionCounters(ctx)
+			if tc.ExpectedError != nil {
+				assert.EqualError(t, err, tc.ExpectedError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	ctx := context.Background()
+	settings := &model.TenantSettings{RecordSessions: true}
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetTenantSettings", ctx, tenantID).Return(settings, nil)
+	ds.On("UpsertTenantSettings", ctx, tenantID, settings).Return(nil)
+
+	app := New(ds, nil, nil)
+	res, err := app.GetTenantSettings(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, settings, res)
+
+	err = app.UpdateTenantSettings(ctx, tenantID, settings)
+	assert.NoError(t, err)
+}
+
+func TestUpdateTenantSettingsAuditLog(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	const userID = "00000000-0000-0000-0000-000000000001"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject: userID,
+		Tenant:  tenantID,
+		IsUser:  true,
+	})
+	settings := &model.TenantSettings{IdleTimeout: 10}
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("UpsertTenantSettings", ctx, tenantID, settings).Return(nil)
+
+	wf := new(wf_mocks.Client)
+	defer wf.AssertExpectations(t)
+	wf.On("SubmitAuditLog", ctx,
+		mock.MatchedBy(func(log workflows.AuditLog) bool {
+			return log.Action == workflows.ActionUpdate &&
+				log.Actor.ID == userID &&
+				log.Object.ID == tenantID &&
+				log.Object.Type == workflows.ObjectSettings &&
+				strings.Contains(log.Change, `"record_sessions":false`)
+		}),
+	).Return(nil).Once()
+	wf.On("SubmitAuditLog", ctx, mock.AnythingOfType("workflows.AuditLog")).
+		Return(errors.New("workflows: internal error")).Once()
+
+	app := New(ds, nil, wf, Config{HaveAuditLogs: true})
+	err := app.UpdateTenantSettings(ctx, tenantID, settings)
+	assert.NoError(t, err)
+	err = app.UpdateTenantSettings(ctx, tenantID, settings)
+	assert.EqualError(t, err, "failed to submit audit log for the settings: "+
+		"workflows: internal error")
+}
+
+func TestSessionLimits(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	defaults := model.SessionLimits{MaxPerDevice: 5, MaxPerUser: 10}
+	override := &model.SessionLimits{MaxPerDevice: 1, MaxPerTenant: 100}
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetSessionLimits", ctx, tenantID).Return(nil, nil).Once()
+	ds.On("GetSessionLimits", ctx, tenantID).Return(override, nil).Once()
+	ds.On("GetSessionLimits", ctx, tenantID).
+		Return(nil, errors.New("store: internal error")).Once()
+	ds.On("UpsertSessionLimits", ctx, tenantID, override).Return(nil)
+
+	app := New(ds, nil, nil, Config{SessionLimits: defaults})
+	limits, err := app.GetSessionLimits(ctx, tenantID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaults, *limits)
+	}
+	limits, err = app.GetSessionLimits(ctx, tenantID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, override, limits)
+	}
+	_, err = app.GetSessionLimits(ctx, tenantID)
+	assert.EqualError(t, err, "store: internal error")
+
+	err = app.UpdateSessionLimits(ctx, tenantID, override)
+	assert.NoError(t, err)
+}
+
+func TestConnectionEvents(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	const deviceID = "00000000-0000-0000-0000-000000000000"
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("InsertConnectionEvent", ctx, tenantID,
+		mock.MatchedBy(func(event *model.ConnectionEvent) bool {
+			return event.ID != "" &&
+				event.DeviceID == deviceID &&
+				event.InstanceID == "deviceconnect-1" &&
+				!event.Timestamp.IsZero()
+		}),
+	).Return(nil).Once()
+	ds.On("InsertConnectionEvent", ctx, tenantID,
+		mock.AnythingOfType("*model.ConnectionEvent"),
+	).Return(errors.New("store: internal error")).Once()
+
+	filter := model.ConnectionFilter{DeviceID: deviceID, Limit: 20}
+	events := []model.ConnectionEvent{{
+		ID:       "00000000-0000-0000-0000-000000000001",
+		DeviceID: deviceID,
+		Type:     model.ConnectionEventConnected,
+	}}
+	ds.On("FindConnectionEvents", ctx, tenantID, filter).
+		Return(events, int64(1), nil)
+
+	app := New(ds, nil, nil, Config{InstanceID: "deviceconnect-1"})
+	err := app.RecordConnectionEvent(ctx, tenantID, &model.ConnectionEvent{
+		DeviceID: deviceID,
+		Type:     model.ConnectionEventConnected,
+	})
+	assert.NoError(t, err)
+
+	err = app.RecordConnectionEvent(ctx, tenantID, &model.ConnectionEvent{
+		DeviceID: deviceID,
+		Type:     model.ConnectionEventDisconnected,
+	})
+	assert.EqualError(t, err, "store: internal error")
+
+	res, count, err := app.GetConnectionEvents(ctx, tenantID, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, events, res)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRecordSessionFrame(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	ctx := context.Background()
+	data := []byte("data")
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("InsertRecordingFrame", ctx,
+		mock.MatchedBy(func(frame *model.RecordingFrame) bool {
+			return frame.SessionID == sessionID &&
+				frame.Direction == model.RecordingDirectionOutput &&
+				!frame.Timestamp.IsZero() &&
+				string(frame.Data) == "data"
+		}),
+	).Return(nil).Once()
+	ds.On("InsertRecordingFrame", ctx,
+		mock.AnythingOfType("*model.RecordingFrame"),
+	).Return(errors.New("store: internal error")).Once()
+
+	app := New(ds, nil, nil)
+	err := app.RecordSessionFrame(
+		ctx, sessionID, model.RecordingDirectionOutput, data,
+	)
+	assert.NoError(t, err)
+
+	err = app.RecordSessionFrame(
+		ctx, sessionID, model.RecordingDirectionOutput, data,
+	)
+	assert.EqualError(t, err,
+		"failed to record session: store: internal error",
+	)
+}
+
+func TestGetSessionRecording(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	const userID = "00000000-0000-0000-0000-000000000001"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject: userID,
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	})
+	sess := &model.Session{
+		ID:       sessionID,
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		DeviceID: "00000000-0000-0000-0000-000000000003",
+		Recorded: true,
+	}
+	frames := []model.RecordingFrame{{
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Direction: model.RecordingDirectionOutput,
+		Data:      []byte("data"),
+	}}
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetRecordingFrames", ctx, sessionID).Return(frames, nil)
+
+	app := New(ds, nil, nil)
+
+	res, err := app.GetSessionRecording(ctx, sess)
+	assert.NoError(t, err)
+	assert.Equal(t, frames, res)
+
+	_, err = app.GetSessionRecording(ctx, &model.Session{ID: sessionID})
+	assert.Equal(t, ErrSessionNotRecorded, err)
+
+	wf := new(wf_mocks.Client)
+	defer wf.AssertExpectations(t)
+	wf.On("SubmitAuditLog", ctx,
+		mock.MatchedBy(func(log workflows.AuditLog) bool {
+			return log.Actor.ID == userID &&
+				log.Object.ID == sessionID &&
+				log.Object.Terminal.DeviceID == sess.DeviceID &&
+				strings.Contains(log.Change, sess.UserID)
+		}),
+	).Return(nil).Once()
+	wf.On("SubmitAuditLog", ctx, mock.AnythingOfType("workflows.AuditLog")).
+		Return(errors.New("workflows: internal error")).Once()
+
+	app = New(ds, nil, wf, Config{HaveAuditLogs: true})
+	res, err = app.GetSessionRecording(ctx, sess)
+	assert.NoError(t, err)
+	assert.Equal(t, frames, res)
+
+	_, err = app.GetSessionRecording(ctx, sess)
+	assert.EqualError(t, err,
+		"failed to submit audit log for the session recording: "+
+			"workflows: internal error",
+	)
+}
+
+func TestObserveSession(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	const userID = "00000000-0000-0000-0000-000000000001"
+	sess := &model.Session{
+		ID:       sessionID,
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		DeviceID: "00000000-0000-0000-0000-000000000003",
+	}
+	testCases := []struct {
+		Name string
+
+		HaveAuditLogs bool
+		StoreErr      error
+		WorkflowsErr  error
+
+		Erre error
+	}{{
+		Name: "ok",
+	}, {
+		Name: "ok, with audit logs",
+
+		HaveAuditLogs: true,
+	}, {
+		Name: "error, session not found",
+
+		StoreErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, SubmitAuditLog http error",
+
+		HaveAuditLogs: true,
+		WorkflowsErr:  errors.New("http error"),
+
+		Erre: errors.New(
+			"failed to submit audit log for session observer: http error",
+		),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			wf := new(wf_mocks.Client)
+			defer wf.AssertExpectations(t)
+
+			ds.On("AddSessionObserver", ctx, sessionID,
+				mock.MatchedBy(func(observer *model.SessionObserver) bool {
+					return observer.ID != "" &&
+						observer.UserID == userID &&
+						!observer.StartTS.IsZero()
+				}),
+			).Return(sess, tc.StoreErr)
+			if tc.HaveAuditLogs {
+				wf.On("SubmitAuditLog", ctx,
+					mock.MatchedBy(func(log workflows.AuditLog) bool {
+						return log.Action == workflows.ActionCreate &&
+							log.Actor.ID == userID &&
+							log.Object.ID == sessionID &&
+							log.Object.Terminal.DeviceID == sess.DeviceID
+					}),
+				).Return(tc.WorkflowsErr)
+			}
+			if tc.WorkflowsErr != nil {
+				ds.On("CloseSessionObserver", ctx, sessionID,
+					mock.AnythingOfType("string"),
+				).Return(sess, nil)
+			}
+
+			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			observer, err := app.ObserveSession(ctx, sessionID, userID)
+			if tc.Erre != nil {
+				assert.EqualError(t, err, tc.Erre.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, userID, observer.UserID)
+			}
+		})
+	}
+}
+
+func TestStopObservingSession(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	const observerID = "00000000-0000-0000-0000-000000000001"
+	now := time.Now()
+	sess := &model.Session{
+		ID:       sessionID,
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		DeviceID: "00000000-0000-0000-0000-000000000003",
+		Observers: []model.SessionObserver{{
+			ID:      observerID,
+			UserID:  "00000000-0000-0000-0000-000000000004",
+			StartTS: now.Add(-time.Minute),
+			EndTS:   &now,
+		}},
+	}
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	wf := new(wf_mocks.Client)
+	defer wf.AssertExpectations(t)
+	ds.On("CloseSessionObserver", ctx, sessionID, observerID).
+		Return(sess, nil).Once()
+	ds.On("CloseSessionObserver", ctx, sessionID, observerID).
+		Return(nil, store.ErrSessionNotFound).Once()
+	wf.On("SubmitAuditLog", ctx,
+		mock.MatchedBy(func(log workflows.AuditLog) bool {
+			return log.Action == workflows.ActionDelete &&
+				log.Actor.ID == "00000000-0000-0000-0000-000000000004"
+		}),
+	).Return(nil)
+
+	app := New(ds, nil, wf, Config{HaveAuditLogs: true})
+	err := app.StopObservingSession(ctx, sessionID, observerID)
+	assert.NoError(t, err)
+
+	err = app.StopObservingSession(ctx, sessionID, observerID)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
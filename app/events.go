@@ -0,0 +1,161 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/go-lib-micro/log"
+)
+
+// Publisher publishes messages for the other services, it is implemented by
+// the NATS client.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// deviceStatusChanged notifies the other services and the webhooks of the
+// status change of a device, if the status actually changed.
+func (a *app) deviceStatusChanged(
+	ctx context.Context,
+	tenantID, deviceID, oldStatus, newStatus string,
+) {
+	if oldStatus == newStatus {
+		return
+	}
+	event := &model.DeviceStatusEvent{
+		TenantID:   tenantID,
+		DeviceID:   deviceID,
+		OldStatus:  oldStatus,
+		NewStatus:  newStatus,
+		Timestamp:  time.Now().UTC(),
+		InstanceID: a.InstanceID,
+	}
+	a.publishDeviceStatus(ctx, event)
+	a.syncInventoryStatus(ctx, event)
+	switch newStatus {
+	case model.DeviceStatusConnected:
+		a.notifyWebhooks(ctx, tenantID,
+			model.WebhookEventDeviceConnected, event)
+	case model.DeviceStatusDisconnected:
+		a.notifyWebhooks(ctx, tenantID,
+			model.WebhookEventDeviceDisconnected, event)
+	}
+}
+
+// publishDeviceStatus publishes the status change of a device; the status
+// is already stored, a failure to publish is only logged.
+func (a *app) publishDeviceStatus(
+	ctx context.Context,
+	event *model.DeviceStatusEvent,
+) {
+	if a.Publisher == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = a.Publisher.Publish(
+			model.GetDeviceStatusSubject(event.TenantID, event.DeviceID),
+			data,
+		)
+	}
+	if err != nil {
+		log.FromContext(ctx).Errorf(
+			"failed to publish the status of the device %s: %s",
+			event.DeviceID, err.Error(),
+		)
+	}
+}
+
+// inventoryQueueSize is the number of status changes waiting to be pushed
+// to the inventory, beyond which the status changes are dropped.
+var inventoryQueueSize = 1024
+
+// inventoryUpdate is a status change waiting to be pushed to the inventory
+type inventoryUpdate struct {
+	logger *log.Logger
+	event  *model.DeviceStatusEvent
+}
+
+// syncInventoryStatus queues the status of the device to be pushed to the
+// inventory, so that the inventory never slows down the devices; a full
+// queue is only logged.
+func (a *app) syncInventoryStatus(
+	ctx context.Context,
+	event *model.DeviceStatusEvent,
+) {
+	if a.inventoryQueue == nil {
+		return
+	}
+	l := log.FromContext(ctx)
+	select {
+	case a.inventoryQueue <- inventoryUpdate{logger: l, event: event}:
+	default:
+		l.Errorf("failed to update the status of the device %s in the "+
+			"inventory: the queue is full", event.DeviceID)
+	}
+}
+
+// inventoryWorker pushes the queued status changes to the inventory, as
+// attributes of the deviceconnect scope, for the status to be usable in the
+// inventory searches and the dynamic groups. A single worker keeps the
+// status changes of a device in order; a failure is only logged.
+func (a *app) inventoryWorker() {
+	defer a.workers.Done()
+	for update := range a.inventoryQueue {
+		ctx := log.WithContext(context.Background(), update.logger)
+		a.updateInventoryStatus(ctx, update.event)
+	}
+}
+
+func (a *app) updateInventoryStatus(
+	ctx context.Context,
+	event *model.DeviceStatusEvent,
+) {
+	l := log.FromContext(ctx)
+	connected := event.NewStatus == model.DeviceStatusConnected
+	attrs := []model.DeviceAttribute{{
+		Name:  model.InventoryConnectedAttributeName,
+		Value: strconv.FormatBool(connected),
+		Scope: model.InventoryDeviceconnectScope,
+	}}
+	// the device may have been last heard from well before the status
+	// changed, e.g. when its presence lease expires
+	device, err := a.store.GetDevice(ctx, event.TenantID, event.DeviceID)
+	if err != nil {
+		l.Errorf("failed to look up the last seen time of the device %s: %s",
+			event.DeviceID, err.Error())
+	} else if device != nil && device.LastSeenTs != nil {
+		attrs = append(attrs, model.DeviceAttribute{
+			Name:  model.InventoryLastSeenAttributeName,
+			Value: device.LastSeenTs.UTC().Format(time.RFC3339),
+			Scope: model.InventoryDeviceconnectScope,
+		})
+	}
+	err = a.inventory.UpdateDeviceAttributes(ctx,
+		event.TenantID, event.DeviceID,
+		model.InventoryDeviceconnectScope, attrs,
+	)
+	if err != nil {
+		l.Errorf(
+			"failed to update the status of the device %s in the inventory: %s",
+			event.DeviceID, err.Error(),
+		)
+	}
+}
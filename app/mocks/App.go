@@ -18,6 +18,7 @@ package mocks
 
 import (
 	context "context"
+	time "time"
 
 	model "github.com/mendersoftware/deviceconnect/model"
 	mock "github.com/stretchr/testify/mock"
@@ -28,6 +29,46 @@ type App struct {
 	mock.Mock
 }
 
+// Close provides a mock function with given fields:
+func (_m *App) Close() {
+	_m.Called()
+}
+
+// ConnectDevice provides a mock function with given fields: ctx, tenantID, deviceID
+func (_m *App) ConnectDevice(ctx context.Context, tenantID string, deviceID string) (int64, error) {
+	ret := _m.Called(ctx, tenantID, deviceID)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) int64); ok {
+		r0 = rf(ctx, tenantID, deviceID)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, tenantID, deviceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateWebhook provides a mock function with given fields: ctx, tenantID, webhook
+func (_m *App) CreateWebhook(ctx context.Context, tenantID string, webhook *model.Webhook) error {
+	ret := _m.Called(ctx, tenantID, webhook)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.Webhook) error); ok {
+		r0 = rf(ctx, tenantID, webhook)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *App) DeleteDevice(ctx context.Context, tenantID string, deviceID string) error {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -42,13 +83,41 @@ func (_m *App) DeleteDevice(ctx context.Context, tenantID string, deviceID strin
 	return r0
 }
 
-// FreeUserSession provides a mock function with given fields: ctx, sessionID
-func (_m *App) FreeUserSession(ctx context.Context, sessionID string) error {
-	ret := _m.Called(ctx, sessionID)
+// DeleteWebhook provides a mock function with given fields: ctx, tenantID, webhookID
+func (_m *App) DeleteWebhook(ctx context.Context, tenantID string, webhookID string) error {
+	ret := _m.Called(ctx, tenantID, webhookID)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
-		r0 = rf(ctx, sessionID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, tenantID, webhookID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DisconnectDevice provides a mock function with given fields: ctx, tenantID, deviceID, generation
+func (_m *App) DisconnectDevice(ctx context.Context, tenantID string, deviceID string, generation int64) error {
+	ret := _m.Called(ctx, tenantID, deviceID, generation)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int64) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, generation)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// FreeUserSession provides a mock function with given fields: ctx, sessionID, end
+func (_m *App) FreeUserSession(ctx context.Context, sessionID string, end model.SessionEnd) error {
+	ret := _m.Called(ctx, sessionID, end)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.SessionEnd) error); ok {
+		r0 = rf(ctx, sessionID, end)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -56,6 +125,36 @@ func (_m *App) FreeUserSession(ctx context.Context, sessionID string) error {
 	return r0
 }
 
+// GetConnectionEvents provides a mock function with given fields: ctx, tenantID, filter
+func (_m *App) GetConnectionEvents(ctx context.Context, tenantID string, filter model.ConnectionFilter) ([]model.ConnectionEvent, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.ConnectionEvent
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.ConnectionFilter) []model.ConnectionEvent); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.ConnectionEvent)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.ConnectionFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.ConnectionFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *App) GetDevice(ctx context.Context, tenantID string, deviceID string) (*model.Device, error) {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -79,6 +178,204 @@ func (_m *App) GetDevice(ctx context.Context, tenantID string, deviceID string)
 	return r0, r1
 }
 
+// GetGroupsDevices provides a mock function with given fields: ctx, tenantID, groups
+func (_m *App) GetGroupsDevices(ctx context.Context, tenantID string, groups []string) ([]string, error) {
+	ret := _m.Called(ctx, tenantID, groups)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, string, []string) []string); ok {
+		r0 = rf(ctx, tenantID, groups)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, []string) error); ok {
+		r1 = rf(ctx, tenantID, groups)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSession provides a mock function with given fields: ctx, sessionID
+func (_m *App) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.Session); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSessionLimits provides a mock function with given fields: ctx, tenantID
+func (_m *App) GetSessionLimits(ctx context.Context, tenantID string) (*model.SessionLimits, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.SessionLimits
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.SessionLimits); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.SessionLimits)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSessionRecording provides a mock function with given fields: ctx, sess
+func (_m *App) GetSessionRecording(ctx context.Context, sess *model.Session) ([]model.RecordingFrame, error) {
+	ret := _m.Called(ctx, sess)
+
+	var r0 []model.RecordingFrame
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session) []model.RecordingFrame); ok {
+		r0 = rf(ctx, sess)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.RecordingFrame)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.Session) error); ok {
+		r1 = rf(ctx, sess)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSessions provides a mock function with given fields: ctx, filter
+func (_m *App) GetSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, model.SessionFilter) []model.Session); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Session)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, model.SessionFilter) int64); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, model.SessionFilter) error); ok {
+		r2 = rf(ctx, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// GetTenantSettings provides a mock function with given fields: ctx, tenantID
+func (_m *App) GetTenantSettings(ctx context.Context, tenantID string) (*model.TenantSettings, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.TenantSettings
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.TenantSettings); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.TenantSettings)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetWebhookDeliveries provides a mock function with given fields: ctx, tenantID, filter
+func (_m *App) GetWebhookDeliveries(ctx context.Context, tenantID string, filter model.WebhookDeliveryFilter) ([]model.WebhookDelivery, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.WebhookDelivery
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.WebhookDeliveryFilter) []model.WebhookDelivery); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.WebhookDelivery)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.WebhookDeliveryFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.WebhookDeliveryFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// GetWebhooks provides a mock function with given fields: ctx, tenantID
+func (_m *App) GetWebhooks(ctx context.Context, tenantID string) ([]model.Webhook, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 []model.Webhook
+	if rf, ok := ret.Get(0).(func(context.Context, string) []model.Webhook); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Webhook)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // HealthCheck provides a mock function with given fields: ctx
 func (_m *App) HealthCheck(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -93,6 +390,29 @@ func (_m *App) HealthCheck(ctx context.Context) error {
 	return r0
 }
 
+// ObserveSession provides a mock function with given fields: ctx, sessionID, userID
+func (_m *App) ObserveSession(ctx context.Context, sessionID string, userID string) (*model.SessionObserver, error) {
+	ret := _m.Called(ctx, sessionID, userID)
+
+	var r0 *model.SessionObserver
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *model.SessionObserver); ok {
+		r0 = rf(ctx, sessionID, userID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.SessionObserver)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, sessionID, userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PrepareUserSession provides a mock function with given fields: ctx, sess
 func (_m *App) PrepareUserSession(ctx context.Context, sess *model.Session) error {
 	ret := _m.Called(ctx, sess)
@@ -135,6 +455,62 @@ func (_m *App) ProvisionTenant(ctx context.Context, tenant *model.Tenant) error
 	return r0
 }
 
+// RebuildSessionCounters provides a mock function with given fields: ctx
+func (_m *App) RebuildSessionCounters(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Reconcile provides a mock function with given fields: ctx, instanceIDs
+func (_m *App) Reconcile(ctx context.Context, instanceIDs []string) error {
+	ret := _m.Called(ctx, instanceIDs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []string) error); ok {
+		r0 = rf(ctx, instanceIDs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RecordConnectionEvent provides a mock function with given fields: ctx, tenantID, event
+func (_m *App) RecordConnectionEvent(ctx context.Context, tenantID string, event *model.ConnectionEvent) error {
+	ret := _m.Called(ctx, tenantID, event)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.ConnectionEvent) error); ok {
+		r0 = rf(ctx, tenantID, event)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RecordSessionFrame provides a mock function with given fields: ctx, sessionID, direction, data
+func (_m *App) RecordSessionFrame(ctx context.Context, sessionID string, direction string, data []byte) error {
+	ret := _m.Called(ctx, sessionID, direction, data)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, []byte) error); ok {
+		r0 = rf(ctx, sessionID, direction, data)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // RemoteTerminalAllowed provides a mock function with given fields: ctx, tenantID, deviceID, groups
 func (_m *App) RemoteTerminalAllowed(ctx context.Context, tenantID string, deviceID string, groups []string) (bool, error) {
 	ret := _m.Called(ctx, tenantID, deviceID, groups)
@@ -156,6 +532,92 @@ func (_m *App) RemoteTerminalAllowed(ctx context.Context, tenantID string, devic
 	return r0, r1
 }
 
+// RenewDevicePresence provides a mock function with given fields: ctx, tenantID, deviceID, lease
+func (_m *App) RenewDevicePresence(ctx context.Context, tenantID string, deviceID string, lease time.Duration) error {
+	ret := _m.Called(ctx, tenantID, deviceID, lease)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Duration) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, lease)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SearchDevices provides a mock function with given fields: ctx, tenantID, filter
+func (_m *App) SearchDevices(ctx context.Context, tenantID string, filter model.DeviceFilter) ([]model.Device, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.Device
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.DeviceFilter) []model.Device); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Device)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.DeviceFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.DeviceFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// StopObservingSession provides a mock function with given fields: ctx, sessionID, observerID
+func (_m *App) StopObservingSession(ctx context.Context, sessionID string, observerID string) error {
+	ret := _m.Called(ctx, sessionID, observerID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, observerID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateDeviceCapabilities provides a mock function with given fields: ctx, tenantID, deviceID, capabilities
+func (_m *App) UpdateDeviceCapabilities(ctx context.Context, tenantID string, deviceID string, capabilities *model.DeviceCapabilities) error {
+	ret := _m.Called(ctx, tenantID, deviceID, capabilities)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, *model.DeviceCapabilities) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, capabilities)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateDeviceLastSeen provides a mock function with given fields: ctx, tenantID, deviceID
+func (_m *App) UpdateDeviceLastSeen(ctx context.Context, tenantID string, deviceID string) error {
+	ret := _m.Called(ctx, tenantID, deviceID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, tenantID, deviceID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UpdateDeviceStatus provides a mock function with given fields: ctx, tenantID, deviceID, status
 func (_m *App) UpdateDeviceStatus(ctx context.Context, tenantID string, deviceID string, status string) error {
 	ret := _m.Called(ctx, tenantID, deviceID, status)
@@ -169,3 +631,31 @@ func (_m *App) UpdateDeviceStatus(ctx context.Context, tenantID string, deviceID
 
 	return r0
 }
+
+// UpdateSessionLimits provides a mock function with given fields: ctx, tenantID, limits
+func (_m *App) UpdateSessionLimits(ctx context.Context, tenantID string, limits *model.SessionLimits) error {
+	ret := _m.Called(ctx, tenantID, limits)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.SessionLimits) error); ok {
+		r0 = rf(ctx, tenantID, limits)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateTenantSettings provides a mock function with given fields: ctx, tenantID, settings
+func (_m *App) UpdateTenantSettings(ctx context.Context, tenantID string, settings *model.TenantSettings) error {
+	ret := _m.Called(ctx, tenantID, settings)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.TenantSettings) error); ok {
+		r0 = rf(ctx, tenantID, settings)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+	"github.com/mendersoftware/go-lib-micro/log"
+)
+
+// webhookSecretSize is the number of random bytes of the secrets generated
+// for the webhooks registered without one.
+const webhookSecretSize = 24
+
+// webhookRecordTimeout is the time allowed to record a delivery interrupted
+// by the shutdown of the service.
+const webhookRecordTimeout = 5 * time.Second
+
+// CreateWebhook registers a webhook of the tenant, generating its secret
+// unless the tenant chose one.
+func (a *app) CreateWebhook(
+	ctx context.Context,
+	tenantID string,
+	webhook *model.Webhook,
+) error {
+	webhookID, err := uuid.NewRandom()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate webhook ID")
+	}
+	webhook.ID = webhookID.String()
+	if webhook.Secret == "" {
+		secret := make([]byte, webhookSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return errors.Wrap(err, "failed to generate webhook secret")
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	if err := webhook.Validate(); err != nil {
+		return errors.Wrap(err, "app: invalid webhook")
+	}
+	webhook.CreatedTs = time.Now().UTC()
+	return a.store.InsertWebhook(ctx, tenantID, webhook)
+}
+
+// GetWebhooks returns the webhooks of the tenant, without their secrets
+func (a *app) GetWebhooks(
+	ctx context.Context,
+	tenantID string,
+) ([]model.Webhook, error) {
+	webhooks, err := a.store.FindWebhooks(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook of the tenant
+func (a *app) DeleteWebhook(
+	ctx context.Context,
+	tenantID, webhookID string,
+) error {
+	err := a.store.DeleteWebhook(ctx, tenantID, webhookID)
+	if err == store.ErrWebhookNotFound {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook
+func (a *app) GetWebhookDeliveries(
+	ctx context.Context,
+	tenantID string,
+	filter model.WebhookDeliveryFilter,
+) ([]model.WebhookDelivery, int64, error) {
+	return a.store.FindWebhookDeliveries(ctx, tenantID, filter)
+}
+
+var (
+	// webhookWorkers is the number of events delivered concurrently
+	webhookWorkers = 8
+	// webhookQueueSize is the number of events waiting to be delivered,
+	// beyond which the events are dropped.
+	webhookQueueSize = 1024
+)
+
+// webhookJob is an event waiting to be delivered to the webhooks of a tenant
+type webhookJob struct {
+	logger   *log.Logger
+	tenantID string
+	event    *model.WebhookEvent
+	payload  []byte
+}
+
+// startWebhookWorkers starts the workers delivering the queued events; the
+// workers stop retrying the deliveries once shutdown is closed.
+func (a *app) startWebhookWorkers(shutdown <-chan struct{}) {
+	ctx := context.Background()
+	if shutdown != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		go func() {
+			<-shutdown
+			cancel()
+		}()
+	}
+	a.workers.Add(webhookWorkers)
+	for i := 0; i < webhookWorkers; i++ {
+		go a.webhookWorker(ctx)
+	}
+}
+
+// notifyWebhooks queues the event for the webhooks of the tenant subscribed
+// to it, so that the webhooks never slow down the devices and the sessions;
+// a full queue is only logged.
+func (a *app) notifyWebhooks(
+	ctx context.Context,
+	tenantID, eventType string,
+	data interface{},
+) {
+	if a.webhookQueue == nil {
+		return
+	}
+	l := log.FromContext(ctx)
+	eventID, err := uuid.NewRandom()
+	if err != nil {
+		l.Errorf("failed to generate webhook event ID: %s", err.Error())
+		return
+	}
+	event := &model.WebhookEvent{
+		ID:        eventID.String(),
+		Type:      eventType,
+		TenantID:  tenantID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	// the data may change once the caller returns
+	payload, err := json.Marshal(event)
+	if err != nil {
+		l.Errorf("failed to encode webhook event: %s", err.Error())
+		return
+	}
+
+	job := webhookJob{
+		logger:   l,
+		tenantID: tenantID,
+		event:    event,
+		payload:  payload,
+	}
+	select {
+	case a.webhookQueue <- job:
+	default:
+		l.Errorf("failed to queue the webhook event %s: the queue is full",
+			event.ID)
+	}
+}
+
+// webhookWorker delivers the queued events to the subscribed webhooks
+func (a *app) webhookWorker(ctx context.Context) {
+	defer a.workers.Done()
+	for job := range a.webhookQueue {
+		ctx := log.WithContext(ctx, job.logger)
+		webhooks, err := a.store.FindWebhooks(ctx, job.tenantID)
+		if err != nil {
+			job.logger.Errorf("failed to look up the webhooks: %s",
+				err.Error())
+			continue
+		}
+		for _, webhook := range webhooks {
+			if webhook.Subscribed(job.event.Type) {
+				a.deliverWebhook(ctx, job.tenantID, webhook,
+					job.event, job.payload)
+			}
+		}
+	}
+}
+
+// deliverWebhook posts the event to the webhook, retrying with an
+// exponential backoff as long as the failure may be transient and the
+// context is not canceled, and records the outcome in the delivery log of
+// the webhook.
+func (a *app) deliverWebhook(
+	ctx context.Context,
+	tenantID string,
+	webhook model.Webhook,
+	event *model.WebhookEvent,
+	payload []byte,
+) {
+	l := log.FromContext(ctx)
+	deliveryID, err := uuid.NewRandom()
+	if err != nil {
+		l.Errorf("failed to generate webhook delivery ID: %s", err.Error())
+		return
+	}
+	delivery := &model.WebhookDelivery{
+		ID:        deliveryID.String(),
+		WebhookID: webhook.ID,
+		EventID:   event.ID,
+		EventType: event.Type,
+	}
+	backoff := a.WebhookBackoff
+Loop:
+	for {
+		delivery.Attempts++
+		delivery.StatusCode, err = a.Webhooks.Deliver(
+			ctx, webhook, event.Type, payload,
+		)
+		if err == nil {
+			delivery.Status = model.WebhookDeliveryStatusDelivered
+			delivery.Error = ""
+			break
+		}
+		delivery.Status = model.WebhookDeliveryStatusFailed
+		delivery.Error = err.Error()
+		if delivery.Attempts >= a.WebhookMaxAttempts ||
+			!retryWebhookDelivery(delivery.StatusCode) {
+			l.Warnf("failed to deliver the event %s to the webhook %s: %s",
+				event.ID, webhook.ID, err.Error())
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			l.Warnf("gave up delivering the event %s to the webhook %s: %s",
+				event.ID, webhook.ID, ctx.Err().Error())
+			break Loop
+		}
+		backoff *= 2
+	}
+	delivery.Timestamp = time.Now().UTC()
+	if ctx.Err() != nil {
+		// record the outcome of the deliveries interrupted by the shutdown
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(
+			log.WithContext(context.Background(), l), webhookRecordTimeout,
+		)
+		defer cancel()
+	}
+	err = a.store.InsertWebhookDelivery(ctx, tenantID, delivery)
+	if err != nil {
+		l.Errorf("failed to record the webhook delivery: %s", err.Error())
+	}
+}
+
+// retryWebhookDelivery returns true if the delivery failed with a status
+// which may be transient, or without a response.
+func retryWebhookDelivery(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
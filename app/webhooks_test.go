@@ -0,0 +1,360 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	wh_mocks "github.com/mendersoftware/deviceconnect/client/webhooks/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	testCases := []struct {
+		Name    string
+		Webhook model.Webhook
+
+		InsertErr error
+
+		Secret      string
+		ValidateErr bool
+		Err         string
+	}{
+		{
+			Name: "ok, generated secret",
+			Webhook: model.Webhook{
+				URL:    "https://example.com/hooks",
+				Events: []string{model.WebhookEventDeviceConnected},
+			},
+		},
+		{
+			Name: "ok, chosen secret",
+			Webhook: model.Webhook{
+				URL:    "https://example.com/hooks",
+				Secret: "0123456789abcdef",
+				Events: []string{model.WebhookEventSessionEnded},
+			},
+			Secret: "0123456789abcdef",
+		},
+		{
+			Name: "error, plain HTTP",
+			Webhook: model.Webhook{
+				URL:    "http://example.com/hooks",
+				Events: []string{model.WebhookEventDeviceConnected},
+			},
+			ValidateErr: true,
+		},
+		{
+			Name: "error, unknown event",
+			Webhook: model.Webhook{
+				URL:    "https://example.com/hooks",
+				Events: []string{"device_exploded"},
+			},
+			ValidateErr: true,
+		},
+		{
+			Name: "error, short secret",
+			Webhook: model.Webhook{
+				URL:    "https://example.com/hooks",
+				Secret: "secret",
+				Events: []string{model.WebhookEventDeviceConnected},
+			},
+			ValidateErr: true,
+		},
+		{
+			Name: "error, store",
+			Webhook: model.Webhook{
+				URL:    "https://example.com/hooks",
+				Events: []string{model.WebhookEventDeviceConnected},
+			},
+			InsertErr: errors.New("store: internal error"),
+			Err:       "store: internal error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			if !tc.ValidateErr {
+				ds.On("InsertWebhook", ctx, tenantID,
+					mock.AnythingOfType("*model.Webhook"),
+				).Return(tc.InsertErr)
+			}
+
+			app := New(ds, nil, nil)
+			webhook := tc.Webhook
+			err := app.CreateWebhook(ctx, tenantID, &webhook)
+			if tc.ValidateErr {
+				_, ok := pkgerrors.Cause(err).(validation.Errors)
+				assert.True(t, ok, "unexpected error: %v", err)
+				return
+			} else if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotEmpty(t, webhook.ID)
+			assert.False(t, webhook.CreatedTs.IsZero())
+			if tc.Secret != "" {
+				assert.Equal(t, tc.Secret, webhook.Secret)
+			} else {
+				assert.Len(t, webhook.Secret, 2*webhookSecretSize)
+			}
+		})
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	const webhookID = "00000000-0000-0000-0000-000000000001"
+	ctx := context.Background()
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("FindWebhooks", ctx, tenantID).Return([]model.Webhook{{
+		ID:     webhookID,
+		URL:    "https://example.com/hooks",
+		Secret: "0123456789abcdef",
+		Events: []string{model.WebhookEventDeviceConnected},
+	}}, nil)
+	ds.On("DeleteWebhook", ctx, tenantID, webhookID).Return(nil).Once()
+	ds.On("DeleteWebhook", ctx, tenantID, webhookID).
+		Return(store.ErrWebhookNotFound).Once()
+	filter := model.WebhookDeliveryFilter{WebhookID: webhookID, Limit: 20}
+	deliveries := []model.WebhookDelivery{{
+		ID:        "00000000-0000-0000-0000-000000000002",
+		WebhookID: webhookID,
+		Status:    model.WebhookDeliveryStatusDelivered,
+	}}
+	ds.On("FindWebhookDeliveries", ctx, tenantID, filter).
+		Return(deliveries, int64(1), nil)
+
+	app := New(ds, nil, nil)
+	webhooks, err := app.GetWebhooks(ctx, tenantID)
+	if assert.NoError(t, err) && assert.Len(t, webhooks, 1) {
+		assert.Equal(t, webhookID, webhooks[0].ID)
+		assert.Empty(t, webhooks[0].Secret)
+	}
+
+	err = app.DeleteWebhook(ctx, tenantID, webhookID)
+	assert.NoError(t, err)
+	err = app.DeleteWebhook(ctx, tenantID, webhookID)
+	assert.Equal(t, ErrWebhookNotFound, err)
+
+	res, count, err := app.GetWebhookDeliveries(ctx, tenantID, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, deliveries, res)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	webhook := model.Webhook{
+		ID:     "00000000-0000-0000-0000-000000000001",
+		URL:    "https://example.com/hooks",
+		Secret: "0123456789abcdef",
+		Events: []string{model.WebhookEventSessionStarted},
+	}
+	event := &model.WebhookEvent{
+		ID:   "00000000-0000-0000-0000-000000000002",
+		Type: model.WebhookEventSessionStarted,
+	}
+	payload := []byte(`{"type":"session_started"}`)
+
+	testCases := []struct {
+		Name string
+
+		// StatusCodes are the responses of the webhook to the attempts
+		StatusCodes []int
+		// Shutdown interrupts the backoff before retrying
+		Shutdown bool
+
+		Status string
+	}{
+		{
+			Name:        "ok",
+			StatusCodes: []int{http.StatusOK},
+			Status:      model.WebhookDeliveryStatusDelivered,
+		},
+		{
+			Name: "ok, after retries",
+			StatusCodes: []int{
+				0,
+				http.StatusServiceUnavailable,
+				http.StatusNoContent,
+			},
+			Status: model.WebhookDeliveryStatusDelivered,
+		},
+		{
+			Name:        "error, not retried",
+			StatusCodes: []int{http.StatusNotFound},
+			Status:      model.WebhookDeliveryStatusFailed,
+		},
+		{
+			Name: "error, too many attempts",
+			StatusCodes: []int{
+				http.StatusTooManyRequests,
+				http.StatusRequestTimeout,
+				http.StatusInternalServerError,
+			},
+			Status: model.WebhookDeliveryStatusFailed,
+		},
+		{
+			Name:        "error, interrupted by the shutdown",
+			StatusCodes: []int{http.StatusServiceUnavailable},
+			Shutdown:    true,
+			Status:      model.WebhookDeliveryStatusFailed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			backoff := time.Millisecond
+			var recordCtx interface{} = ctx
+			if tc.Shutdown {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+				backoff = time.Minute
+				// the delivery is recorded with a new context
+				recordCtx = mock.MatchedBy(func(ctx context.Context) bool {
+					return ctx.Err() == nil
+				})
+			}
+			wh := new(wh_mocks.Client)
+			defer wh.AssertExpectations(t)
+			for _, statusCode := range tc.StatusCodes {
+				var err error
+				if statusCode < 200 || statusCode >= 300 {
+					err = errors.New("webhooks: failure")
+				}
+				wh.On("Deliver", ctx, webhook, event.Type, payload).
+					Return(statusCode, err).Once()
+			}
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("InsertWebhookDelivery", recordCtx, tenantID,
+				mock.MatchedBy(func(delivery *model.WebhookDelivery) bool {
+					last := tc.StatusCodes[len(tc.StatusCodes)-1]
+					return delivery.ID != "" &&
+						delivery.WebhookID == webhook.ID &&
+						delivery.EventID == event.ID &&
+						delivery.EventType == event.Type &&
+						delivery.Status == tc.Status &&
+						delivery.Attempts == len(tc.StatusCodes) &&
+						delivery.StatusCode == last &&
+						!delivery.Timestamp.IsZero()
+				}),
+			).Return(nil)
+
+			a := New(ds, nil, nil, Config{
+				Webhooks:           wh,
+				WebhookMaxAttempts: 3,
+				WebhookBackoff:     backoff,
+			}).(*app)
+			a.deliverWebhook(ctx, tenantID, webhook, event, payload)
+		})
+	}
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	subscribed := model.Webhook{
+		ID:     "00000000-0000-0000-0000-000000000001",
+		URL:    "https://example.com/hooks",
+		Secret: "0123456789abcdef",
+		Events: []string{model.WebhookEventDeviceConnected},
+	}
+	unsubscribed := model.Webhook{
+		ID:     "00000000-0000-0000-0000-000000000002",
+		URL:    "https://example.com/other",
+		Secret: "0123456789abcdef",
+		Events: []string{model.WebhookEventSessionEnded},
+	}
+
+	ds := new(store_mocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("SetDeviceConnected", mock.Anything, tenantID, deviceID,
+		mock.Anything).
+		Return(int64(1), model.DeviceStatusDisconnected, nil)
+	ds.On("FindWebhooks", mock.Anything, tenantID).
+		Return([]model.Webhook{subscribed, unsubscribed}, nil)
+	delivered := make(chan struct{})
+	ds.On("InsertWebhookDelivery", mock.Anything, tenantID,
+		mock.MatchedBy(func(delivery *model.WebhookDelivery) bool {
+			return delivery.WebhookID == subscribed.ID &&
+				delivery.Status == model.WebhookDeliveryStatusDelivered
+		}),
+	).Run(func(mock.Arguments) {
+		close(delivered)
+	}).Return(nil)
+
+	wh := new(wh_mocks.Client)
+	defer wh.AssertExpectations(t)
+	wh.On("Deliver", mock.Anything, subscribed,
+		model.WebhookEventDeviceConnected,
+		mock.MatchedBy(func(payload []byte) bool {
+			var event struct {
+				model.WebhookEvent
+				Data model.DeviceStatusEvent `json:"data"`
+			}
+			err := json.Unmarshal(payload, &event)
+			return err == nil &&
+				event.ID != "" &&
+				event.Type == model.WebhookEventDeviceConnected &&
+				event.TenantID == tenantID &&
+				event.Data.DeviceID == deviceID &&
+				event.Data.NewStatus == model.DeviceStatusConnected
+		}),
+	).Return(http.StatusOK, nil)
+
+	app := New(ds, nil, nil, Config{Webhooks: wh})
+	_, err := app.ConnectDevice(context.Background(), tenantID, deviceID)
+	assert.NoError(t, err)
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the event was not delivered")
+	}
+}
+
+func TestNotifyWebhooksQueueFull(t *testing.T) {
+	// without a worker draining the queue, the event is dropped
+	app := &app{
+		Config:       Config{Webhooks: new(wh_mocks.Client)},
+		webhookQueue: make(chan webhookJob),
+	}
+	app.notifyWebhooks(context.Background(), "",
+		model.WebhookEventDeviceConnected, nil)
+	assert.Len(t, app.webhookQueue, 0)
+}
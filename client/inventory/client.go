@@ -28,7 +28,8 @@ import (
 )
 
 const (
-	uriSearch = "/api/internal/v2/inventory/tenants/:id/filters/search"
+	uriSearch      = "/api/internal/v2/inventory/tenants/:id/filters/search"
+	uriUpdateAttrs = "/api/internal/v1/inventory/tenants/:id/device/:did/attribute/scope/:scope"
 )
 
 //go:generate ../../utils/mockgen.sh
@@ -37,6 +38,12 @@ type Client interface {
 		ctx context.Context,
 		tenantId string,
 		filter model.SearchParams) ([]model.InvDevice, int, error)
+	UpdateDeviceAttributes(
+		ctx context.Context,
+		tenantId string,
+		deviceId string,
+		scope string,
+		attrs []model.DeviceAttribute) error
 }
 
 type client struct {
@@ -93,3 +100,40 @@ func (c *client) Search(
 
 	return devs, totalCount, nil
 }
+
+// UpdateDeviceAttributes upserts the attributes of a device in the given
+// scope; the other attributes of the device are left untouched.
+func (c *client) UpdateDeviceAttributes(
+	ctx context.Context,
+	tenantId string,
+	deviceId string,
+	scope string,
+	attrs []model.DeviceAttribute) error {
+
+	l := log.FromContext(ctx)
+	l.Debugf("UpdateDeviceAttributes")
+
+	repl := strings.NewReplacer(":id", tenantId, ":did", deviceId, ":scope", scope)
+	url := c.uriBase + repl.Replace(uriUpdateAttrs)
+
+	payload, _ := json.Marshal(attrs)
+	req, err := http.NewRequestWithContext(ctx,
+		"PATCH", url, strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "update device attributes request failed")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < http.StatusOK || rsp.StatusCode >= 300 {
+		return errors.Errorf(
+			"update device attributes request failed with unexpected status %v",
+			rsp.StatusCode)
+	}
+	return nil
+}
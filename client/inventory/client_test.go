@@ -0,0 +1,99 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestUpdateDeviceAttributes(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		deviceID = "00000000-0000-0000-0000-000000000000"
+	)
+	attrs := []model.DeviceAttribute{{
+		Name:  model.InventoryConnectedAttributeName,
+		Value: "true",
+		Scope: model.InventoryDeviceconnectScope,
+	}}
+
+	testCases := []struct {
+		Name string
+
+		ResponseCode int
+		Closed       bool
+
+		Error string
+	}{{
+		Name: "ok",
+
+		ResponseCode: http.StatusOK,
+	}, {
+		Name: "error, device not found",
+
+		ResponseCode: http.StatusNotFound,
+		Error: "update device attributes request failed " +
+			"with unexpected status 404",
+	}, {
+		Name: "error, inventory unreachable",
+
+		Closed: true,
+		Error:  "update device attributes request failed",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, http.MethodPatch, r.Method)
+					assert.Equal(t,
+						"/api/internal/v1/inventory/tenants/"+tenantID+
+							"/device/"+deviceID+
+							"/attribute/scope/deviceconnect",
+						r.URL.Path,
+					)
+					var body []model.DeviceAttribute
+					err := json.NewDecoder(r.Body).Decode(&body)
+					assert.NoError(t, err)
+					assert.Equal(t, attrs, body)
+					w.WriteHeader(tc.ResponseCode)
+				},
+			))
+			defer srv.Close()
+			if tc.Closed {
+				srv.Close()
+			}
+
+			client := NewClient(srv.URL, 5)
+			err := client.UpdateDeviceAttributes(context.Background(),
+				tenantID, deviceID, model.InventoryDeviceconnectScope, attrs,
+			)
+			if tc.Error != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Error)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -19,9 +19,8 @@ package mocks
 import (
 	context "context"
 
-	mock "github.com/stretchr/testify/mock"
-
 	model "github.com/mendersoftware/deviceconnect/model"
+	mock "github.com/stretchr/testify/mock"
 )
 
 // Client is an autogenerated mock type for the Client type
@@ -58,3 +57,17 @@ func (_m *Client) Search(ctx context.Context, tenantId string, filter model.Sear
 
 	return r0, r1, r2
 }
+
+// UpdateDeviceAttributes provides a mock function with given fields: ctx, tenantId, deviceId, scope, attrs
+func (_m *Client) UpdateDeviceAttributes(ctx context.Context, tenantId string, deviceId string, scope string, attrs []model.DeviceAttribute) error {
+	ret := _m.Called(ctx, tenantId, deviceId, scope, attrs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, []model.DeviceAttribute) error); ok {
+		r0 = rf(ctx, tenantId, deviceId, scope, attrs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+const (
+	// HeaderEvent carries the type of the event posted to the webhook
+	HeaderEvent = "X-Deviceconnect-Event"
+	// HeaderTimestamp carries the time the event was posted, in seconds
+	// since the epoch, for the webhook to reject replayed events
+	HeaderTimestamp = "X-Deviceconnect-Timestamp"
+	// HeaderSignature carries the HMAC-SHA256 signature of the timestamp
+	// and the payload, as "<timestamp>.<payload>", keyed with the secret
+	// of the webhook, as "sha256=<hex digest>"
+	HeaderSignature = "X-Deviceconnect-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+const (
+	defaultTimeout = time.Duration(10) * time.Second
+)
+
+var (
+	// ErrForbiddenAddress is returned when the webhook resolves to a
+	// loopback, private or link-local address
+	ErrForbiddenAddress = errors.New(
+		"webhooks: the webhook address is not a public address",
+	)
+
+	// forbiddenNetworks are the networks the webhooks may not point to,
+	// on top of the loopback, link-local and multicast addresses
+	forbiddenNetworks = parseNetworks(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	)
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, networks[i], _ = net.ParseCIDR(cidr)
+	}
+	return networks
+}
+
+// publicIP returns true if the webhooks may connect to the address
+func publicIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl rejects the connections to the non-public addresses, once
+// the host name of the webhook is resolved, so that a host name resolving
+// to an internal address cannot be used to reach the internal services.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// noRedirect prevents the client from following the redirects, which could
+// lead the deliveries to the internal services.
+func noRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// Client is the webhooks client
+//go:generate ../../utils/mockgen.sh
+type Client interface {
+	Deliver(ctx context.Context, webhook model.Webhook, eventType string, payload []byte) (int, error)
+}
+
+type ClientOptions struct {
+	Client *http.Client
+}
+
+// NewClient returns a new webhooks client; by default, the client connects
+// to public addresses only, never through a proxy, whose address would be
+// checked instead of the address of the webhook. The redirects are never
+// followed.
+func NewClient(opts ...ClientOptions) Client {
+	// Initialize default options
+	var clientOpts = ClientOptions{
+		Client: &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				Proxy: nil,
+				DialContext: (&net.Dialer{
+					Timeout:   defaultTimeout,
+					KeepAlive: 30 * time.Second,
+					Control:   dialControl,
+				}).DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   defaultTimeout,
+				ExpectContinueTimeout: time.Second,
+			},
+		},
+	}
+	// Merge options
+	for _, opt := range opts {
+		if opt.Client != nil {
+			clientOpts.Client = opt.Client
+		}
+	}
+
+	c := &client{
+		client: *clientOpts.Client,
+	}
+	c.client.CheckRedirect = noRedirect
+	if c.client.Timeout == 0 {
+		c.client.Timeout = defaultTimeout
+	}
+	return c
+}
+
+type client struct {
+	client http.Client
+}
+
+// Sign returns the signature of the timestamp and the payload sent in the
+// HeaderSignature header
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	_, _ = mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts the signed payload to the webhook; it returns the HTTP
+// status of the response, zero if there was none, and an error unless the
+// status is a success.
+func (c *client) Deliver(
+	ctx context.Context,
+	webhook model.Webhook,
+	eventType string,
+	payload []byte,
+) (int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx,
+		"POST",
+		webhook.URL,
+		bytes.NewReader(payload),
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "webhooks: error preparing HTTP request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp := time.Now().Unix()
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, payload))
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "webhooks: failed to deliver the event")
+	}
+	defer rsp.Body.Close()
+	// drain the body to reuse the connection
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 4096))
+
+	if rsp.StatusCode >= http.StatusOK && rsp.StatusCode < 300 {
+		return rsp.StatusCode, nil
+	}
+	return rsp.StatusCode, errors.Errorf(
+		"webhooks: unexpected HTTP status from the webhook: %s",
+		rsp.Status,
+	)
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package webhooks
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '1609459200.{"type":"device_connected"}' |
+	//     openssl dgst -sha256 -hmac 0123456789abcdef
+	assert.Equal(t,
+		"sha256=20b3effbeec9c5a4b0966e6c5b7cbc362ace9e07009fc4ff9b8f95d3722aab2b",
+		Sign("0123456789abcdef", 1609459200,
+			[]byte(`{"type":"device_connected"}`)),
+	)
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte(`{"type":"device_connected"}`)
+	testCases := []struct {
+		Name string
+
+		ResponseCode int
+		Closed       bool
+		// DefaultClient uses the client restricted to public addresses
+		DefaultClient bool
+
+		StatusCode int
+		Error      string
+	}{{
+		Name: "ok",
+
+		ResponseCode: http.StatusNoContent,
+		StatusCode:   http.StatusNoContent,
+	}, {
+		Name: "error, webhook failure",
+
+		ResponseCode: http.StatusBadGateway,
+		StatusCode:   http.StatusBadGateway,
+		Error: "webhooks: unexpected HTTP status from the webhook: " +
+			"502 Bad Gateway",
+	}, {
+		Name: "error, redirect not followed",
+
+		ResponseCode: http.StatusFound,
+		StatusCode:   http.StatusFound,
+		Error: "webhooks: unexpected HTTP status from the webhook: " +
+			"302 Found",
+	}, {
+		Name: "error, webhook unreachable",
+
+		Closed: true,
+		Error:  "webhooks: failed to deliver the event",
+	}, {
+		Name: "error, loopback address",
+
+		DefaultClient: true,
+		Error:         ErrForbiddenAddress.Error(),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewTLSServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					assert.Equal(t, payload, body)
+					assert.Equal(t, "application/json",
+						r.Header.Get("Content-Type"))
+					assert.Equal(t, model.WebhookEventDeviceConnected,
+						r.Header.Get(HeaderEvent))
+					timestamp, err := strconv.ParseInt(
+						r.Header.Get(HeaderTimestamp), 10, 64,
+					)
+					assert.NoError(t, err)
+					assert.WithinDuration(t, time.Now(),
+						time.Unix(timestamp, 0), time.Minute)
+					assert.Equal(t,
+						Sign("0123456789abcdef", timestamp, payload),
+						r.Header.Get(HeaderSignature))
+					if tc.ResponseCode == http.StatusFound {
+						w.Header().Set("Location", "/internal")
+					}
+					w.WriteHeader(tc.ResponseCode)
+				},
+			))
+			defer srv.Close()
+			if tc.Closed {
+				srv.Close()
+			}
+
+			client := NewClient(ClientOptions{Client: srv.Client()})
+			if tc.DefaultClient {
+				client = NewClient()
+			}
+			statusCode, err := client.Deliver(context.Background(),
+				model.Webhook{
+					URL:    srv.URL + "/hooks/deviceconnect",
+					Secret: "0123456789abcdef",
+				},
+				model.WebhookEventDeviceConnected,
+				payload,
+			)
+			assert.Equal(t, tc.StatusCode, statusCode)
+			if tc.Error != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Error)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewClientNoProxy(t *testing.T) {
+	c := NewClient().(*client)
+	transport, ok := c.client.Transport.(*http.Transport)
+	if assert.True(t, ok) {
+		assert.Nil(t, transport.Proxy)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	testCases := map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::248": true,
+		"0.0.0.0":              false,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"100.64.0.1":           false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"224.0.0.1":            false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"::ffff:127.0.0.1":     false,
+	}
+	for addr, public := range testCases {
+		assert.Equal(t, public, publicIP(net.ParseIP(addr)), addr)
+	}
+}
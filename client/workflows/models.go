@@ -78,7 +78,10 @@ func (t Terminal) Validate() error {
 
 type ObjectType string
 
-const ObjectTerminal ObjectType = "terminal"
+const (
+	ObjectTerminal ObjectType = "terminal"
+	ObjectSettings ObjectType = "settings"
+)
 
 type Object struct {
 	ID   string     `json:"id"`
@@ -92,9 +95,11 @@ func (o Object) Validate() error {
 		validation.Field(&o.ID, validation.Required),
 		validation.Field(&o.Type,
 			validation.Required,
-			validation.In(ObjectTerminal),
+			validation.In(ObjectTerminal, ObjectSettings),
+		),
+		validation.Field(&o.Terminal,
+			validation.When(o.Type == ObjectTerminal, validation.Required),
 		),
-		validation.Field(&o.Terminal, validation.Required),
 	)
 	return err
 }
@@ -70,6 +70,12 @@ const (
 	// SettingInventoryTimeoutDefault is the default value for the inventory timeout
 	SettingInventoryTimeoutDefault = 10
 
+	// SettingInventoryStatusSync pushes the connected and last_seen
+	// attributes of the devices to the inventory when their status changes.
+	SettingInventoryStatusSync = "inventory_status_sync"
+	// SettingInventoryStatusSyncDefault is false.
+	SettingInventoryStatusSyncDefault = false
+
 	// SettingWorkflowsURL sets the base URL for the workflows orchestrator.
 	SettingWorkflowsURL = "workflows_url"
 	// SettingWorkflowsURLDefault sets the default workflows URL.
@@ -79,6 +85,98 @@ const (
 	SettingEnableAuditLogs = "enable_audit"
 	// SettingEnableAuditLogsDefault is disabled by default.
 	SettingEnableAuditLogsDefault = false
+
+	// SettingRecordingFailClosed stops the recorded sessions when the
+	// recording fails instead of only warning the user.
+	SettingRecordingFailClosed = "recording_fail_closed"
+	// SettingRecordingFailClosedDefault is disabled (fail-open) by default.
+	SettingRecordingFailClosedDefault = false
+
+	// SettingSessionGracePeriod is the number of seconds a terminal session
+	// waits for the user to reconnect after the websocket broke.
+	SettingSessionGracePeriod = "session_grace_period"
+	// SettingSessionGracePeriodDefault is the default grace period.
+	SettingSessionGracePeriodDefault = 30
+
+	// SettingSessionBufferSize is the maximum number of bytes of output
+	// buffered while a session waits for the user to reconnect.
+	SettingSessionBufferSize = "session_buffer_size"
+	// SettingSessionBufferSizeDefault is the default buffer size (64 KiB).
+	SettingSessionBufferSizeDefault = 65536
+
+	// SettingMaxSessionsPerDevice is the default maximum number of
+	// concurrent sessions of a device, 0 means unlimited.
+	SettingMaxSessionsPerDevice = "max_sessions_per_device"
+	// SettingMaxSessionsPerDeviceDefault is the default device limit.
+	SettingMaxSessionsPerDeviceDefault = 5
+
+	// SettingMaxSessionsPerUser is the default maximum number of
+	// concurrent sessions of a user, 0 means unlimited.
+	SettingMaxSessionsPerUser = "max_sessions_per_user"
+	// SettingMaxSessionsPerUserDefault is the default user limit.
+	SettingMaxSessionsPerUserDefault = 10
+
+	// SettingMaxSessionsPerTenant is the default maximum number of
+	// concurrent sessions of a tenant, 0 means unlimited.
+	SettingMaxSessionsPerTenant = "max_sessions_per_tenant"
+	// SettingMaxSessionsPerTenantDefault is unlimited by default.
+	SettingMaxSessionsPerTenantDefault = 0
+
+	// SettingDeviceLastSeenInterval is the minimum number of seconds
+	// between updates of the last seen time of a connected device.
+	SettingDeviceLastSeenInterval = "device_last_seen_interval"
+	// SettingDeviceLastSeenIntervalDefault is the default interval.
+	SettingDeviceLastSeenIntervalDefault = 30
+
+	// SettingDevicePresenceLease is the number of seconds a device is
+	// considered connected unless the instance holding the connection
+	// renews its presence lease.
+	SettingDevicePresenceLease = "device_presence_lease"
+	// SettingDevicePresenceLeaseDefault is the default lease (90 seconds).
+	SettingDevicePresenceLeaseDefault = 90
+
+	// SettingMaxMessageSize is the maximum size in bytes of the messages
+	// read from the websockets.
+	SettingMaxMessageSize = "max_message_size"
+	// SettingMaxMessageSizeDefault is the default limit (1 MiB).
+	SettingMaxMessageSizeDefault = 1048576
+
+	// SettingProtocolValidation is the validation mode of the messages
+	// read from the websockets: off, lenient or strict.
+	SettingProtocolValidation = "protocol_validation"
+	// SettingProtocolValidationDefault is lenient.
+	SettingProtocolValidationDefault = "lenient"
+
+	// SettingMaxProtocolViolations is the number of invalid messages
+	// after which a connection is closed in lenient mode.
+	SettingMaxProtocolViolations = "max_protocol_violations"
+	// SettingMaxProtocolViolationsDefault is 10.
+	SettingMaxProtocolViolationsDefault = 10
+
+	// SettingReconcileOnStartup disconnects the devices whose presence
+	// lease expired and closes their sessions when the server starts.
+	SettingReconcileOnStartup = "reconcile_on_startup"
+	// SettingReconcileOnStartupDefault is true.
+	SettingReconcileOnStartupDefault = true
+
+	// SettingInstanceID identifies this instance of the service in the
+	// connection history of the devices, defaults to the hostname; it
+	// must be unique among the running instances.
+	SettingInstanceID = "instance_id"
+	// SettingInstanceIDDefault is empty, i.e. the hostname.
+	SettingInstanceIDDefault = ""
+
+	// SettingWebhookMaxAttempts is the maximum number of attempts to
+	// deliver an event to a webhook.
+	SettingWebhookMaxAttempts = "webhook_max_attempts"
+	// SettingWebhookMaxAttemptsDefault is 5.
+	SettingWebhookMaxAttemptsDefault = 5
+
+	// SettingWebhookBackoff is the delay in seconds before retrying to
+	// deliver an event to a webhook, doubled after every attempt.
+	SettingWebhookBackoff = "webhook_backoff"
+	// SettingWebhookBackoffDefault is 2 seconds.
+	SettingWebhookBackoffDefault = 2
 )
 
 var (
@@ -93,7 +191,23 @@ var (
 		{Key: SettingDebugLog, Value: SettingDebugLogDefault},
 		{Key: SettingInventoryURI, Value: SettingInventoryURIDefault},
 		{Key: SettingInventoryTimeout, Value: SettingInventoryTimeoutDefault},
+		{Key: SettingInventoryStatusSync, Value: SettingInventoryStatusSyncDefault},
 		{Key: SettingWorkflowsURL, Value: SettingWorkflowsURLDefault},
 		{Key: SettingEnableAuditLogs, Value: SettingEnableAuditLogsDefault},
+		{Key: SettingRecordingFailClosed, Value: SettingRecordingFailClosedDefault},
+		{Key: SettingSessionGracePeriod, Value: SettingSessionGracePeriodDefault},
+		{Key: SettingSessionBufferSize, Value: SettingSessionBufferSizeDefault},
+		{Key: SettingMaxSessionsPerDevice, Value: SettingMaxSessionsPerDeviceDefault},
+		{Key: SettingMaxSessionsPerUser, Value: SettingMaxSessionsPerUserDefault},
+		{Key: SettingMaxSessionsPerTenant, Value: SettingMaxSessionsPerTenantDefault},
+		{Key: SettingDeviceLastSeenInterval, Value: SettingDeviceLastSeenIntervalDefault},
+		{Key: SettingDevicePresenceLease, Value: SettingDevicePresenceLeaseDefault},
+		{Key: SettingMaxMessageSize, Value: SettingMaxMessageSizeDefault},
+		{Key: SettingProtocolValidation, Value: SettingProtocolValidationDefault},
+		{Key: SettingMaxProtocolViolations, Value: SettingMaxProtocolViolationsDefault},
+		{Key: SettingReconcileOnStartup, Value: SettingReconcileOnStartupDefault},
+		{Key: SettingInstanceID, Value: SettingInstanceIDDefault},
+		{Key: SettingWebhookMaxAttempts, Value: SettingWebhookMaxAttemptsDefault},
+		{Key: SettingWebhookBackoff, Value: SettingWebhookBackoffDefault},
 	}
 )
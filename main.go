@@ -15,12 +15,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/nats-io/nats.go"
 	"github.com/urfave/cli"
 
 	dconfig "github.com/mendersoftware/deviceconnect/config"
@@ -63,6 +65,20 @@ func doMain(args []string) {
 				Usage:  "Run the migrations",
 				Action: cmdMigrate,
 			},
+			{
+				Name: "reconcile",
+				Usage: "Disconnect the stale devices, close " +
+					"their sessions and rebuild the session counters",
+				Action: cmdReconcile,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name: "instance",
+						Usage: "ID of an instance of the service " +
+							"which no longer exists, " +
+							"can be repeated.",
+					},
+				},
+			},
 		},
 	}
 	app.Usage = "Device Connect"
@@ -100,6 +116,35 @@ func cmdServer(args *cli.Context) error {
 	return server.InitAndRun(config.Config, dataStore)
 }
 
+func cmdReconcile(args *cli.Context) error {
+	dataStore, err := store.SetupDataStore(false)
+	if err != nil {
+		return err
+	}
+	defer dataStore.Close()
+	natsClient, err := nats.Connect(
+		config.Config.GetString(dconfig.SettingNatsURI),
+	)
+	if err != nil {
+		return err
+	}
+	defer natsClient.Close()
+	deviceConnectApp, err := server.NewApp(
+		config.Config, dataStore, natsClient, nil,
+	)
+	if err != nil {
+		return err
+	}
+	// the status changes of the devices are notified in the background
+	defer deviceConnectApp.Close()
+	ctx := context.Background()
+	err = deviceConnectApp.Reconcile(ctx, args.StringSlice("instance"))
+	if err != nil {
+		return err
+	}
+	return deviceConnectApp.RebuildSessionCounters(ctx)
+}
+
 func cmdMigrate(args *cli.Context) error {
 	_, err := store.SetupDataStore(true)
 	if err != nil {
@@ -0,0 +1,75 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// Values for the connection event type attribute
+const (
+	ConnectionEventConnected    = "connected"
+	ConnectionEventDisconnected = "disconnected"
+)
+
+// Values for the disconnect reason attribute of the connection events
+const (
+	// DisconnectReasonClosed: the device closed the websocket
+	DisconnectReasonClosed = "closed"
+	// DisconnectReasonLost: the connection broke without closing handshake
+	DisconnectReasonLost = "lost"
+	// DisconnectReasonTimeout: the device did not answer the pings
+	DisconnectReasonTimeout = "timeout"
+	// DisconnectReasonError: the connection was closed on error
+	DisconnectReasonError = "error"
+	// DisconnectReasonReplaced: a newer connection of the device took over
+	DisconnectReasonReplaced = "replaced"
+)
+
+// ConnectionEvent is an entry of the connection history of a device
+type ConnectionEvent struct {
+	ID         string    `json:"id" bson:"_id"`
+	DeviceID   string    `json:"device_id" bson:"device_id"`
+	Type       string    `json:"type" bson:"type"`
+	Timestamp  time.Time `json:"ts" bson:"ts"`
+	RemoteAddr string    `json:"remote_address,omitempty" bson:"remote_address,omitempty"`
+	InstanceID string    `json:"instance_id,omitempty" bson:"instance_id,omitempty"`
+
+	// Reason and Error are set on disconnection
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+func (e ConnectionEvent) Validate() error {
+	return validation.ValidateStruct(&e,
+		validation.Field(&e.ID, validation.Required),
+		validation.Field(&e.DeviceID, validation.Required),
+		validation.Field(&e.Timestamp, validation.Required),
+		validation.Field(&e.Type, validation.Required, validation.In(
+			ConnectionEventConnected, ConnectionEventDisconnected,
+		)),
+	)
+}
+
+// ConnectionFilter contains the pagination parameters used when looking up
+// the connection events of a device; the events are sorted by time,
+// newest first.
+type ConnectionFilter struct {
+	DeviceID string
+	Skip     int64
+	Limit    int64
+}
@@ -14,7 +14,11 @@
 
 package model
 
-import "time"
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
 
 // Values for the device status attribute
 const (
@@ -23,10 +27,136 @@ const (
 	DeviceStatusUnknown      = "unknown"
 )
 
+// Protocols advertised by the devices in their capabilities
+const (
+	ProtocolShell        = "shell"
+	ProtocolFileTransfer = "file_transfer"
+	ProtocolPortForward  = "port_forward"
+)
+
+// maxCapabilities is the maximum number of entries of each list of the
+// device capabilities.
+const maxCapabilities = 32
+
+// maxDeviceFilterIDs is the maximum number of device IDs of a search
+const maxDeviceFilterIDs = 10000
+
 // Device represents a device and its attributes
-type Device struct {
+type Device struct { //nolint:lll
 	ID        string    `json:"device_id" bson:"_id"`
 	Status    string    `json:"status" bson:"status"`
 	CreatedTs time.Time `json:"created_ts" bson:"created_ts,omitempty"`
 	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+	// LastSeenTs is the last time the device was heard from, nil if the
+	// device never connected
+	LastSeenTs *time.Time `json:"last_seen_ts,omitempty" bson:"last_seen_ts,omitempty"`
+
+	// InstanceID is the instance of the service holding the connection
+	// with the device until it disconnects, renewing the presence lease
+	// until LeaseExpiresTs.
+	InstanceID     string    `json:"-" bson:"instance_id,omitempty"`
+	LeaseExpiresTs time.Time `json:"-" bson:"lease_expires_ts,omitempty"`
+
+	// Generation is incremented every time the device connects, only the
+	// latest connection of the device updates its status.
+	Generation int64 `json:"-" bson:"generation,omitempty"`
+
+	// Capabilities are advertised by the device after connecting, nil if
+	// the device did not advertise them during its current connection.
+	Capabilities *DeviceCapabilities `json:"capabilities,omitempty" bson:"capabilities,omitempty"`
+}
+
+// DeviceStatusEvent is published every time the status of a device changes
+type DeviceStatusEvent struct {
+	TenantID  string    `json:"tenant_id"`
+	DeviceID  string    `json:"device_id"`
+	OldStatus string    `json:"old_status,omitempty"`
+	NewStatus string    `json:"new_status"`
+	Timestamp time.Time `json:"ts"`
+	// InstanceID is the instance of the service which changed the status
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// DeviceCapabilities are the features of the agent running on the device
+type DeviceCapabilities struct { //nolint:lll
+	AgentVersion     string    `json:"agent_version,omitempty" bson:"agent_version,omitempty" msgpack:"agent_version,omitempty"`
+	Protocols        []string  `json:"protocols" bson:"protocols" msgpack:"protocols"`
+	Shells           []string  `json:"shells,omitempty" bson:"shells,omitempty" msgpack:"shells,omitempty"`
+	TerminalFeatures []string  `json:"terminal_features,omitempty" bson:"terminal_features,omitempty" msgpack:"terminal_features,omitempty"`
+	UpdatedTs        time.Time `json:"updated_ts" bson:"updated_ts" msgpack:"-"`
+}
+
+func (c DeviceCapabilities) Validate() error {
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.AgentVersion, validation.Length(0, 64)),
+		validation.Field(&c.Protocols,
+			validation.Required,
+			validation.Length(0, maxCapabilities),
+			validation.Each(validation.Required, validation.Length(0, 64)),
+		),
+		validation.Field(&c.Shells,
+			validation.Length(0, maxCapabilities),
+			validation.Each(validation.Required, validation.Length(0, 256)),
+		),
+		validation.Field(&c.TerminalFeatures,
+			validation.Length(0, maxCapabilities),
+			validation.Each(validation.Required, validation.Length(0, 64)),
+		),
+	)
+}
+
+// SupportsProtocol returns true if the device advertised the protocol; the
+// devices which did not advertise their capabilities support only the
+// remote terminal.
+func (d *Device) SupportsProtocol(protocol string) bool {
+	if d.Capabilities == nil {
+		return protocol == ProtocolShell
+	}
+	for _, p := range d.Capabilities.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// PresenceExpired returns true if the device is reported connected by an
+// instance of the service which stopped renewing the presence lease.
+func (d *Device) PresenceExpired(now time.Time) bool {
+	return d.Status == DeviceStatusConnected &&
+		!d.LeaseExpiresTs.IsZero() &&
+		now.After(d.LeaseExpiresTs)
+}
+
+// DeviceFilter contains the search parameters of the devices and the
+// pagination parameters.
+type DeviceFilter struct {
+	// IDs restricts the search to the given devices
+	IDs []string `json:"device_ids,omitempty"`
+	// Status restricts the search to the devices with the given status,
+	// taking the presence lease of the connected devices into account.
+	Status string `json:"status,omitempty"`
+
+	// Sort is the sort order on updated_ts; the devices are sorted by ID
+	// if it is empty.
+	Sort  string `json:"-"`
+	Skip  int64  `json:"-"`
+	Limit int64  `json:"-"`
+}
+
+func (f DeviceFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.IDs,
+			validation.Length(0, maxDeviceFilterIDs),
+			validation.Each(validation.Required),
+		),
+		validation.Field(&f.Status, validation.In(
+			DeviceStatusConnected,
+			DeviceStatusDisconnected,
+			DeviceStatusUnknown,
+		)),
+		validation.Field(&f.Sort, validation.In(
+			SortAscending, SortDescending,
+		)),
+	)
 }
@@ -23,6 +23,16 @@ const (
 	InventoryGroupAttributeName = "group"
 )
 
+// Attributes of the devices pushed to the inventory by deviceconnect; the
+// inventory only stores strings and numbers, connected is "true" or "false"
+// and last_seen is the RFC3339 timestamp of the last time the device was
+// heard from, not pushed for the devices never heard from.
+const (
+	InventoryDeviceconnectScope     = "deviceconnect"
+	InventoryConnectedAttributeName = "connected"
+	InventoryLastSeenAttributeName  = "last_seen"
+)
+
 type DeviceAttribute struct {
 	Name        string      `json:"name" bson:",omitempty"`
 	Description *string     `json:"description,omitempty" bson:",omitempty"`
@@ -0,0 +1,35 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// SessionLimits holds the maximum number of concurrent sessions per device,
+// per user and per tenant; zero means unlimited.
+type SessionLimits struct {
+	MaxPerDevice int `json:"max_sessions_per_device" bson:"max_sessions_per_device"`
+	MaxPerUser   int `json:"max_sessions_per_user" bson:"max_sessions_per_user"`
+	MaxPerTenant int `json:"max_sessions_per_tenant" bson:"max_sessions_per_tenant"`
+}
+
+func (l SessionLimits) Validate() error {
+	return validation.ValidateStruct(&l,
+		validation.Field(&l.MaxPerDevice, validation.Min(0)),
+		validation.Field(&l.MaxPerUser, validation.Min(0)),
+		validation.Field(&l.MaxPerTenant, validation.Min(0)),
+	)
+}
@@ -16,4 +16,8 @@ package model
 
 const (
 	RBACHeaderRemoteTerminalGroups = "X-MEN-RBAC-Remote-Terminal-Groups"
+	RBACHeaderRoles                = "X-MEN-RBAC-Roles"
 )
+
+// RBACRoleAdmin is the role of the users with full access to the tenant
+const RBACRoleAdmin = "RBAC_ROLE_PERMIT_ALL"
@@ -0,0 +1,32 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import "time"
+
+// Values for the direction of a recorded frame
+const (
+	RecordingDirectionInput  = "input"
+	RecordingDirectionOutput = "output"
+)
+
+// RecordingFrame is a message relayed during a recorded session, Data holds
+// the msgpack encoded ws.ProtoMsg as it was relayed.
+type RecordingFrame struct {
+	SessionID string    `json:"session_id" bson:"session_id"`
+	Timestamp time.Time `json:"ts" bson:"ts"`
+	Direction string    `json:"direction" bson:"direction"`
+	Data      []byte    `json:"data" bson:"data"`
+}
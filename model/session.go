@@ -15,6 +15,7 @@
 package model
 
 import (
+	"errors"
 	"strings"
 	"time"
 
@@ -24,7 +25,18 @@ import (
 // Values for the session status attribute
 const (
 	SessionStatusDisconnected = "disconnected"
-	SessiontatusConnected     = "connected"
+	SessionStatusConnected    = "connected"
+)
+
+// Values for the session close reason attribute
+const (
+	SessionCloseReasonUserDisconnect   = "user_disconnect"
+	SessionCloseReasonDeviceDisconnect = "device_disconnect"
+	SessionCloseReasonTerminated       = "terminated"
+	SessionCloseReasonTimeout          = "timeout"
+	SessionCloseReasonRecordingFailed  = "recording_failed"
+	SessionCloseReasonIdleTimeout      = "idle_timeout"
+	SessionCloseReasonMaxDuration      = "max_duration"
 )
 
 func GetSessionSubject(tenantID, sessionID string) string {
@@ -40,6 +52,12 @@ func GetSessionSubject(tenantID, sessionID string) string {
 	}, ".")
 }
 
+// GetSessionResumeSubject returns the subject used to hand a suspended
+// session over to the handler re-attaching the user.
+func GetSessionResumeSubject(tenantID, sessionID string) string {
+	return GetSessionSubject(tenantID, sessionID) + ".resume"
+}
+
 func GetDeviceSubject(tenantID, deviceID string) string {
 	if tenantID == "" {
 		return strings.Join([]string{
@@ -54,24 +72,144 @@ func GetDeviceSubject(tenantID, deviceID string) string {
 	}, ".")
 }
 
+// GetDeviceControlSubject returns the subject used to notify the websocket
+// connections of a device that a newer connection took over.
+func GetDeviceControlSubject(tenantID, deviceID string) string {
+	return GetDeviceSubject(tenantID, deviceID) + ".control"
+}
+
+// GetDeviceStatusSubject returns the subject the status changes of a device
+// are published on, for the other services to subscribe to, for instance
+// with the "device-status.>" wildcard; the subject does not share the prefix
+// of the device subjects, which carry the messages for the devices.
+func GetDeviceStatusSubject(tenantID, deviceID string) string {
+	if tenantID == "" {
+		return strings.Join([]string{
+			"device-status",
+			deviceID,
+		}, ".")
+	}
+	return strings.Join([]string{
+		"device-status",
+		tenantID,
+		deviceID,
+	}, ".")
+}
+
 // Session represents a session from a user to a device and its attributes
 type Session struct {
 	ID       string    `json:"id" bson:"_id"`
 	UserID   string    `json:"user_id" bson:"user_id"`
 	DeviceID string    `json:"device_id" bson:"device_id"`
+	Status   string    `json:"status" bson:"status"`
 	StartTS  time.Time `json:"start_ts" bson:"start_ts"`
 	TenantID string    `json:"tenant_id" bson:"-"`
+
+	// EndTS, Duration (in seconds) and CloseReason are set
+	// when the session is closed.
+	EndTS       *time.Time `json:"end_ts,omitempty" bson:"end_ts,omitempty"`
+	Duration    float64    `json:"duration,omitempty" bson:"duration,omitempty"`
+	CloseReason string     `json:"close_reason,omitempty" bson:"close_reason,omitempty"`
+
+	BytesToDevice   int64 `json:"bytes_to_device" bson:"bytes_to_device"`
+	BytesFromDevice int64 `json:"bytes_from_device" bson:"bytes_from_device"`
+
+	// Recorded is set if the session is recorded
+	Recorded bool `json:"recorded" bson:"recorded"`
+
+	// IdleTimeout and MaxDuration are the limits in minutes applying to
+	// the session, taken from the tenant settings when the session starts.
+	IdleTimeout int `json:"idle_timeout,omitempty" bson:"idle_timeout,omitempty"`
+	MaxDuration int `json:"max_duration,omitempty" bson:"max_duration,omitempty"`
+
+	// Observers are the users watching the session in read-only mode
+	Observers []SessionObserver `json:"observers,omitempty" bson:"observers,omitempty"`
+
+	// DeviceGeneration is the connection generation of the device when the
+	// session started; the session does not survive a new connection.
+	DeviceGeneration int64 `json:"-" bson:"device_generation,omitempty"`
+}
+
+// SessionObserver is a user attached to a session in read-only mode, EndTS
+// is set when the observer detaches.
+type SessionObserver struct {
+	ID      string     `json:"id" bson:"id"`
+	UserID  string     `json:"user_id" bson:"user_id"`
+	StartTS time.Time  `json:"start_ts" bson:"start_ts"`
+	EndTS   *time.Time `json:"end_ts,omitempty" bson:"end_ts,omitempty"`
+}
+
+// SessionEnd describes how a session ended
+type SessionEnd struct {
+	Reason          string
+	BytesToDevice   int64
+	BytesFromDevice int64
 }
 
 func (sess Session) Subject(tenantID string) string {
 	return GetSessionSubject(tenantID, sess.ID)
 }
 
+func (sess Session) ResumeSubject(tenantID string) string {
+	return GetSessionResumeSubject(tenantID, sess.ID)
+}
+
 func (sess Session) Validate() error {
 	return validation.ValidateStruct(&sess,
 		validation.Field(&sess.ID, validation.Required),
 		validation.Field(&sess.UserID, validation.Required),
 		validation.Field(&sess.DeviceID, validation.Required),
 		validation.Field(&sess.StartTS, validation.Required),
+		validation.Field(&sess.Status, validation.In(
+			SessionStatusConnected, SessionStatusDisconnected,
+		)),
 	)
 }
+
+// Values for the sort order of session lookups
+const (
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+// SessionFilter contains the filter and pagination parameters used when
+// looking up sessions.
+type SessionFilter struct {
+	UserID      string
+	DeviceID    string
+	Status      string
+	StartTsFrom *time.Time
+	StartTsTo   *time.Time
+
+	// DeviceIDs restricts the sessions to the ones of the given devices,
+	// if not nil; an empty list matches no session.
+	DeviceIDs []string
+
+	// Sort is the sort order on start_ts, defaults to SortDescending.
+	Sort  string
+	Skip  int64
+	Limit int64
+}
+
+func (f SessionFilter) Validate() error {
+	err := validation.ValidateStruct(&f,
+		validation.Field(&f.Status, validation.In(
+			SessionStatusConnected, SessionStatusDisconnected,
+		)),
+		validation.Field(&f.Sort, validation.In(
+			SortAscending, SortDescending,
+		)),
+		validation.Field(&f.Skip, validation.Min(int64(0))),
+		validation.Field(&f.Limit, validation.Min(int64(0))),
+	)
+	if err != nil {
+		return err
+	}
+	if f.StartTsFrom != nil && f.StartTsTo != nil &&
+		f.StartTsTo.Before(*f.StartTsFrom) {
+		return validation.Errors{
+			"start_ts_to": errors.New("must not be before start_ts_from"),
+		}
+	}
+	return nil
+}
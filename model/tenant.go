@@ -14,7 +14,30 @@
 
 package model
 
+import (
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
 // Tenant represents a new tenant
 type Tenant struct {
 	TenantID string `json:"tenant_id"`
 }
+
+// TenantSettings holds the configuration of a tenant
+type TenantSettings struct {
+	// RecordSessions enables the recording of the terminal sessions
+	RecordSessions bool `json:"record_sessions" bson:"record_sessions"`
+	// IdleTimeout is the number of minutes without user input after which
+	// a terminal session is closed, zero disables the timeout.
+	IdleTimeout int `json:"idle_timeout" bson:"idle_timeout"`
+	// MaxSessionDuration is the maximum duration of a terminal session in
+	// minutes, zero disables the limit.
+	MaxSessionDuration int `json:"max_session_duration" bson:"max_session_duration"`
+}
+
+func (s TenantSettings) Validate() error {
+	return validation.ValidateStruct(&s,
+		validation.Field(&s.IdleTimeout, validation.Min(0)),
+		validation.Field(&s.MaxSessionDuration, validation.Min(0)),
+	)
+}
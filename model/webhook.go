@@ -0,0 +1,122 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// Events the webhooks subscribe to
+const (
+	WebhookEventDeviceConnected    = "device_connected"
+	WebhookEventDeviceDisconnected = "device_disconnected"
+	WebhookEventSessionStarted     = "session_started"
+	WebhookEventSessionEnded       = "session_ended"
+)
+
+// Values for the status of the webhook deliveries
+const (
+	WebhookDeliveryStatusDelivered = "delivered"
+	WebhookDeliveryStatusFailed    = "failed"
+)
+
+// minWebhookSecretLength is the minimum length of the secrets chosen by the
+// tenants to sign the webhook payloads.
+const minWebhookSecretLength = 16
+
+// Webhook is an HTTPS endpoint of a tenant called on the subscribed events;
+// the payloads are signed with the secret, which is never returned once the
+// webhook is registered.
+type Webhook struct {
+	ID        string    `json:"id" bson:"_id"`
+	URL       string    `json:"url" bson:"url"`
+	Secret    string    `json:"secret,omitempty" bson:"secret"`
+	Events    []string  `json:"events" bson:"events"`
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
+}
+
+func (w Webhook) Validate() error {
+	return validation.ValidateStruct(&w,
+		validation.Field(&w.URL, validation.Required,
+			validation.By(validateHTTPSURL)),
+		validation.Field(&w.Secret, validation.Required,
+			validation.Length(minWebhookSecretLength, 256)),
+		validation.Field(&w.Events, validation.Required,
+			validation.Each(validation.In(
+				WebhookEventDeviceConnected,
+				WebhookEventDeviceDisconnected,
+				WebhookEventSessionStarted,
+				WebhookEventSessionEnded,
+			))),
+	)
+}
+
+// Subscribed returns true if the webhook is called on the event
+func (w Webhook) Subscribed(eventType string) bool {
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHTTPSURL(value interface{}) error {
+	s, _ := value.(string)
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.New("must be a valid URL")
+	} else if u.Scheme != "https" || u.Host == "" {
+		return errors.New("must be an HTTPS URL")
+	}
+	return nil
+}
+
+// WebhookEvent is the payload posted to the webhooks; Data holds the device
+// status change or the session the event is about.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	TenantID  string      `json:"tenant_id"`
+	Timestamp time.Time   `json:"ts"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is an entry of the delivery log of a webhook, recording
+// the outcome of the delivery of an event after all the attempts.
+type WebhookDelivery struct {
+	ID         string    `json:"id" bson:"_id"`
+	WebhookID  string    `json:"webhook_id" bson:"webhook_id"`
+	EventID    string    `json:"event_id" bson:"event_id"`
+	EventType  string    `json:"event_type" bson:"event_type"`
+	Status     string    `json:"status" bson:"status"`
+	Attempts   int       `json:"attempts" bson:"attempts"`
+	StatusCode int       `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	Timestamp  time.Time `json:"ts" bson:"ts"`
+}
+
+// WebhookDeliveryFilter contains the pagination parameters used when
+// looking up the delivery log of a webhook; the deliveries are sorted by
+// time, newest first.
+type WebhookDeliveryFilter struct {
+	WebhookID string
+	Skip      int64
+	Limit     int64
+}
@@ -16,6 +16,7 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -29,11 +30,63 @@ import (
 	api "github.com/mendersoftware/deviceconnect/api/http"
 	"github.com/mendersoftware/deviceconnect/app"
 	"github.com/mendersoftware/deviceconnect/client/inventory"
+	"github.com/mendersoftware/deviceconnect/client/webhooks"
 	"github.com/mendersoftware/deviceconnect/client/workflows"
 	dconfig "github.com/mendersoftware/deviceconnect/config"
+	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
 )
 
+// NewApp initializes the app from the configuration, publishing the status
+// changes of the devices with the publisher; closing shutdown stops the
+// webhook deliveries from retrying.
+func NewApp(
+	conf config.Reader,
+	dataStore store.DataStore,
+	publisher app.Publisher,
+	shutdown <-chan struct{},
+) (app.App, error) {
+	inventory := inventory.NewClient(
+		conf.GetString(dconfig.SettingInventoryURI),
+		conf.GetInt(dconfig.SettingInventoryTimeout),
+	)
+	wflows := workflows.NewClient(
+		conf.GetString(dconfig.SettingWorkflowsURL),
+	)
+	instanceID := conf.GetString(dconfig.SettingInstanceID)
+	if instanceID == "" {
+		var err error
+		instanceID, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return app.New(
+		dataStore, inventory,
+		wflows, app.Config{
+			HaveAuditLogs: conf.GetBool(dconfig.SettingEnableAuditLogs),
+			SessionLimits: model.SessionLimits{
+				MaxPerDevice: conf.GetInt(dconfig.SettingMaxSessionsPerDevice),
+				MaxPerUser:   conf.GetInt(dconfig.SettingMaxSessionsPerUser),
+				MaxPerTenant: conf.GetInt(dconfig.SettingMaxSessionsPerTenant),
+			},
+			InstanceID: instanceID,
+			Publisher:  publisher,
+			Webhooks:   webhooks.NewClient(),
+			WebhookMaxAttempts: conf.GetInt(
+				dconfig.SettingWebhookMaxAttempts,
+			),
+			WebhookBackoff: time.Duration(conf.GetInt(
+				dconfig.SettingWebhookBackoff,
+			)) * time.Second,
+			InventoryStatusSync: conf.GetBool(
+				dconfig.SettingInventoryStatusSync,
+			),
+			Shutdown: shutdown,
+		},
+	), nil
+}
+
 // InitAndRun initializes the server and runs it
 func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 	ctx := context.Background()
@@ -45,21 +98,54 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 	if err != nil {
 		return err
 	}
-	inventory := inventory.NewClient(
-		config.Config.GetString(dconfig.SettingInventoryURI),
-		config.Config.GetInt(dconfig.SettingInventoryTimeout),
-	)
-	wflows := workflows.NewClient(
-		config.Config.GetString(dconfig.SettingWorkflowsURL),
-	)
-	deviceConnectApp := app.New(
-		dataStore, inventory,
-		wflows, app.Config{
-			HaveAuditLogs: conf.GetBool(dconfig.SettingEnableAuditLogs),
+	// closing shutdown notifies the websocket handlers to close the
+	// connections with the proper close code, and the webhook deliveries
+	// to stop retrying
+	shutdown := make(chan struct{})
+	deviceConnectApp, err := NewApp(conf, dataStore, natsClient, shutdown)
+	if err != nil {
+		return err
+	}
+
+	if conf.GetBool(dconfig.SettingReconcileOnStartup) {
+		// only the devices whose presence lease expired are stale: the
+		// instance ID may be shared with a live replica, whose devices
+		// must not be disconnected
+		err = deviceConnectApp.Reconcile(ctx, nil)
+		if err != nil {
+			l.Errorf("failed to reconcile the device statuses: %s",
+				err.Error())
+		}
+	}
+
+	router, err := api.NewRouter(
+		deviceConnectApp, natsClient, api.Config{
+			RecordingFailClosed: conf.GetBool(
+				dconfig.SettingRecordingFailClosed,
+			),
+			SessionGracePeriod: time.Duration(conf.GetInt(
+				dconfig.SettingSessionGracePeriod,
+			)) * time.Second,
+			SessionBufferSize: conf.GetInt(
+				dconfig.SettingSessionBufferSize,
+			),
+			DeviceLastSeenInterval: time.Duration(conf.GetInt(
+				dconfig.SettingDeviceLastSeenInterval,
+			)) * time.Second,
+			DevicePresenceLease: time.Duration(conf.GetInt(
+				dconfig.SettingDevicePresenceLease,
+			)) * time.Second,
+			MaxMessageSize: int64(conf.GetInt(
+				dconfig.SettingMaxMessageSize,
+			)),
+			ProtocolValidation: conf.GetString(
+				dconfig.SettingProtocolValidation,
+			),
+			MaxProtocolViolations: conf.GetInt(
+				dconfig.SettingMaxProtocolViolations,
+			),
 		},
 	)
-
-	router, err := api.NewRouter(deviceConnectApp, natsClient)
 	if err != nil {
 		l.Fatal(err)
 	}
@@ -68,6 +154,9 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 	srv := &http.Server{
 		Addr:    listen,
 		Handler: router,
+		BaseContext: func(net.Listener) context.Context {
+			return api.ContextWithShutdown(ctx, shutdown)
+		},
 	}
 
 	go func() {
@@ -81,6 +170,7 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 	<-quit
 
 	l.Info("server shutdown")
+	close(shutdown)
 
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -17,6 +17,7 @@ package store
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/mendersoftware/deviceconnect/model"
 )
@@ -27,16 +28,48 @@ import (
 type DataStore interface {
 	Ping(ctx context.Context) error
 	ProvisionTenant(ctx context.Context, tenantID string) error
+	GetTenantIDs(ctx context.Context) ([]string, error)
 	ProvisionDevice(ctx context.Context, tenantID string, deviceID string) error
 	DeleteDevice(ctx context.Context, tenantID, deviceID string) error
 	GetDevice(ctx context.Context, tenantID, deviceID string) (*model.Device, error)
-	UpsertDeviceStatus(ctx context.Context, tenantID, deviceID, status string) error
-	AllocateSession(ctx context.Context, sess *model.Session) error
+	UpsertDeviceStatus(ctx context.Context, tenantID, deviceID, status string) (string, error)
+	SetDeviceConnected(ctx context.Context, tenantID, deviceID, instanceID string) (int64, string, error)
+	SetDeviceDisconnected(ctx context.Context, tenantID, deviceID string, generation int64) (string, error)
+	RenewDeviceLease(ctx context.Context, tenantID, deviceID, instanceID string, expires time.Time) error
+	ResetStaleDevices(ctx context.Context, tenantID string, instanceIDs []string) ([]string, error)
+	RebuildSessionCounters(ctx context.Context, tenantID string) error
+	ExpireDevicePresence(ctx context.Context, tenantID, deviceID string) (bool, error)
+	FindDevices(ctx context.Context, tenantID string, filter model.DeviceFilter) ([]model.Device, int64, error)
+	SetDeviceCapabilities(ctx context.Context, tenantID, deviceID string, capabilities *model.DeviceCapabilities) error
+	UpdateDeviceLastSeen(ctx context.Context, tenantID, deviceID string, lastSeen time.Time) error
+	InsertConnectionEvent(ctx context.Context, tenantID string, event *model.ConnectionEvent) error
+	FindConnectionEvents(ctx context.Context, tenantID string, filter model.ConnectionFilter) ([]model.ConnectionEvent, int64, error)
+	InsertWebhook(ctx context.Context, tenantID string, webhook *model.Webhook) error
+	FindWebhooks(ctx context.Context, tenantID string) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, tenantID, webhookID string) error
+	InsertWebhookDelivery(ctx context.Context, tenantID string, delivery *model.WebhookDelivery) error
+	FindWebhookDeliveries(ctx context.Context, tenantID string, filter model.WebhookDeliveryFilter) ([]model.WebhookDelivery, int64, error)
+	AllocateSession(ctx context.Context, sess *model.Session, limits model.SessionLimits) error
 	GetSession(ctx context.Context, sessionID string) (*model.Session, error)
 	DeleteSession(ctx context.Context, sessionID string) (*model.Session, error)
+	CloseSession(ctx context.Context, sessionID string, end model.SessionEnd) (*model.Session, error)
+	FindSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error)
+	AddSessionObserver(ctx context.Context, sessionID string, observer *model.SessionObserver) (*model.Session, error)
+	CloseSessionObserver(ctx context.Context, sessionID, observerID string) (*model.Session, error)
+	GetTenantSettings(ctx context.Context, tenantID string) (*model.TenantSettings, error)
+	UpsertTenantSettings(ctx context.Context, tenantID string, settings *model.TenantSettings) error
+	GetSessionLimits(ctx context.Context, tenantID string) (*model.SessionLimits, error)
+	UpsertSessionLimits(ctx context.Context, tenantID string, limits *model.SessionLimits) error
+	InsertRecordingFrame(ctx context.Context, frame *model.RecordingFrame) error
+	GetRecordingFrames(ctx context.Context, sessionID string) ([]model.RecordingFrame, error)
 	Close() error
 }
 
 var (
 	ErrSessionNotFound = errors.New("store: session not found")
+	ErrWebhookNotFound = errors.New("store: webhook not found")
+
+	ErrDeviceSessionLimit = errors.New("store: device session limit reached")
+	ErrUserSessionLimit   = errors.New("store: user session limit reached")
+	ErrTenantSessionLimit = errors.New("store: tenant session limit reached")
 )
@@ -18,6 +18,7 @@ package mocks
 
 import (
 	context "context"
+	time "time"
 
 	model "github.com/mendersoftware/deviceconnect/model"
 	mock "github.com/stretchr/testify/mock"
@@ -28,13 +29,36 @@ type DataStore struct {
 	mock.Mock
 }
 
-// AllocateSession provides a mock function with given fields: ctx, sess
-func (_m *DataStore) AllocateSession(ctx context.Context, sess *model.Session) error {
-	ret := _m.Called(ctx, sess)
+// AddSessionObserver provides a mock function with given fields: ctx, sessionID, observer
+func (_m *DataStore) AddSessionObserver(ctx context.Context, sessionID string, observer *model.SessionObserver) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID, observer)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.SessionObserver) *model.Session); ok {
+		r0 = rf(ctx, sessionID, observer)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *model.SessionObserver) error); ok {
+		r1 = rf(ctx, sessionID, observer)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// AllocateSession provides a mock function with given fields: ctx, sess, limits
+func (_m *DataStore) AllocateSession(ctx context.Context, sess *model.Session, limits model.SessionLimits) error {
+	ret := _m.Called(ctx, sess, limits)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, *model.Session) error); ok {
-		r0 = rf(ctx, sess)
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, model.SessionLimits) error); ok {
+		r0 = rf(ctx, sess, limits)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -56,6 +80,52 @@ func (_m *DataStore) Close() error {
 	return r0
 }
 
+// CloseSession provides a mock function with given fields: ctx, sessionID, end
+func (_m *DataStore) CloseSession(ctx context.Context, sessionID string, end model.SessionEnd) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID, end)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.SessionEnd) *model.Session); ok {
+		r0 = rf(ctx, sessionID, end)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.SessionEnd) error); ok {
+		r1 = rf(ctx, sessionID, end)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CloseSessionObserver provides a mock function with given fields: ctx, sessionID, observerID
+func (_m *DataStore) CloseSessionObserver(ctx context.Context, sessionID string, observerID string) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID, observerID)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *model.Session); ok {
+		r0 = rf(ctx, sessionID, observerID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, sessionID, observerID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // DeleteDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *DataStore) DeleteDevice(ctx context.Context, tenantID string, deviceID string) error {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -93,6 +163,184 @@ func (_m *DataStore) DeleteSession(ctx context.Context, sessionID string) (*mode
 	return r0, r1
 }
 
+// DeleteWebhook provides a mock function with given fields: ctx, tenantID, webhookID
+func (_m *DataStore) DeleteWebhook(ctx context.Context, tenantID string, webhookID string) error {
+	ret := _m.Called(ctx, tenantID, webhookID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, tenantID, webhookID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ExpireDevicePresence provides a mock function with given fields: ctx, tenantID, deviceID
+func (_m *DataStore) ExpireDevicePresence(ctx context.Context, tenantID string, deviceID string) (bool, error) {
+	ret := _m.Called(ctx, tenantID, deviceID)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) bool); ok {
+		r0 = rf(ctx, tenantID, deviceID)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, tenantID, deviceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FindConnectionEvents provides a mock function with given fields: ctx, tenantID, filter
+func (_m *DataStore) FindConnectionEvents(ctx context.Context, tenantID string, filter model.ConnectionFilter) ([]model.ConnectionEvent, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.ConnectionEvent
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.ConnectionFilter) []model.ConnectionEvent); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.ConnectionEvent)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.ConnectionFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.ConnectionFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// FindDevices provides a mock function with given fields: ctx, tenantID, filter
+func (_m *DataStore) FindDevices(ctx context.Context, tenantID string, filter model.DeviceFilter) ([]model.Device, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.Device
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.DeviceFilter) []model.Device); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Device)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.DeviceFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.DeviceFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// FindSessions provides a mock function with given fields: ctx, filter
+func (_m *DataStore) FindSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, model.SessionFilter) []model.Session); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Session)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, model.SessionFilter) int64); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, model.SessionFilter) error); ok {
+		r2 = rf(ctx, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// FindWebhookDeliveries provides a mock function with given fields: ctx, tenantID, filter
+func (_m *DataStore) FindWebhookDeliveries(ctx context.Context, tenantID string, filter model.WebhookDeliveryFilter) ([]model.WebhookDelivery, int64, error) {
+	ret := _m.Called(ctx, tenantID, filter)
+
+	var r0 []model.WebhookDelivery
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.WebhookDeliveryFilter) []model.WebhookDelivery); ok {
+		r0 = rf(ctx, tenantID, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.WebhookDelivery)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, string, model.WebhookDeliveryFilter) int64); ok {
+		r1 = rf(ctx, tenantID, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, model.WebhookDeliveryFilter) error); ok {
+		r2 = rf(ctx, tenantID, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// FindWebhooks provides a mock function with given fields: ctx, tenantID
+func (_m *DataStore) FindWebhooks(ctx context.Context, tenantID string) ([]model.Webhook, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 []model.Webhook
+	if rf, ok := ret.Get(0).(func(context.Context, string) []model.Webhook); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Webhook)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *DataStore) GetDevice(ctx context.Context, tenantID string, deviceID string) (*model.Device, error) {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -116,6 +364,29 @@ func (_m *DataStore) GetDevice(ctx context.Context, tenantID string, deviceID st
 	return r0, r1
 }
 
+// GetRecordingFrames provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) GetRecordingFrames(ctx context.Context, sessionID string) ([]model.RecordingFrame, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 []model.RecordingFrame
+	if rf, ok := ret.Get(0).(func(context.Context, string) []model.RecordingFrame); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.RecordingFrame)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetSession provides a mock function with given fields: ctx, sessionID
 func (_m *DataStore) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
 	ret := _m.Called(ctx, sessionID)
@@ -139,6 +410,131 @@ func (_m *DataStore) GetSession(ctx context.Context, sessionID string) (*model.S
 	return r0, r1
 }
 
+// GetSessionLimits provides a mock function with given fields: ctx, tenantID
+func (_m *DataStore) GetSessionLimits(ctx context.Context, tenantID string) (*model.SessionLimits, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.SessionLimits
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.SessionLimits); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.SessionLimits)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetTenantIDs provides a mock function with given fields: ctx
+func (_m *DataStore) GetTenantIDs(ctx context.Context) ([]string, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetTenantSettings provides a mock function with given fields: ctx, tenantID
+func (_m *DataStore) GetTenantSettings(ctx context.Context, tenantID string) (*model.TenantSettings, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.TenantSettings
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.TenantSettings); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.TenantSettings)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// InsertConnectionEvent provides a mock function with given fields: ctx, tenantID, event
+func (_m *DataStore) InsertConnectionEvent(ctx context.Context, tenantID string, event *model.ConnectionEvent) error {
+	ret := _m.Called(ctx, tenantID, event)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.ConnectionEvent) error); ok {
+		r0 = rf(ctx, tenantID, event)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertRecordingFrame provides a mock function with given fields: ctx, frame
+func (_m *DataStore) InsertRecordingFrame(ctx context.Context, frame *model.RecordingFrame) error {
+	ret := _m.Called(ctx, frame)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.RecordingFrame) error); ok {
+		r0 = rf(ctx, frame)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertWebhook provides a mock function with given fields: ctx, tenantID, webhook
+func (_m *DataStore) InsertWebhook(ctx context.Context, tenantID string, webhook *model.Webhook) error {
+	ret := _m.Called(ctx, tenantID, webhook)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.Webhook) error); ok {
+		r0 = rf(ctx, tenantID, webhook)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertWebhookDelivery provides a mock function with given fields: ctx, tenantID, delivery
+func (_m *DataStore) InsertWebhookDelivery(ctx context.Context, tenantID string, delivery *model.WebhookDelivery) error {
+	ret := _m.Called(ctx, tenantID, delivery)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.WebhookDelivery) error); ok {
+		r0 = rf(ctx, tenantID, delivery)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Ping provides a mock function with given fields: ctx
 func (_m *DataStore) Ping(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -181,13 +577,176 @@ func (_m *DataStore) ProvisionTenant(ctx context.Context, tenantID string) error
 	return r0
 }
 
+// RebuildSessionCounters provides a mock function with given fields: ctx, tenantID
+func (_m *DataStore) RebuildSessionCounters(ctx context.Context, tenantID string) error {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RenewDeviceLease provides a mock function with given fields: ctx, tenantID, deviceID, instanceID, expires
+func (_m *DataStore) RenewDeviceLease(ctx context.Context, tenantID string, deviceID string, instanceID string, expires time.Time) error {
+	ret := _m.Called(ctx, tenantID, deviceID, instanceID, expires)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, time.Time) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, instanceID, expires)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResetStaleDevices provides a mock function with given fields: ctx, tenantID, instanceIDs
+func (_m *DataStore) ResetStaleDevices(ctx context.Context, tenantID string, instanceIDs []string) ([]string, error) {
+	ret := _m.Called(ctx, tenantID, instanceIDs)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, string, []string) []string); ok {
+		r0 = rf(ctx, tenantID, instanceIDs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, []string) error); ok {
+		r1 = rf(ctx, tenantID, instanceIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetDeviceCapabilities provides a mock function with given fields: ctx, tenantID, deviceID, capabilities
+func (_m *DataStore) SetDeviceCapabilities(ctx context.Context, tenantID string, deviceID string, capabilities *model.DeviceCapabilities) error {
+	ret := _m.Called(ctx, tenantID, deviceID, capabilities)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, *model.DeviceCapabilities) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, capabilities)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetDeviceConnected provides a mock function with given fields: ctx, tenantID, deviceID, instanceID
+func (_m *DataStore) SetDeviceConnected(ctx context.Context, tenantID string, deviceID string, instanceID string) (int64, string, error) {
+	ret := _m.Called(ctx, tenantID, deviceID, instanceID)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) int64); ok {
+		r0 = rf(ctx, tenantID, deviceID, instanceID)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) string); ok {
+		r1 = rf(ctx, tenantID, deviceID, instanceID)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, string, string) error); ok {
+		r2 = rf(ctx, tenantID, deviceID, instanceID)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// SetDeviceDisconnected provides a mock function with given fields: ctx, tenantID, deviceID, generation
+func (_m *DataStore) SetDeviceDisconnected(ctx context.Context, tenantID string, deviceID string, generation int64) (string, error) {
+	ret := _m.Called(ctx, tenantID, deviceID, generation)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int64) string); ok {
+		r0 = rf(ctx, tenantID, deviceID, generation)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int64) error); ok {
+		r1 = rf(ctx, tenantID, deviceID, generation)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateDeviceLastSeen provides a mock function with given fields: ctx, tenantID, deviceID, lastSeen
+func (_m *DataStore) UpdateDeviceLastSeen(ctx context.Context, tenantID string, deviceID string, lastSeen time.Time) error {
+	ret := _m.Called(ctx, tenantID, deviceID, lastSeen)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time) error); ok {
+		r0 = rf(ctx, tenantID, deviceID, lastSeen)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UpsertDeviceStatus provides a mock function with given fields: ctx, tenantID, deviceID, status
-func (_m *DataStore) UpsertDeviceStatus(ctx context.Context, tenantID string, deviceID string, status string) error {
+func (_m *DataStore) UpsertDeviceStatus(ctx context.Context, tenantID string, deviceID string, status string) (string, error) {
 	ret := _m.Called(ctx, tenantID, deviceID, status)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) string); ok {
 		r0 = rf(ctx, tenantID, deviceID, status)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, tenantID, deviceID, status)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpsertSessionLimits provides a mock function with given fields: ctx, tenantID, limits
+func (_m *DataStore) UpsertSessionLimits(ctx context.Context, tenantID string, limits *model.SessionLimits) error {
+	ret := _m.Called(ctx, tenantID, limits)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.SessionLimits) error); ok {
+		r0 = rf(ctx, tenantID, limits)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpsertTenantSettings provides a mock function with given fields: ctx, tenantID, settings
+func (_m *DataStore) UpsertTenantSettings(ctx context.Context, tenantID string, settings *model.TenantSettings) error {
+	ret := _m.Called(ctx, tenantID, settings)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.TenantSettings) error); ok {
+		r0 = rf(ctx, tenantID, settings)
 	} else {
 		r0 = ret.Error(0)
 	}
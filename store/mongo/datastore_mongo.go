@@ -37,9 +37,62 @@ const (
 	// SessionsCollectionName refers to the name of the collection of sessions
 	SessionsCollectionName = "sessions"
 
+	// RecordingsCollectionName refers to the name of the collection of
+	// the recorded session frames
+	RecordingsCollectionName = "recordings"
+
+	// SettingsCollectionName refers to the name of the collection holding
+	// the tenant settings
+	SettingsCollectionName = "settings"
+
+	// ConnectionsCollectionName refers to the name of the collection of
+	// the device connection events
+	ConnectionsCollectionName = "connections"
+
+	// CountersCollectionName refers to the name of the collection holding
+	// the number of open sessions per device, per user and per tenant
+	CountersCollectionName = "session_counters"
+
+	// WebhooksCollectionName refers to the name of the collection of the
+	// tenant webhooks
+	WebhooksCollectionName = "webhooks"
+
+	// WebhookDeliveriesCollectionName refers to the name of the collection
+	// of the webhook delivery log
+	WebhookDeliveriesCollectionName = "webhook_deliveries"
+
+	// settingsID is the ID of the tenant settings document
+	settingsID = "settings"
+	// limitsID is the ID of the tenant session limits document
+	limitsID = "limits"
+
 	dbFieldStatus    = "status"
 	dbFieldCreatedTs = "created_ts"
 	dbFieldUpdatedTs = "updated_ts"
+	dbFieldDeviceID  = "device_id"
+	dbFieldUserID    = "user_id"
+
+	dbFieldEndTs           = "end_ts"
+	dbFieldDuration        = "duration"
+	dbFieldCloseReason     = "close_reason"
+	dbFieldBytesToDevice   = "bytes_to_device"
+	dbFieldBytesFromDevice = "bytes_from_device"
+	dbFieldStartTs         = "start_ts"
+	dbFieldDeviceGen       = "device_generation"
+
+	dbFieldSessionID = "session_id"
+	dbFieldTs        = "ts"
+	dbFieldLastSeen  = "last_seen_ts"
+	dbFieldInstance  = "instance_id"
+	dbFieldLeaseExp  = "lease_expires_ts"
+	dbFieldGen       = "generation"
+	dbFieldCaps      = "capabilities"
+	dbFieldObservers = "observers"
+	dbFieldWebhookID = "webhook_id"
+
+	dbFieldCount = "count"
+
+	errCodeDuplicateKey = 11000
 )
 
 // SetupDataStore returns the mongo data store and optionally runs migrations
@@ -158,6 +211,20 @@ func (db *DataStoreMongo) ProvisionTenant(ctx context.Context, tenantID string)
 	return Migrate(ctx, dbname, DbVersion, db.client, true)
 }
 
+// GetTenantIDs returns the IDs of the tenants having a database, including
+// the empty tenant ID of the default database.
+func (db *DataStoreMongo) GetTenantIDs(ctx context.Context) ([]string, error) {
+	dbs, err := migrate.GetTenantDbs(ctx, db.client, mstore.IsTenantDb(DbName))
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to retrieve tenant DBs")
+	}
+	tenantIDs := []string{""}
+	for _, d := range dbs {
+		tenantIDs = append(tenantIDs, mstore.TenantFromDbName(d, DbName))
+	}
+	return tenantIDs, nil
+}
+
 // ProvisionDevice provisions a new device
 func (db *DataStoreMongo) ProvisionDevice(ctx context.Context, tenantID, deviceID string) error {
 	dbname := mstore.DbNameForTenant(tenantID, DbName)
@@ -212,56 +279,759 @@ func (db *DataStoreMongo) GetDevice(
 	return device, nil
 }
 
-// UpsertDeviceStatus upserts the connection status of a device
+// FindDevices returns the devices matching the filter and the total count of
+// matching devices, sorted by ID or by update time; the status of a connected
+// device is considered disconnected once its presence lease expired.
+func (db *DataStoreMongo) FindDevices(
+	ctx context.Context,
+	tenantID string,
+	filter model.DeviceFilter,
+) ([]model.Device, int64, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	query := bson.M{}
+	if len(filter.IDs) > 0 {
+		query["_id"] = bson.M{"$in": filter.IDs}
+	}
+	now := clock.Now().UTC()
+	switch filter.Status {
+	case "":
+	case model.DeviceStatusConnected:
+		query[dbFieldStatus] = model.DeviceStatusConnected
+		query["$or"] = bson.A{
+			bson.M{dbFieldLeaseExp: bson.M{"$exists": false}},
+			bson.M{dbFieldLeaseExp: bson.M{"$gt": now}},
+		}
+	case model.DeviceStatusDisconnected:
+		query["$or"] = bson.A{
+			bson.M{dbFieldStatus: model.DeviceStatusDisconnected},
+			bson.M{
+				dbFieldStatus:   model.DeviceStatusConnected,
+				dbFieldLeaseExp: bson.M{"$lte": now},
+			},
+		}
+	default:
+		query[dbFieldStatus] = filter.Status
+	}
+
+	sort := bson.D{{Key: "_id", Value: 1}}
+	switch filter.Sort {
+	case model.SortAscending:
+		sort = append(bson.D{{Key: dbFieldUpdatedTs, Value: 1}}, sort...)
+	case model.SortDescending:
+		sort = append(bson.D{{Key: dbFieldUpdatedTs, Value: -1}}, sort...)
+	}
+	findOpts := mopts.Find().SetSort(sort)
+	if filter.Skip > 0 {
+		findOpts.SetSkip(filter.Skip)
+	}
+	if filter.Limit > 0 {
+		findOpts.SetLimit(filter.Limit)
+	}
+
+	cur, err := coll.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to find devices")
+	}
+	devices := []model.Device{}
+	if err = cur.All(ctx, &devices); err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to decode devices")
+	}
+	count, err := coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to count devices")
+	}
+	return devices, count, nil
+}
+
+// UpsertDeviceStatus upserts the connection status of a device; the presence
+// lease is reset and must be renewed by the instance holding the connection,
+// which is kept until the device disconnects. It returns the previous status
+// of the device, empty if it was created.
 func (db *DataStoreMongo) UpsertDeviceStatus(
 	ctx context.Context,
 	tenantID string,
 	deviceID string,
 	status string,
-) error {
+) (string, error) {
 	dbname := mstore.DbNameForTenant(tenantID, DbName)
 	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
 
-	updateOpts := &mopts.UpdateOptions{}
-	updateOpts.SetUpsert(true)
-
 	now := clock.Now().UTC()
 
-	_, err := coll.UpdateOne(ctx,
+	set := bson.M{
+		dbFieldStatus:    status,
+		dbFieldUpdatedTs: &now,
+	}
+	unset := bson.M{
+		dbFieldLeaseExp: "",
+	}
+	if status == model.DeviceStatusConnected {
+		set[dbFieldLastSeen] = &now
+	} else {
+		unset[dbFieldInstance] = ""
+	}
+	previous := &model.Device{}
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": deviceID},
+		bson.M{
+			"$set":   set,
+			"$unset": unset,
+			"$setOnInsert": bson.M{
+				dbFieldCreatedTs: &now,
+			},
+		},
+		mopts.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(mopts.Before),
+	).Decode(previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", err
+	}
+	return previous.Status, nil
+}
+
+// SetDeviceConnected sets the status of the device to connected, held by the
+// given instance of the service, and starts a new connection generation; it
+// returns the generation and the previous status of the device.
+func (db *DataStoreMongo) SetDeviceConnected(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+	instanceID string,
+) (int64, string, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	now := clock.Now().UTC()
+	previous := &model.Device{}
+	err := coll.FindOneAndUpdate(ctx,
 		bson.M{"_id": deviceID},
 		bson.M{
 			"$set": bson.M{
-				dbFieldStatus:    status,
+				dbFieldStatus:    model.DeviceStatusConnected,
 				dbFieldUpdatedTs: &now,
+				dbFieldLastSeen:  &now,
+				dbFieldInstance:  instanceID,
+			},
+			"$unset": bson.M{
+				dbFieldLeaseExp: "",
+				dbFieldCaps:     "",
+			},
+			"$inc": bson.M{
+				dbFieldGen: 1,
 			},
 			"$setOnInsert": bson.M{
 				dbFieldCreatedTs: &now,
 			},
 		},
-		updateOpts,
+		mopts.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(mopts.Before),
+	).Decode(previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, "", errors.Wrap(err,
+			"store: failed to set the device connected",
+		)
+	}
+	return previous.Generation + 1, previous.Status, nil
+}
+
+// SetDeviceDisconnected sets the status of the device to disconnected,
+// unless a newer connection generation started in the meantime. It returns
+// the previous status of the device, empty if it was not updated.
+func (db *DataStoreMongo) SetDeviceDisconnected(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+	generation int64,
+) (string, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	now := clock.Now().UTC()
+	previous := &model.Device{}
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":      deviceID,
+			dbFieldGen: generation,
+		},
+		bson.M{
+			"$set": bson.M{
+				dbFieldStatus:    model.DeviceStatusDisconnected,
+				dbFieldUpdatedTs: &now,
+			},
+			"$unset": bson.M{
+				dbFieldInstance: "",
+				dbFieldLeaseExp: "",
+			},
+		},
+	).Decode(previous)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err,
+			"store: failed to set the device disconnected",
+		)
+	}
+	return previous.Status, nil
+}
+
+// RenewDeviceLease extends the presence lease of a connected device held by
+// the given instance of the service.
+func (db *DataStoreMongo) RenewDeviceLease(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+	instanceID string,
+	expires time.Time,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	_, err := coll.UpdateOne(ctx,
+		bson.M{
+			"_id":         deviceID,
+			dbFieldStatus: model.DeviceStatusConnected,
+		},
+		bson.M{
+			"$set": bson.M{
+				dbFieldInstance: instanceID,
+				dbFieldLeaseExp: expires.UTC(),
+			},
+		},
 	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to renew the device lease")
+	}
+	return nil
+}
 
-	return err
+// ResetStaleDevices sets the status of the devices reported connected by one
+// of the given instances, or whose presence lease expired, to disconnected.
+// It returns the IDs of the devices updated.
+func (db *DataStoreMongo) ResetStaleDevices(
+	ctx context.Context,
+	tenantID string,
+	instanceIDs []string,
+) ([]string, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	now := clock.Now().UTC()
+	stale := bson.A{
+		bson.M{dbFieldLeaseExp: bson.M{"$lt": now}},
+	}
+	if len(instanceIDs) > 0 {
+		stale = append(stale, bson.M{
+			dbFieldInstance: bson.M{"$in": instanceIDs},
+		})
+	}
+	query := bson.M{
+		dbFieldStatus: model.DeviceStatusConnected,
+		"$or":         stale,
+	}
+	cur, err := coll.Find(ctx, query,
+		mopts.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to find stale devices")
+	}
+	devices := []model.Device{}
+	if err = cur.All(ctx, &devices); err != nil {
+		return nil, errors.Wrap(err, "store: failed to decode devices")
+	}
+
+	// the devices are reset one by one, skipping the devices which
+	// reconnected in the meantime, to report the devices actually updated
+	deviceIDs := []string{}
+	for _, device := range devices {
+		query["_id"] = device.ID
+		res, err := coll.UpdateOne(ctx, query, staleDeviceUpdate(now))
+		if err != nil {
+			return deviceIDs, errors.Wrap(err,
+				"store: failed to reset stale devices",
+			)
+		} else if res.ModifiedCount > 0 {
+			deviceIDs = append(deviceIDs, device.ID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+// ExpireDevicePresence sets the status of the device to disconnected if it
+// is reported connected and its presence lease expired. It returns true if
+// the device was updated.
+func (db *DataStoreMongo) ExpireDevicePresence(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) (bool, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	now := clock.Now().UTC()
+	res, err := coll.UpdateOne(ctx,
+		bson.M{
+			"_id":           deviceID,
+			dbFieldStatus:   model.DeviceStatusConnected,
+			dbFieldLeaseExp: bson.M{"$lt": now},
+		},
+		staleDeviceUpdate(now),
+	)
+	if err != nil {
+		return false, errors.Wrap(err,
+			"store: failed to expire the device presence",
+		)
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// staleDeviceUpdate returns the update setting a stale device disconnected
+func staleDeviceUpdate(now time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			dbFieldStatus:    model.DeviceStatusDisconnected,
+			dbFieldUpdatedTs: &now,
+		},
+		"$unset": bson.M{
+			dbFieldInstance: "",
+			dbFieldLeaseExp: "",
+		},
+	}
+}
+
+// UpdateDeviceLastSeen sets the last time the device was heard from, unless
+// a later time is already stored.
+func (db *DataStoreMongo) UpdateDeviceLastSeen(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+	lastSeen time.Time,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	_, err := coll.UpdateOne(ctx,
+		bson.M{"_id": deviceID},
+		bson.M{
+			"$max": bson.M{
+				dbFieldLastSeen: lastSeen.UTC(),
+			},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to update the device last seen")
+	}
+	return nil
+}
+
+// SetDeviceCapabilities stores the capabilities advertised by the device
+func (db *DataStoreMongo) SetDeviceCapabilities(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+	capabilities *model.DeviceCapabilities,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(DevicesCollectionName)
+
+	_, err := coll.UpdateOne(ctx,
+		bson.M{"_id": deviceID},
+		bson.M{
+			"$set": bson.M{
+				dbFieldCaps: capabilities,
+			},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to set the device capabilities")
+	}
+	return nil
+}
+
+// InsertConnectionEvent stores an event of the connection history of a device
+func (db *DataStoreMongo) InsertConnectionEvent(
+	ctx context.Context,
+	tenantID string,
+	event *model.ConnectionEvent,
+) error {
+	if err := event.Validate(); err != nil {
+		return errors.Wrap(err, "store: cannot insert invalid connection event")
+	}
+
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(ConnectionsCollectionName)
+
+	_, err := coll.InsertOne(ctx, event)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to insert connection event")
+	}
+	return nil
+}
+
+// FindConnectionEvents returns the connection events of a device, newest
+// first, together with the total number of events of the device.
+func (db *DataStoreMongo) FindConnectionEvents(
+	ctx context.Context,
+	tenantID string,
+	filter model.ConnectionFilter,
+) ([]model.ConnectionEvent, int64, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(ConnectionsCollectionName)
+
+	query := bson.M{dbFieldDeviceID: filter.DeviceID}
+	findOpts := mopts.Find().
+		SetSort(bson.D{{Key: dbFieldTs, Value: -1}})
+	if filter.Skip > 0 {
+		findOpts.SetSkip(filter.Skip)
+	}
+	if filter.Limit > 0 {
+		findOpts.SetLimit(filter.Limit)
+	}
+
+	cur, err := coll.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to find connection events",
+		)
+	}
+	events := []model.ConnectionEvent{}
+	if err = cur.All(ctx, &events); err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to decode connection events",
+		)
+	}
+	count, err := coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to count connection events",
+		)
+	}
+	return events, count, nil
+}
+
+// InsertWebhook registers a webhook of the tenant
+func (db *DataStoreMongo) InsertWebhook(
+	ctx context.Context,
+	tenantID string,
+	webhook *model.Webhook,
+) error {
+	if err := webhook.Validate(); err != nil {
+		return errors.Wrap(err, "store: cannot insert invalid webhook")
+	}
+
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(WebhooksCollectionName)
+
+	_, err := coll.InsertOne(ctx, webhook)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to insert webhook")
+	}
+	return nil
 }
 
-// AllocateSession allocates a new session.
-func (db *DataStoreMongo) AllocateSession(ctx context.Context, sess *model.Session) error {
+// FindWebhooks returns the webhooks of the tenant, oldest first
+func (db *DataStoreMongo) FindWebhooks(
+	ctx context.Context,
+	tenantID string,
+) ([]model.Webhook, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(WebhooksCollectionName)
+
+	cur, err := coll.Find(ctx, bson.M{},
+		mopts.Find().SetSort(bson.D{{Key: dbFieldCreatedTs, Value: 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to find webhooks")
+	}
+	webhooks := []model.Webhook{}
+	if err = cur.All(ctx, &webhooks); err != nil {
+		return nil, errors.Wrap(err, "store: failed to decode webhooks")
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook of the tenant, together with its
+// delivery log.
+func (db *DataStoreMongo) DeleteWebhook(
+	ctx context.Context,
+	tenantID string,
+	webhookID string,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	database := db.client.Database(dbname)
+
+	res, err := database.Collection(WebhooksCollectionName).
+		DeleteOne(ctx, bson.M{"_id": webhookID})
+	if err != nil {
+		return errors.Wrap(err, "store: failed to delete webhook")
+	} else if res.DeletedCount == 0 {
+		return store.ErrWebhookNotFound
+	}
+	_, err = database.Collection(WebhookDeliveriesCollectionName).
+		DeleteMany(ctx, bson.M{dbFieldWebhookID: webhookID})
+	if err != nil {
+		return errors.Wrap(err, "store: failed to delete webhook deliveries")
+	}
+	return nil
+}
+
+// InsertWebhookDelivery appends an entry to the delivery log of a webhook
+func (db *DataStoreMongo) InsertWebhookDelivery(
+	ctx context.Context,
+	tenantID string,
+	delivery *model.WebhookDelivery,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).
+		Collection(WebhookDeliveriesCollectionName)
+
+	_, err := coll.InsertOne(ctx, delivery)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to insert webhook delivery")
+	}
+	return nil
+}
+
+// FindWebhookDeliveries returns the delivery log of a webhook, newest
+// first, together with the total number of deliveries of the webhook.
+func (db *DataStoreMongo) FindWebhookDeliveries(
+	ctx context.Context,
+	tenantID string,
+	filter model.WebhookDeliveryFilter,
+) ([]model.WebhookDelivery, int64, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).
+		Collection(WebhookDeliveriesCollectionName)
+
+	query := bson.M{dbFieldWebhookID: filter.WebhookID}
+	findOpts := mopts.Find().
+		SetSort(bson.D{{Key: dbFieldTs, Value: -1}})
+	if filter.Skip > 0 {
+		findOpts.SetSkip(filter.Skip)
+	}
+	if filter.Limit > 0 {
+		findOpts.SetLimit(filter.Limit)
+	}
+
+	cur, err := coll.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to find webhook deliveries",
+		)
+	}
+	deliveries := []model.WebhookDelivery{}
+	if err = cur.All(ctx, &deliveries); err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to decode webhook deliveries",
+		)
+	}
+	count, err := coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, -1, errors.Wrap(err,
+			"store: failed to count webhook deliveries",
+		)
+	}
+	return deliveries, count, nil
+}
+
+// AllocateSession allocates a new session, unless the number of open sessions
+// of the device, the user or the tenant reached the limits.
+func (db *DataStoreMongo) AllocateSession(
+	ctx context.Context,
+	sess *model.Session,
+	limits model.SessionLimits,
+) error {
 
 	if err := sess.Validate(); err != nil {
 		return errors.Wrap(err, "store: cannot allocate invalid Session")
 	}
 
 	dbname := mstore.DbNameForTenant(sess.TenantID, DbName)
-	coll := db.client.Database(dbname).Collection(SessionsCollectionName)
+	database := db.client.Database(dbname)
+	coll := database.Collection(SessionsCollectionName)
+	collCounters := database.Collection(CountersCollectionName)
+
+	counters := sessionCounters(sess)
+	slots := []struct {
+		limit int
+		err   error
+	}{
+		{limits.MaxPerDevice, store.ErrDeviceSessionLimit},
+		{limits.MaxPerUser, store.ErrUserSessionLimit},
+		{limits.MaxPerTenant, store.ErrTenantSessionLimit},
+	}
+	for i, slot := range slots {
+		err := acquireSessionSlot(ctx, collCounters, counters[i], slot.limit)
+		if err == errSessionSlotUnavailable {
+			err = slot.err
+		}
+		if err != nil {
+			releaseSessionSlots(ctx, collCounters, counters[:i])
+			return err
+		}
+	}
 
 	_, err := coll.InsertOne(ctx, sess)
 	if err != nil {
+		releaseSessionSlots(ctx, collCounters, counters)
 		return errors.Wrap(err, "store: failed to allocate session")
 	}
 
 	return nil
 }
 
+var errSessionSlotUnavailable = errors.New("session slot unavailable")
+
+// sessionCounters returns the IDs of the device, user and tenant counters
+// of open sessions
+func sessionCounters(sess *model.Session) []string {
+	return []string{
+		"device:" + sess.DeviceID,
+		"user:" + sess.UserID,
+		"tenant",
+	}
+}
+
+// acquireSessionSlot increments the counter of open sessions, unless it
+// already reached the limit; zero means unlimited.
+func acquireSessionSlot(
+	ctx context.Context,
+	coll *mongo.Collection,
+	counterID string,
+	limit int,
+) error {
+	filter := bson.D{{Key: "_id", Value: counterID}}
+	if limit > 0 {
+		filter = append(filter, bson.E{
+			Key: dbFieldCount, Value: bson.D{{Key: "$lt", Value: limit}},
+		})
+	}
+	// if the counter reached the limit, the upsert fails on the
+	// duplicate _id
+	_, err := coll.UpdateOne(ctx,
+		filter,
+		bson.D{{Key: "$inc", Value: bson.D{{Key: dbFieldCount, Value: 1}}}},
+		mopts.Update().SetUpsert(true),
+	)
+	if isDuplicateKeyError(err) {
+		return errSessionSlotUnavailable
+	} else if err != nil {
+		return errors.Wrap(err, "store: failed to count open sessions")
+	}
+	return nil
+}
+
+// RebuildSessionCounters recomputes the counters of open sessions of the
+// tenant from the connected sessions, fixing the counters left behind by the
+// instances which stopped without closing their sessions.
+func (db *DataStoreMongo) RebuildSessionCounters(
+	ctx context.Context,
+	tenantID string,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	return rebuildSessionCounters(ctx, db.client.Database(dbname))
+}
+
+// rebuildSessionCounters sets the counters of open sessions to the number
+// of connected sessions; without transactions, a session allocated or
+// closed meanwhile may skew the counters until the next rebuild.
+func rebuildSessionCounters(ctx context.Context, database *mongo.Database) error {
+	coll := database.Collection(SessionsCollectionName)
+	collCounters := database.Collection(CountersCollectionName)
+
+	cur, err := coll.Find(ctx,
+		bson.D{{Key: dbFieldStatus, Value: model.SessionStatusConnected}},
+		mopts.Find().SetProjection(bson.D{
+			{Key: dbFieldDeviceID, Value: 1},
+			{Key: dbFieldUserID, Value: 1},
+		}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to find open sessions")
+	}
+	sessions := []model.Session{}
+	if err = cur.All(ctx, &sessions); err != nil {
+		return errors.Wrap(err, "store: failed to decode sessions")
+	}
+	counts := make(map[string]int)
+	for i := range sessions {
+		for _, counterID := range sessionCounters(&sessions[i]) {
+			counts[counterID]++
+		}
+	}
+
+	// the counters without open sessions are reset
+	cur, err = collCounters.Find(ctx, bson.D{
+		{Key: dbFieldCount, Value: bson.D{{Key: "$gt", Value: 0}}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "store: failed to find session counters")
+	}
+	counters := []struct {
+		ID string `bson:"_id"`
+	}{}
+	if err = cur.All(ctx, &counters); err != nil {
+		return errors.Wrap(err, "store: failed to decode session counters")
+	}
+	for _, counter := range counters {
+		if _, ok := counts[counter.ID]; !ok {
+			counts[counter.ID] = 0
+		}
+	}
+
+	for counterID, count := range counts {
+		_, err = collCounters.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: counterID}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: dbFieldCount, Value: count},
+			}}},
+			mopts.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return errors.Wrap(err,
+				"store: failed to update session counters",
+			)
+		}
+	}
+	return nil
+}
+
+// releaseSessionSlots decrements the counters of open sessions
+func releaseSessionSlots(
+	ctx context.Context,
+	coll *mongo.Collection,
+	counterIDs []string,
+) {
+	if len(counterIDs) == 0 {
+		return
+	}
+	//nolint:errcheck
+	coll.UpdateMany(ctx,
+		bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$in", Value: counterIDs}}},
+			{Key: dbFieldCount, Value: bson.D{{Key: "$gt", Value: 0}}},
+		},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: dbFieldCount, Value: -1}}}},
+	)
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == errCodeDuplicateKey {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == errCodeDuplicateKey
+	}
+	return false
+}
+
 // DeleteSession deletes a session
 func (db *DataStoreMongo) DeleteSession(
 	ctx context.Context, sessionID string,
@@ -281,6 +1051,147 @@ func (db *DataStoreMongo) DeleteSession(
 			return nil, err
 		}
 	}
+	if sess.Status == model.SessionStatusConnected {
+		releaseSessionSlots(ctx,
+			db.client.Database(dbname).Collection(CountersCollectionName),
+			sessionCounters(sess),
+		)
+	}
+	if idty := identity.FromContext(ctx); idty != nil {
+		sess.TenantID = idty.Tenant
+	}
+	return sess, nil
+}
+
+// CloseSession marks an open session as disconnected, recording the end time,
+// duration, close reason and byte counts. If the session does not exist or
+// is already closed, the byte counts are added to the session (if any) and
+// ErrSessionNotFound is returned.
+func (db *DataStoreMongo) CloseSession(
+	ctx context.Context,
+	sessionID string,
+	end model.SessionEnd,
+) (*model.Session, error) {
+	collSess := db.client.
+		Database(mstore.DbFromContext(ctx, DbName)).
+		Collection(SessionsCollectionName)
+
+	now := clock.Now().UTC()
+	addBytes := func(field string, n int64) bson.D {
+		return bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, 0}}}, n,
+		}}}
+	}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+		{Key: dbFieldStatus, Value: model.SessionStatusDisconnected},
+		{Key: dbFieldEndTs, Value: now},
+		{Key: dbFieldDuration, Value: bson.D{{Key: "$divide", Value: bson.A{
+			bson.D{{Key: "$subtract", Value: bson.A{
+				now, "$" + dbFieldStartTs,
+			}}}, 1000,
+		}}}},
+		{Key: dbFieldCloseReason, Value: end.Reason},
+		{Key: dbFieldBytesToDevice, Value: addBytes(
+			dbFieldBytesToDevice, end.BytesToDevice,
+		)},
+		{Key: dbFieldBytesFromDevice, Value: addBytes(
+			dbFieldBytesFromDevice, end.BytesFromDevice,
+		)},
+	}}}}
+	sess := new(model.Session)
+	err := collSess.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "_id", Value: sessionID},
+			{Key: dbFieldStatus, Value: model.SessionStatusConnected},
+		},
+		update,
+		mopts.FindOneAndUpdate().SetReturnDocument(mopts.After),
+	).Decode(sess)
+	if err == mongo.ErrNoDocuments {
+		_, err = collSess.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: sessionID}},
+			bson.D{{Key: "$inc", Value: bson.D{
+				{Key: dbFieldBytesToDevice, Value: end.BytesToDevice},
+				{Key: dbFieldBytesFromDevice, Value: end.BytesFromDevice},
+			}}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return nil, store.ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	releaseSessionSlots(ctx,
+		db.client.
+			Database(mstore.DbFromContext(ctx, DbName)).
+			Collection(CountersCollectionName),
+		sessionCounters(sess),
+	)
+	if idty := identity.FromContext(ctx); idty != nil {
+		sess.TenantID = idty.Tenant
+	}
+	return sess, nil
+}
+
+// AddSessionObserver adds an observer to a connected session
+func (db *DataStoreMongo) AddSessionObserver(
+	ctx context.Context,
+	sessionID string,
+	observer *model.SessionObserver,
+) (*model.Session, error) {
+	collSess := db.client.
+		Database(mstore.DbFromContext(ctx, DbName)).
+		Collection(SessionsCollectionName)
+
+	sess := new(model.Session)
+	err := collSess.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "_id", Value: sessionID},
+			{Key: dbFieldStatus, Value: model.SessionStatusConnected},
+		},
+		bson.D{{Key: "$push", Value: bson.D{
+			{Key: dbFieldObservers, Value: observer},
+		}}},
+		mopts.FindOneAndUpdate().SetReturnDocument(mopts.After),
+	).Decode(sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, store.ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if idty := identity.FromContext(ctx); idty != nil {
+		sess.TenantID = idty.Tenant
+	}
+	return sess, nil
+}
+
+// CloseSessionObserver sets the end time of the observer of a session
+func (db *DataStoreMongo) CloseSessionObserver(
+	ctx context.Context,
+	sessionID string,
+	observerID string,
+) (*model.Session, error) {
+	collSess := db.client.
+		Database(mstore.DbFromContext(ctx, DbName)).
+		Collection(SessionsCollectionName)
+
+	sess := new(model.Session)
+	err := collSess.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "_id", Value: sessionID},
+			{Key: dbFieldObservers + ".id", Value: observerID},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: dbFieldObservers + ".$." + dbFieldEndTs, Value: clock.Now().UTC()},
+		}}},
+		mopts.FindOneAndUpdate().SetReturnDocument(mopts.After),
+	).Decode(sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, store.ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
 	if idty := identity.FromContext(ctx); idty != nil {
 		sess.TenantID = idty.Tenant
 	}
@@ -314,6 +1225,189 @@ func (db *DataStoreMongo) GetSession(
 	return session, nil
 }
 
+// FindSessions returns the sessions matching the filter together with the
+// total number of matching sessions, regardless of the pagination.
+func (db *DataStoreMongo) FindSessions(
+	ctx context.Context,
+	filter model.SessionFilter,
+) ([]model.Session, int64, error) {
+	collSess := db.client.
+		Database(mstore.DbFromContext(ctx, DbName)).
+		Collection(SessionsCollectionName)
+
+	query := bson.M{}
+	if filter.UserID != "" {
+		query[dbFieldUserID] = filter.UserID
+	}
+	if filter.DeviceID != "" {
+		query[dbFieldDeviceID] = filter.DeviceID
+	} else if filter.DeviceIDs != nil {
+		query[dbFieldDeviceID] = bson.M{"$in": filter.DeviceIDs}
+	}
+	if filter.Status != "" {
+		query[dbFieldStatus] = filter.Status
+	}
+	if filter.StartTsFrom != nil || filter.StartTsTo != nil {
+		startTs := bson.M{}
+		if filter.StartTsFrom != nil {
+			startTs["$gte"] = *filter.StartTsFrom
+		}
+		if filter.StartTsTo != nil {
+			startTs["$lte"] = *filter.StartTsTo
+		}
+		query[dbFieldStartTs] = startTs
+	}
+
+	sortOrder := -1
+	if filter.Sort == model.SortAscending {
+		sortOrder = 1
+	}
+	findOpts := mopts.Find().
+		SetSort(bson.D{{Key: dbFieldStartTs, Value: sortOrder}})
+	if filter.Skip > 0 {
+		findOpts.SetSkip(filter.Skip)
+	}
+	if filter.Limit > 0 {
+		findOpts.SetLimit(filter.Limit)
+	}
+
+	cur, err := collSess.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to find sessions")
+	}
+	sessions := []model.Session{}
+	if err = cur.All(ctx, &sessions); err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to decode sessions")
+	}
+	count, err := collSess.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "store: failed to count sessions")
+	}
+
+	if idty := identity.FromContext(ctx); idty != nil {
+		for i := range sessions {
+			sessions[i].TenantID = idty.Tenant
+		}
+	}
+
+	return sessions, count, nil
+}
+
+// GetTenantSettings returns the settings of the tenant, or the default
+// settings if the tenant has none stored
+func (db *DataStoreMongo) GetTenantSettings(
+	ctx context.Context,
+	tenantID string,
+) (*model.TenantSettings, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(SettingsCollectionName)
+
+	settings := &model.TenantSettings{}
+	err := coll.FindOne(ctx, bson.M{"_id": settingsID}).Decode(settings)
+	if err == mongo.ErrNoDocuments {
+		return &model.TenantSettings{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// UpsertTenantSettings stores the settings of the tenant
+func (db *DataStoreMongo) UpsertTenantSettings(
+	ctx context.Context,
+	tenantID string,
+	settings *model.TenantSettings,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(SettingsCollectionName)
+
+	_, err := coll.ReplaceOne(ctx,
+		bson.M{"_id": settingsID},
+		settings,
+		mopts.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// GetSessionLimits returns the session limits of the tenant, or nil if the
+// tenant has none stored
+func (db *DataStoreMongo) GetSessionLimits(
+	ctx context.Context,
+	tenantID string,
+) (*model.SessionLimits, error) {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(SettingsCollectionName)
+
+	limits := &model.SessionLimits{}
+	err := coll.FindOne(ctx, bson.M{"_id": limitsID}).Decode(limits)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// UpsertSessionLimits stores the session limits of the tenant
+func (db *DataStoreMongo) UpsertSessionLimits(
+	ctx context.Context,
+	tenantID string,
+	limits *model.SessionLimits,
+) error {
+	dbname := mstore.DbNameForTenant(tenantID, DbName)
+	coll := db.client.Database(dbname).Collection(SettingsCollectionName)
+
+	_, err := coll.ReplaceOne(ctx,
+		bson.M{"_id": limitsID},
+		limits,
+		mopts.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// InsertRecordingFrame stores a frame of a recorded session
+func (db *DataStoreMongo) InsertRecordingFrame(
+	ctx context.Context,
+	frame *model.RecordingFrame,
+) error {
+	dbname := mstore.DbFromContext(ctx, DbName)
+	coll := db.client.Database(dbname).
+		Collection(RecordingsCollectionName)
+
+	_, err := coll.InsertOne(ctx, frame)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to insert recording frame")
+	}
+	return nil
+}
+
+// GetRecordingFrames returns the recorded frames of a session sorted by time
+func (db *DataStoreMongo) GetRecordingFrames(
+	ctx context.Context,
+	sessionID string,
+) ([]model.RecordingFrame, error) {
+	dbname := mstore.DbFromContext(ctx, DbName)
+	coll := db.client.Database(dbname).
+		Collection(RecordingsCollectionName)
+
+	findOpts := mopts.Find().
+		SetSort(bson.D{{Key: dbFieldTs, Value: 1}})
+	cur, err := coll.Find(ctx,
+		bson.M{dbFieldSessionID: sessionID},
+		findOpts,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to find recording frames")
+	}
+	frames := []model.RecordingFrame{}
+	if err = cur.All(ctx, &frames); err != nil {
+		return nil, errors.Wrap(err,
+			"store: failed to decode recording frames",
+		)
+	}
+	return frames, nil
+}
+
 // Close disconnects the client
 func (db *DataStoreMongo) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
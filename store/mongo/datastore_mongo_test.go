@@ -21,6 +21,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
@@ -129,31 +130,417 @@ func TestUpsertDeviceStatus(t *testing.T) {
 
 	clock = mockClock{}
 
-	err = ds.UpsertDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusConnected)
+	previous, err := ds.UpsertDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusConnected)
 	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusUnknown, previous)
 
 	device, err = ds.GetDevice(ctx, tenantID, deviceID)
 	assert.NoError(t, err)
 	assert.Equal(t, model.DeviceStatusConnected, device.Status)
 	assert.NotEqual(t, mockTime, device.CreatedTs)
 	assert.Equal(t, mockTime, device.UpdatedTs)
+	assert.Equal(t, &mockTime, device.LastSeenTs)
 
 	const anotherDeviceID = "efgh"
-	err = ds.UpsertDeviceStatus(ctx, tenantID, anotherDeviceID, model.DeviceStatusConnected)
+	previous, err = ds.UpsertDeviceStatus(ctx, tenantID, anotherDeviceID, model.DeviceStatusConnected)
 	assert.NoError(t, err)
+	assert.Equal(t, "", previous)
 
 	device, err = ds.GetDevice(ctx, tenantID, anotherDeviceID)
 	assert.NoError(t, err)
 	assert.Equal(t, model.DeviceStatusConnected, device.Status)
 
-	err = ds.UpsertDeviceStatus(ctx, tenantID, anotherDeviceID, model.DeviceStatusDisconnected)
+	previous, err = ds.UpsertDeviceStatus(ctx, tenantID, anotherDeviceID, model.DeviceStatusDisconnected)
 	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusConnected, previous)
 
 	device, err = ds.GetDevice(ctx, tenantID, anotherDeviceID)
 	assert.NoError(t, err)
 	assert.Equal(t, model.DeviceStatusDisconnected, device.Status)
 }
 
+func TestSetDeviceConnected(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSetDeviceConnected in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const (
+		tenantID = "1234"
+		deviceID = "abcd"
+	)
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	oldGeneration, previous, err := ds.SetDeviceConnected(ctx, tenantID, deviceID, "instance")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), oldGeneration)
+	assert.Equal(t, "", previous)
+
+	newGeneration, previous, err := ds.SetDeviceConnected(ctx, tenantID, deviceID, "instance")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), newGeneration)
+	assert.Equal(t, model.DeviceStatusConnected, previous)
+
+	// the disconnection of the old connection is ignored
+	previous, err = ds.SetDeviceDisconnected(ctx, tenantID, deviceID, oldGeneration)
+	assert.NoError(t, err)
+	assert.Equal(t, "", previous)
+	device, err := ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusConnected, device.Status)
+	assert.Equal(t, "instance", device.InstanceID)
+
+	previous, err = ds.SetDeviceDisconnected(ctx, tenantID, deviceID, newGeneration)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusConnected, previous)
+	device, err = ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusDisconnected, device.Status)
+	assert.Empty(t, device.InstanceID)
+}
+
+func TestSetDeviceCapabilities(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSetDeviceCapabilities in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const (
+		tenantID = "1234"
+		deviceID = "abcd"
+	)
+	capabilities := &model.DeviceCapabilities{
+		AgentVersion: "2.0.0",
+		Protocols:    []string{model.ProtocolShell},
+		Shells:       []string{"/bin/sh"},
+		UpdatedTs:    time.Now().UTC().Round(time.Millisecond),
+	}
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	_, _, err := ds.SetDeviceConnected(ctx, tenantID, deviceID, "instance")
+	assert.NoError(t, err)
+
+	err = ds.SetDeviceCapabilities(ctx, tenantID, deviceID, capabilities)
+	assert.NoError(t, err)
+	device, err := ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, capabilities, device.Capabilities)
+
+	// the capabilities are advertised again on every connection
+	_, _, err = ds.SetDeviceConnected(ctx, tenantID, deviceID, "instance")
+	assert.NoError(t, err)
+	device, err = ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Nil(t, device.Capabilities)
+}
+
+func TestUpdateDeviceLastSeen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestUpdateDeviceLastSeen in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const (
+		tenantID = "1234"
+		deviceID = "abcd"
+	)
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	err := ds.ProvisionDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+
+	err = ds.UpdateDeviceLastSeen(ctx, tenantID, deviceID, now)
+	assert.NoError(t, err)
+
+	device, err := ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, &now, device.LastSeenTs)
+
+	// an earlier time does not overwrite the last seen time
+	err = ds.UpdateDeviceLastSeen(ctx, tenantID, deviceID, now.Add(-time.Minute))
+	assert.NoError(t, err)
+
+	device, err = ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, &now, device.LastSeenTs)
+}
+
+func TestRenewDeviceLease(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestRenewDeviceLease in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const (
+		tenantID = "1234"
+		deviceID = "abcd"
+	)
+	expires := time.Now().UTC().Add(time.Minute).Round(time.Millisecond)
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	err := ds.ProvisionDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+
+	// the lease of a device not connected is not renewed
+	err = ds.RenewDeviceLease(ctx, tenantID, deviceID, "instance", expires)
+	assert.NoError(t, err)
+	device, err := ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.True(t, device.LeaseExpiresTs.IsZero())
+
+	_, err = ds.UpsertDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusConnected)
+	assert.NoError(t, err)
+	err = ds.RenewDeviceLease(ctx, tenantID, deviceID, "instance", expires)
+	assert.NoError(t, err)
+	device, err = ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, "instance", device.InstanceID)
+	assert.Equal(t, expires, device.LeaseExpiresTs)
+
+	// updating the status resets the lease
+	_, err = ds.UpsertDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusDisconnected)
+	assert.NoError(t, err)
+	device, err = ds.GetDevice(ctx, tenantID, deviceID)
+	assert.NoError(t, err)
+	assert.Empty(t, device.InstanceID)
+	assert.True(t, device.LeaseExpiresTs.IsZero())
+}
+
+func TestResetStaleDevices(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestResetStaleDevices in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const tenantID = "1234"
+	now := time.Now().UTC()
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	defer db.Client().
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Drop(ctx) //nolint:errcheck
+
+	tenantIDs, err := ds.GetTenantIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, tenantIDs)
+
+	leases := map[string]struct {
+		instanceID string
+		expires    time.Time
+		stale      bool
+	}{
+		"expired": {"live", now.Add(-time.Minute), true},
+		"dead":    {"dead", now.Add(time.Minute), true},
+		"live":    {"live", now.Add(time.Minute), false},
+	}
+	for deviceID, lease := range leases {
+		_, err = ds.UpsertDeviceStatus(ctx, tenantID, deviceID,
+			model.DeviceStatusConnected)
+		assert.NoError(t, err)
+		err = ds.RenewDeviceLease(ctx, tenantID, deviceID,
+			lease.instanceID, lease.expires)
+		assert.NoError(t, err)
+	}
+	// connected before the presence leases were introduced
+	_, err = ds.UpsertDeviceStatus(ctx, tenantID, "legacy",
+		model.DeviceStatusConnected)
+	assert.NoError(t, err)
+
+	tenantIDs, err = ds.GetTenantIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", tenantID}, tenantIDs)
+
+	deviceIDs, err := ds.ResetStaleDevices(ctx, tenantID, []string{"dead"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"expired", "dead"}, deviceIDs)
+
+	for deviceID, lease := range leases {
+		device, err := ds.GetDevice(ctx, tenantID, deviceID)
+		assert.NoError(t, err)
+		if lease.stale {
+			assert.Equal(t, model.DeviceStatusDisconnected, device.Status)
+		} else {
+			assert.Equal(t, model.DeviceStatusConnected, device.Status)
+		}
+	}
+	device, err := ds.GetDevice(ctx, tenantID, "legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusConnected, device.Status)
+}
+
+func TestExpireDevicePresence(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestExpireDevicePresence in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const tenantID = "1234"
+	now := time.Now().UTC()
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	defer db.Client().
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Drop(ctx) //nolint:errcheck
+
+	leases := map[string]struct {
+		expires time.Time
+		expired bool
+	}{
+		"expired": {now.Add(-time.Minute), true},
+		"live":    {now.Add(time.Minute), false},
+	}
+	for deviceID, lease := range leases {
+		_, err := ds.UpsertDeviceStatus(ctx, tenantID, deviceID,
+			model.DeviceStatusConnected)
+		assert.NoError(t, err)
+		err = ds.RenewDeviceLease(ctx, tenantID, deviceID,
+			"deviceconnect-1", lease.expires)
+		assert.NoError(t, err)
+
+		expired, err := ds.ExpireDevicePresence(ctx, tenantID, deviceID)
+		assert.NoError(t, err)
+		assert.Equal(t, lease.expired, expired)
+
+		device, err := ds.GetDevice(ctx, tenantID, deviceID)
+		assert.NoError(t, err)
+		if lease.expired {
+			assert.Equal(t, model.DeviceStatusDisconnected, device.Status)
+		} else {
+			assert.Equal(t, model.DeviceStatusConnected, device.Status)
+		}
+	}
+
+	// the device is updated only once
+	expired, err := ds.ExpireDevicePresence(ctx, tenantID, "expired")
+	assert.NoError(t, err)
+	assert.False(t, expired)
+}
+
+func TestFindDevices(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestFindDevices in short mode.")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+
+	const tenantID = "1234"
+	now := time.Now().UTC()
+
+	ds := DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	defer db.Client().
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Drop(ctx) //nolint:errcheck
+
+	for _, deviceID := range []string{"a", "b", "c"} {
+		_, err := ds.UpsertDeviceStatus(ctx, tenantID, deviceID,
+			model.DeviceStatusConnected)
+		assert.NoError(t, err)
+		// distinct update times
+		time.Sleep(5 * time.Millisecond)
+	}
+	err := ds.RenewDeviceLease(ctx, tenantID, "b", "live", now.Add(time.Minute))
+	assert.NoError(t, err)
+	err = ds.RenewDeviceLease(ctx, tenantID, "c", "dead", now.Add(-time.Minute))
+	assert.NoError(t, err)
+	_, err = ds.UpsertDeviceStatus(ctx, tenantID, "d",
+		model.DeviceStatusDisconnected)
+	assert.NoError(t, err)
+	err = ds.ProvisionDevice(ctx, tenantID, "e")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		Name   string
+		Filter model.DeviceFilter
+
+		IDs   []string
+		Count int64
+	}{
+		{
+			Name:  "all",
+			IDs:   []string{"a", "b", "c", "d", "e"},
+			Count: 5,
+		},
+		{
+			Name: "paginated",
+			Filter: model.DeviceFilter{
+				Skip:  1,
+				Limit: 2,
+			},
+			IDs:   []string{"b", "c"},
+			Count: 5,
+		},
+		{
+			Name: "by ID",
+			Filter: model.DeviceFilter{
+				IDs: []string{"e", "a", "z"},
+			},
+			IDs:   []string{"a", "e"},
+			Count: 2,
+		},
+		{
+			Name: "connected",
+			Filter: model.DeviceFilter{
+				Status: model.DeviceStatusConnected,
+			},
+			IDs:   []string{"a", "b"},
+			Count: 2,
+		},
+		{
+			Name: "connected, most recently updated first",
+			Filter: model.DeviceFilter{
+				Status: model.DeviceStatusConnected,
+				Sort:   model.SortDescending,
+			},
+			IDs:   []string{"b", "a"},
+			Count: 2,
+		},
+		{
+			Name: "disconnected",
+			Filter: model.DeviceFilter{
+				Status: model.DeviceStatusDisconnected,
+			},
+			IDs:   []string{"c", "d"},
+			Count: 2,
+		},
+		{
+			Name: "unknown by ID",
+			Filter: model.DeviceFilter{
+				IDs:    []string{"a", "e"},
+				Status: model.DeviceStatusUnknown,
+			},
+			IDs:   []string{"e"},
+			Count: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			devices, count, err := ds.FindDevices(ctx, tenantID, tc.Filter)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Count, count)
+			ids := make([]string, len(devices))
+			for i, device := range devices {
+				ids[i] = device.ID
+			}
+			assert.Equal(t, tc.IDs, ids)
+		})
+	}
+}
+
 type brokenReader struct{}
 
 func (r brokenReader) Read(b []byte) (int, error) {
@@ -219,7 +606,7 @@ func TestAllocateSession(t *testing.T) {
 			ds := DataStoreMongo{client: db.Client()}
 			defer ds.DropDatabase()
 
-			err := ds.AllocateSession(tc.CTX, tc.Session)
+			err := ds.AllocateSession(tc.CTX, tc.Session, model.SessionLimits{})
 			if tc.Erre != nil {
 				if assert.Error(t, err) {
 					assert.Regexp(t, tc.Erre.Error(), err.Error())
@@ -426,3 +813,608 @@ func TestGetSession(t *testing.T) {
 		})
 	}
 }
+
+func TestFindSessions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestFindSessions in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	now := time.Now().UTC().Round(time.Second)
+	sessions := []model.Session{{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		TenantID: tenantID,
+		StartTS:  now.Add(-time.Hour),
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000003",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		TenantID: tenantID,
+		StartTS:  now,
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000004",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000005",
+		TenantID: tenantID,
+		StartTS:  now.Add(time.Minute),
+	}}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	collSess := db.Client().
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Collection(SessionsCollectionName)
+	for _, sess := range sessions {
+		_, err := collSess.InsertOne(ctx, sess)
+		if err != nil {
+			panic(errors.Wrap(err,
+				"[TEST ERR] Failed to prepare test case",
+			))
+		}
+	}
+
+	res, count, err := ds.FindSessions(ctx, model.SessionFilter{
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.Session{sessions[1], sessions[0]}, res)
+
+	res, count, err = ds.FindSessions(ctx, model.SessionFilter{
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		Skip:     1,
+		Limit:    1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.Session{sessions[0]}, res)
+
+	from := now.Add(-time.Minute)
+	res, count, err = ds.FindSessions(ctx, model.SessionFilter{
+		UserID:      "00000000-0000-0000-0000-000000000001",
+		StartTsFrom: &from,
+		Sort:        model.SortAscending,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.Session{sessions[1], sessions[2]}, res)
+
+	res, count, err = ds.FindSessions(ctx, model.SessionFilter{
+		DeviceIDs: []string{
+			"00000000-0000-0000-0000-000000000005",
+			"00000000-0000-0000-0000-000000000006",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, []model.Session{sessions[2]}, res)
+
+	res, count, err = ds.FindSessions(ctx, model.SessionFilter{
+		DeviceIDs: []string{},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+	assert.Len(t, res, 0)
+}
+
+func TestCloseSession(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestCloseSession in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		Status:   model.SessionStatusConnected,
+		TenantID: tenantID,
+		StartTS:  time.Now().UTC().Add(-time.Minute),
+	}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	err := ds.AllocateSession(ctx, sess, model.SessionLimits{})
+	if err != nil {
+		panic(errors.Wrap(err,
+			"[TEST ERR] Failed to prepare test case",
+		))
+	}
+
+	end := model.SessionEnd{
+		Reason:          model.SessionCloseReasonUserDisconnect,
+		BytesToDevice:   10,
+		BytesFromDevice: 20,
+	}
+	res, err := ds.CloseSession(ctx, sess.ID, end)
+	if assert.NoError(t, err) {
+		assert.Equal(t, model.SessionStatusDisconnected, res.Status)
+		assert.Equal(t, model.SessionCloseReasonUserDisconnect, res.CloseReason)
+		assert.Equal(t, int64(10), res.BytesToDevice)
+		assert.Equal(t, int64(20), res.BytesFromDevice)
+		assert.NotNil(t, res.EndTS)
+		assert.InDelta(t, 60, res.Duration, 5)
+	}
+
+	// The session is kept in the history and cannot be closed again
+	_, err = ds.CloseSession(ctx, sess.ID, end)
+	assert.Equal(t, store.ErrSessionNotFound, err)
+
+	res, err = ds.GetSession(ctx, sess.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, model.SessionStatusDisconnected, res.Status)
+		assert.Equal(t, int64(20), res.BytesToDevice)
+		assert.Equal(t, int64(40), res.BytesFromDevice)
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestTenantSettings in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := context.Background()
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	settings, err := ds.GetTenantSettings(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.TenantSettings{}, settings)
+
+	err = ds.UpsertTenantSettings(ctx, tenantID,
+		&model.TenantSettings{RecordSessions: true},
+	)
+	assert.NoError(t, err)
+
+	settings, err = ds.GetTenantSettings(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.TenantSettings{RecordSessions: true}, settings)
+}
+
+func TestInsertRecordingFrame(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestInsertRecordingFrame in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	frame := &model.RecordingFrame{
+		SessionID: "00000000-0000-0000-0000-000000000000",
+		Timestamp: time.Now().UTC().Round(time.Millisecond),
+		Direction: model.RecordingDirectionOutput,
+		Data:      []byte("data"),
+	}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	err := ds.InsertRecordingFrame(ctx, frame)
+	assert.NoError(t, err)
+
+	res := &model.RecordingFrame{}
+	err = db.Client().
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Collection(RecordingsCollectionName).
+		FindOne(ctx, bson.M{dbFieldSessionID: frame.SessionID}).
+		Decode(res)
+	assert.NoError(t, err)
+	assert.Equal(t, frame, res)
+}
+
+func TestGetRecordingFrames(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestGetRecordingFrames in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	now := time.Now().UTC().Round(time.Millisecond)
+	frames := []model.RecordingFrame{{
+		SessionID: sessionID,
+		Timestamp: now.Add(time.Second),
+		Direction: model.RecordingDirectionOutput,
+		Data:      []byte("second"),
+	}, {
+		SessionID: sessionID,
+		Timestamp: now,
+		Direction: model.RecordingDirectionInput,
+		Data:      []byte("first"),
+	}, {
+		SessionID: "00000000-0000-0000-0000-000000000001",
+		Timestamp: now,
+		Direction: model.RecordingDirectionOutput,
+		Data:      []byte("other"),
+	}}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	for i := range frames {
+		err := ds.InsertRecordingFrame(ctx, &frames[i])
+		if err != nil {
+			panic(errors.Wrap(err,
+				"[TEST ERR] Failed to prepare test case",
+			))
+		}
+	}
+
+	res, err := ds.GetRecordingFrames(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.RecordingFrame{frames[1], frames[0]}, res)
+}
+
+func TestSessionObservers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSessionObservers in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		Status:   model.SessionStatusConnected,
+		TenantID: tenantID,
+		StartTS:  time.Now().UTC().Round(time.Second),
+	}
+	observer := &model.SessionObserver{
+		ID:      "00000000-0000-0000-0000-000000000003",
+		UserID:  "00000000-0000-0000-0000-000000000004",
+		StartTS: time.Now().UTC().Round(time.Second),
+	}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	err := ds.AllocateSession(ctx, sess, model.SessionLimits{})
+	if err != nil {
+		panic(errors.Wrap(err,
+			"[TEST ERR] Failed to prepare test case",
+		))
+	}
+
+	res, err := ds.AddSessionObserver(ctx, sess.ID, observer)
+	if assert.NoError(t, err) && assert.Len(t, res.Observers, 1) {
+		assert.Equal(t, *observer, res.Observers[0])
+	}
+
+	res, err = ds.CloseSessionObserver(ctx, sess.ID, observer.ID)
+	if assert.NoError(t, err) && assert.Len(t, res.Observers, 1) {
+		assert.NotNil(t, res.Observers[0].EndTS)
+	}
+
+	_, err = ds.CloseSessionObserver(ctx, sess.ID, "unknown")
+	assert.Equal(t, store.ErrSessionNotFound, err)
+
+	_, err = ds.CloseSession(ctx, sess.ID, model.SessionEnd{})
+	assert.NoError(t, err)
+	_, err = ds.AddSessionObserver(ctx, sess.ID, observer)
+	assert.Equal(t, store.ErrSessionNotFound, err)
+}
+
+func TestAllocateSessionLimits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestAllocateSessionLimits in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	newSession := func(id, userID, deviceID string) *model.Session {
+		return &model.Session{
+			ID:       id,
+			UserID:   userID,
+			DeviceID: deviceID,
+			Status:   model.SessionStatusConnected,
+			TenantID: tenantID,
+			StartTS:  time.Now().UTC(),
+		}
+	}
+	limits := model.SessionLimits{
+		MaxPerDevice: 1,
+		MaxPerUser:   2,
+		MaxPerTenant: 3,
+	}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	//nolint:errcheck
+	defer ds.client.
+		Database(mstore.DbNameForTenant(tenantID, DbName)).
+		Drop(ctx)
+
+	err := ds.AllocateSession(ctx, newSession("1", "user1", "device1"), limits)
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, newSession("2", "user2", "device1"), limits)
+	assert.Equal(t, store.ErrDeviceSessionLimit, err)
+	err = ds.AllocateSession(ctx, newSession("3", "user1", "device2"), limits)
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, newSession("4", "user1", "device3"), limits)
+	assert.Equal(t, store.ErrUserSessionLimit, err)
+	err = ds.AllocateSession(ctx, newSession("5", "user2", "device3"), limits)
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, newSession("6", "user3", "device4"), limits)
+	assert.Equal(t, store.ErrTenantSessionLimit, err)
+
+	// closing a session releases its slots
+	_, err = ds.CloseSession(ctx, "1", model.SessionEnd{})
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, newSession("7", "user3", "device1"), limits)
+	assert.NoError(t, err)
+
+	// deleting a session releases its slots
+	_, err = ds.DeleteSession(ctx, "7")
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, newSession("8", "user3", "device1"), limits)
+	assert.NoError(t, err)
+
+	// zero means unlimited
+	err = ds.AllocateSession(
+		ctx, newSession("9", "user3", "device1"), model.SessionLimits{},
+	)
+	assert.NoError(t, err)
+}
+
+func TestRebuildSessionCounters(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestRebuildSessionCounters in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(
+		context.Background(),
+		&identity.Identity{
+			Tenant: tenantID,
+		},
+	)
+	limits := model.SessionLimits{MaxPerDevice: 1}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	database := ds.client.Database(mstore.DbNameForTenant(tenantID, DbName))
+	//nolint:errcheck
+	defer database.Drop(ctx)
+
+	for _, sess := range []*model.Session{{
+		ID: "1", UserID: "user1", DeviceID: "device1",
+	}, {
+		ID: "2", UserID: "user1", DeviceID: "device2",
+	}} {
+		sess.Status = model.SessionStatusConnected
+		sess.TenantID = tenantID
+		sess.StartTS = time.Now().UTC()
+		err := ds.AllocateSession(ctx, sess, limits)
+		assert.NoError(t, err)
+	}
+	// the instance relaying the session crashed, the session is closed
+	// without releasing its slots
+	_, err := database.Collection(SessionsCollectionName).UpdateOne(ctx,
+		bson.M{"_id": "1"},
+		bson.M{"$set": bson.M{dbFieldStatus: model.SessionStatusDisconnected}},
+	)
+	assert.NoError(t, err)
+	err = ds.AllocateSession(ctx, &model.Session{
+		ID: "3", UserID: "user2", DeviceID: "device1",
+		Status: model.SessionStatusConnected, TenantID: tenantID,
+		StartTS: time.Now().UTC(),
+	}, limits)
+	assert.Equal(t, store.ErrDeviceSessionLimit, err)
+
+	err = ds.RebuildSessionCounters(ctx, tenantID)
+	assert.NoError(t, err)
+
+	counts := map[string]int{}
+	cur, err := database.Collection(CountersCollectionName).Find(ctx, bson.M{})
+	assert.NoError(t, err)
+	var counters []struct {
+		ID    string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	assert.NoError(t, cur.All(ctx, &counters))
+	for _, counter := range counters {
+		counts[counter.ID] = counter.Count
+	}
+	assert.Equal(t, map[string]int{
+		"device:device1": 0,
+		"device:device2": 1,
+		"user:user1":     1,
+		"tenant":         1,
+	}, counts)
+}
+
+func TestSessionLimits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSessionLimits in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := context.Background()
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	limits, err := ds.GetSessionLimits(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Nil(t, limits)
+
+	expected := &model.SessionLimits{MaxPerDevice: 1, MaxPerUser: 2}
+	err = ds.UpsertSessionLimits(ctx, tenantID, expected)
+	assert.NoError(t, err)
+	limits, err = ds.GetSessionLimits(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, limits)
+}
+
+func TestConnectionEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestConnectionEvents in short mode.")
+	}
+	const deviceID = "00000000-0000-0000-0000-000000000000"
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Millisecond)
+	events := []model.ConnectionEvent{{
+		ID:         "00000000-0000-0000-0000-000000000001",
+		DeviceID:   deviceID,
+		Type:       model.ConnectionEventConnected,
+		Timestamp:  now,
+		RemoteAddr: "10.0.0.1",
+	}, {
+		ID:         "00000000-0000-0000-0000-000000000002",
+		DeviceID:   deviceID,
+		Type:       model.ConnectionEventDisconnected,
+		Timestamp:  now.Add(time.Minute),
+		RemoteAddr: "10.0.0.1",
+		Reason:     model.DisconnectReasonTimeout,
+		Error:      "i/o timeout",
+	}, {
+		ID:        "00000000-0000-0000-0000-000000000003",
+		DeviceID:  "00000000-0000-0000-0000-000000000001",
+		Type:      model.ConnectionEventConnected,
+		Timestamp: now,
+	}}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	for i := range events {
+		err := ds.InsertConnectionEvent(ctx, "", &events[i])
+		if err != nil {
+			panic(errors.Wrap(err,
+				"[TEST ERR] Failed to prepare test case",
+			))
+		}
+	}
+	err := ds.InsertConnectionEvent(ctx, "", &model.ConnectionEvent{})
+	assert.Error(t, err)
+
+	res, count, err := ds.FindConnectionEvents(ctx, "", model.ConnectionFilter{
+		DeviceID: deviceID,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.ConnectionEvent{events[1], events[0]}, res)
+
+	res, count, err = ds.FindConnectionEvents(ctx, "", model.ConnectionFilter{
+		DeviceID: deviceID,
+		Skip:     1,
+		Limit:    1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.ConnectionEvent{events[0]}, res)
+}
+
+func TestWebhooks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestWebhooks in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Millisecond)
+	webhooks := []model.Webhook{{
+		ID:        "00000000-0000-0000-0000-000000000001",
+		URL:       "https://example.com/hooks",
+		Secret:    "0123456789abcdef",
+		Events:    []string{model.WebhookEventDeviceConnected},
+		CreatedTs: now,
+	}, {
+		ID:        "00000000-0000-0000-0000-000000000002",
+		URL:       "https://example.com/other",
+		Secret:    "fedcba9876543210",
+		Events:    []string{model.WebhookEventSessionEnded},
+		CreatedTs: now.Add(time.Minute),
+	}}
+	deliveries := []model.WebhookDelivery{{
+		ID:        "00000000-0000-0000-0000-000000000003",
+		WebhookID: webhooks[0].ID,
+		EventID:   "00000000-0000-0000-0000-000000000004",
+		EventType: model.WebhookEventDeviceConnected,
+		Status:    model.WebhookDeliveryStatusDelivered,
+		Attempts:  1,
+		Timestamp: now,
+	}, {
+		ID:         "00000000-0000-0000-0000-000000000005",
+		WebhookID:  webhooks[0].ID,
+		EventID:    "00000000-0000-0000-0000-000000000006",
+		EventType:  model.WebhookEventDeviceConnected,
+		Status:     model.WebhookDeliveryStatusFailed,
+		Attempts:   5,
+		StatusCode: 502,
+		Error:      "502 Bad Gateway",
+		Timestamp:  now.Add(time.Minute),
+	}}
+
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+	for i := range webhooks {
+		err := ds.InsertWebhook(ctx, tenantID, &webhooks[i])
+		if err != nil {
+			panic(errors.Wrap(err,
+				"[TEST ERR] Failed to prepare test case",
+			))
+		}
+	}
+	for i := range deliveries {
+		err := ds.InsertWebhookDelivery(ctx, tenantID, &deliveries[i])
+		if err != nil {
+			panic(errors.Wrap(err,
+				"[TEST ERR] Failed to prepare test case",
+			))
+		}
+	}
+	err := ds.InsertWebhook(ctx, tenantID, &model.Webhook{
+		URL: "http://example.com/hooks",
+	})
+	assert.Error(t, err)
+
+	res, err := ds.FindWebhooks(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, webhooks, res)
+
+	log, count, err := ds.FindWebhookDeliveries(ctx, tenantID,
+		model.WebhookDeliveryFilter{
+			WebhookID: webhooks[0].ID,
+			Limit:     1,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, []model.WebhookDelivery{deliveries[1]}, log)
+
+	err = ds.DeleteWebhook(ctx, tenantID, webhooks[0].ID)
+	assert.NoError(t, err)
+	err = ds.DeleteWebhook(ctx, tenantID, webhooks[0].ID)
+	assert.Equal(t, store.ErrWebhookNotFound, err)
+
+	res, err = ds.FindWebhooks(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Equal(t, webhooks[1:], res)
+	_, count, err = ds.FindWebhookDeliveries(ctx, tenantID,
+		model.WebhookDeliveryFilter{WebhookID: webhooks[0].ID},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// IndexNameSessionsUserStartTs is the name of the index used to
+	// look up the sessions of a user.
+	IndexNameSessionsUserStartTs = "user_id_1_start_ts_-1"
+	// IndexNameSessionsStartTs is the name of the index used to
+	// look up the sessions by start time.
+	IndexNameSessionsStartTs = "start_ts_-1"
+)
+
+type migration_1_1_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the indexes used to search the sessions of the tenant
+func (m *migration_1_1_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collSess := m.client.Database(m.db).Collection(SessionsCollectionName)
+
+	_, err := collSess.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: dbFieldUserID, Value: 1},
+			{Key: dbFieldStartTs, Value: -1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameSessionsUserStartTs),
+	}, {
+		Keys: bson.D{
+			{Key: dbFieldStartTs, Value: -1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameSessionsStartTs),
+	}})
+	return err
+}
+
+func (m *migration_1_1_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 1, 0)
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+type migration_1_2_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up marks the sessions created before sessions were kept after closing as
+// connected.
+func (m *migration_1_2_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collSess := m.client.Database(m.db).Collection(SessionsCollectionName)
+
+	_, err := collSess.UpdateMany(ctx,
+		bson.M{dbFieldStatus: bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{dbFieldStatus: model.SessionStatusConnected}},
+	)
+	return err
+}
+
+func (m *migration_1_2_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 2, 0)
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// IndexNameRecordingsSessionTs is the name of the index used to
+	// look up the recorded frames of a session.
+	IndexNameRecordingsSessionTs = "session_id_1_ts_1"
+)
+
+type migration_1_3_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the index on the recordings collection
+func (m *migration_1_3_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collRec := m.client.Database(m.db).Collection(RecordingsCollectionName)
+
+	_, err := collRec.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: dbFieldSessionID, Value: 1},
+			{Key: dbFieldTs, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameRecordingsSessionTs),
+	})
+	return err
+}
+
+func (m *migration_1_3_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 3, 0)
+}
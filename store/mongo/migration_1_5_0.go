@@ -0,0 +1,55 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// IndexNameDevicesStatus is the name of the index used to look up the
+	// devices by status.
+	IndexNameDevicesStatus = "status_1__id_1"
+)
+
+type migration_1_5_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the index used to search the devices by status
+func (m *migration_1_5_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collDev := m.client.Database(m.db).Collection(DevicesCollectionName)
+
+	_, err := collDev.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: dbFieldStatus, Value: 1},
+			{Key: "_id", Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameDevicesStatus),
+	})
+	return err
+}
+
+func (m *migration_1_5_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 5, 0)
+}
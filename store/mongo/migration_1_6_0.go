@@ -0,0 +1,56 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// IndexNameDevicesStatusUpdatedTs is the name of the index used to
+	// list the devices by status, most recently updated first.
+	IndexNameDevicesStatusUpdatedTs = "status_1_updated_ts_-1__id_1"
+)
+
+type migration_1_6_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the index used to list the devices by status and update time
+func (m *migration_1_6_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collDev := m.client.Database(m.db).Collection(DevicesCollectionName)
+
+	_, err := collDev.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: dbFieldStatus, Value: 1},
+			{Key: dbFieldUpdatedTs, Value: -1},
+			{Key: "_id", Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameDevicesStatusUpdatedTs),
+	})
+	return err
+}
+
+func (m *migration_1_6_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 6, 0)
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// IndexNameWebhookDeliveriesTs is the name of the index used to look
+	// up the delivery log of a webhook.
+	IndexNameWebhookDeliveriesTs = "webhook_id_1_ts_-1"
+)
+
+type migration_1_7_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the index on the webhook deliveries collection
+func (m *migration_1_7_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collDeliveries := m.client.Database(m.db).
+		Collection(WebhookDeliveriesCollectionName)
+
+	_, err := collDeliveries.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: dbFieldWebhookID, Value: 1},
+			{Key: dbFieldTs, Value: -1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameWebhookDeliveriesTs),
+	})
+	return err
+}
+
+func (m *migration_1_7_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 7, 0)
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type migration_1_8_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up seeds the counters of open sessions from the connected sessions
+func (m *migration_1_8_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	return rebuildSessionCounters(ctx, m.client.Database(m.db))
+}
+
+func (m *migration_1_8_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 8, 0)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+type migration_1_9_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up disconnects the devices reported connected by the previous versions of
+// the service, which record neither the instance holding the connection nor
+// a presence lease and thus are never reset by the reconciliation; then it
+// closes their sessions, which carry no connection generation, and rebuilds
+// the counters of open sessions.
+func (m *migration_1_9_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	database := m.client.Database(m.db)
+	collDevs := database.Collection(DevicesCollectionName)
+	collSess := database.Collection(SessionsCollectionName)
+
+	now := time.Now().UTC()
+	_, err := collDevs.UpdateMany(ctx,
+		bson.M{
+			dbFieldStatus:   model.DeviceStatusConnected,
+			dbFieldInstance: bson.M{"$exists": false},
+			dbFieldLeaseExp: bson.M{"$exists": false},
+		},
+		staleDeviceUpdate(now),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = collSess.UpdateMany(ctx,
+		bson.M{
+			dbFieldStatus:    model.SessionStatusConnected,
+			dbFieldDeviceGen: bson.M{"$exists": false},
+		},
+		mongo.Pipeline{{{Key: "$set", Value: bson.D{
+			{Key: dbFieldStatus, Value: model.SessionStatusDisconnected},
+			{Key: dbFieldEndTs, Value: now},
+			{Key: dbFieldDuration, Value: bson.D{{Key: "$divide", Value: bson.A{
+				bson.D{{Key: "$subtract", Value: bson.A{
+					now, "$" + dbFieldStartTs,
+				}}}, 1000,
+			}}}},
+			{Key: dbFieldCloseReason,
+				Value: model.SessionCloseReasonDeviceDisconnect},
+		}}}},
+	)
+	if err != nil {
+		return err
+	}
+	return rebuildSessionCounters(ctx, database)
+}
+
+func (m *migration_1_9_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 9, 0)
+}
@@ -25,7 +25,7 @@ import (
 
 const (
 	// DbVersion is the current schema version
-	DbVersion = "0.0.0"
+	DbVersion = "1.9.0"
 
 	// DbName is the database name
 	DbName = "deviceconnect"
@@ -52,7 +52,48 @@ func Migrate(ctx context.Context,
 		Automigrate: automigrate,
 	}
 
-	migrations := []migrate.Migration{}
+	migrations := []migrate.Migration{
+		&migration_1_0_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_1_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_2_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_3_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_4_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_5_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_6_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_7_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_8_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_9_0{
+			client: client,
+			db:     db,
+		},
+	}
 
 	err = m.Apply(ctx, *ver, migrations)
 	if err != nil {